@@ -0,0 +1,405 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file has the admin API, for managing a live server. It's served on its own address, which has to be on
+// the local machine, and every request needs the admin token from the config in an "Authorization: Bearer"
+// header. Everything it does goes to the audit log.
+//
+// The API is JSON over HTTP:
+//
+//	GET  /connections     everyone connected
+//	GET  /matches         the battles going on
+//	GET  /bans            the bans that haven't run out
+//	POST /kick            {"name": ...} or {"conn": ...}
+//	POST /mute            {"name": ... or "conn": ..., "duration": "10m"}; a duration of "0s" unmutes
+//	POST /ban             {"name": ... or "ip": ..., "duration": "1h"}
+//	POST /end-match       {"match": ...}, which calls it off as a no-contest
+//	POST /notice          {"message": ...}, which is shown to everyone in the lobby chat
+//	POST /reload-balance  reloads the balance file (see balance.go)
+//
+// The dispatcher owns everything the API works on, so the handlers pass each action to it as an adminCommand and
+// wait for the answer.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The least an admin token can be, so it can't be guessed.
+const ADMIN_TOKEN_MIN_LENGTH = 16
+
+// The name of the audit log in the data directory.
+const AUDIT_FILE = "audit.jsonl"
+
+// adminCommand is an admin action for the dispatcher to carry out. The answer is sent on Reply.
+type adminCommand struct {
+	Action string
+	Args   adminArgs
+	// The new archetypes, for reload-balance.
+	Archetypes []Archetype
+	Reply      chan adminReply
+}
+
+// adminArgs is what an admin request can say. Each action only uses some of it.
+type adminArgs struct {
+	Name     string   `json:"name,omitempty"`
+	IP       string   `json:"ip,omitempty"`
+	Conn     uint64   `json:"conn,omitempty"`
+	Match    uint64   `json:"match,omitempty"`
+	Duration Duration `json:"duration,omitempty"`
+	Message  string   `json:"message,omitempty"`
+}
+
+type adminReply struct {
+	Result interface{}
+	Err    error
+}
+
+// errNotFound is returned when an admin action is about a user or match that isn't there.
+var errNotFound = errors.New("not found")
+
+// adminConnection is how the admin API describes a connection.
+type adminConnection struct {
+	Conn       uint64     `json:"conn"`
+	Name       string     `json:"name"`
+	Addr       string     `json:"addr"`
+	Ready      bool       `json:"ready"`
+	Queue      string     `json:"queue,omitempty"`
+	Match      uint64     `json:"match,omitempty"`
+	MutedUntil *time.Time `json:"mutedUntil,omitempty"`
+}
+
+// adminMatch is how the admin API describes a battle.
+type adminMatch struct {
+	Match   uint64    `json:"match"`
+	Mode    string    `json:"mode"`
+	Rated   bool      `json:"rated"`
+	Players []string  `json:"players"`
+	Started time.Time `json:"started"`
+	Worker  string    `json:"worker,omitempty"`
+}
+
+// A Ban keeps anyone with a name or from an IP address out until it runs out.
+type Ban struct {
+	Name  string    `json:"name,omitempty"`
+	IP    string    `json:"ip,omitempty"`
+	Until time.Time `json:"until"`
+}
+
+// bans is the list of bans. Only the dispatcher uses it.
+type bans []Ban
+
+// check returns the ban that keeps out a user with the given name or address, or nil if there isn't one. Bans that
+// have run out are forgotten.
+func (b *bans) check(name, addr string) *Ban {
+	now := time.Now()
+	live := (*b)[:0]
+	for _, ban := range *b {
+		if now.Before(ban.Until) {
+			live = append(live, ban)
+		}
+	}
+	*b = live
+	for i, ban := range *b {
+		if (ban.Name != "" && strings.EqualFold(ban.Name, name)) || (ban.IP != "" && ban.IP == addr) {
+			return &(*b)[i]
+		}
+	}
+	return nil
+}
+
+// kick tells a connection's goroutine to close the connection, with the reason as the close message.
+type kick struct {
+	Reason string
+}
+
+// reason is what a banned user is told when they're kicked out.
+func (ban Ban) reason() string {
+	return "you're banned until " + ban.Until.UTC().Format(time.RFC1123)
+}
+
+// handleAdmin carries out an admin command. It's called by the dispatcher, with the dispatcher's state.
+func handleAdmin(cmd adminCommand, clients map[*ConnInfo]*User, live *liveMatches, banned *bans) (interface{}, error) {
+	args := cmd.Args
+	switch cmd.Action {
+	case "connections":
+		list := []adminConnection{}
+		for conn, user := range clients {
+			c := adminConnection{Conn: conn.ID, Name: user.Name, Addr: conn.Addr, Ready: user.Ready, Queue: user.Queue}
+			if user.InGame {
+				c.Match = user.Match.ID
+			}
+			if time.Now().Before(user.MutedUntil) {
+				c.MutedUntil = &user.MutedUntil
+			}
+			list = append(list, c)
+		}
+		return list, nil
+	case "matches":
+		list := []adminMatch{}
+		for match, info := range live.matches {
+			list = append(list, adminMatch{Match: match.ID, Mode: info.Mode, Rated: info.Rated, Players: info.Players,
+				Started: info.Started, Worker: info.Worker})
+		}
+		return list, nil
+	case "bans":
+		banned.check("", "")
+		return append([]Ban{}, *banned...), nil
+	case "kick":
+		conn := findConn(clients, args)
+		if conn == nil {
+			return nil, errNotFound
+		}
+		conn.Send(kick{Reason: "you were kicked by an admin"})
+		return nil, nil
+	case "mute":
+		conn := findConn(clients, args)
+		if conn == nil {
+			return nil, errNotFound
+		}
+		if args.Duration < 0 {
+			return nil, errors.New("a mute can't last a negative time")
+		}
+		clients[conn].MutedUntil = time.Now().Add(time.Duration(args.Duration))
+		return nil, nil
+	case "ban":
+		if (args.Name == "") == (args.IP == "") {
+			return nil, errors.New("a ban is for either a name or an IP address")
+		}
+		if args.IP != "" && net.ParseIP(args.IP) == nil {
+			return nil, errors.Errorf("bad IP address %q", args.IP)
+		}
+		if args.Duration <= 0 {
+			return nil, errors.New("a ban has to last a while")
+		}
+		ban := Ban{Name: args.Name, IP: args.IP, Until: time.Now().Add(time.Duration(args.Duration))}
+		*banned = append(*banned, ban)
+		// Anyone it's for who's already here is kicked out.
+		for conn, user := range clients {
+			if banned.check(user.Name, conn.Addr) != nil {
+				conn.Send(kick{Reason: ban.reason()})
+			}
+		}
+		return nil, nil
+	case "end-match":
+		for match := range live.matches {
+			if match.ID == args.Match {
+				// It's recorded when it's over, like any other battle.
+				match.Abort()
+				return nil, nil
+			}
+		}
+		return nil, errNotFound
+	case "notice":
+		if args.Message == "" {
+			return nil, errors.New("the notice is empty")
+		}
+		for conn := range clients {
+			conn.Send(Message{Username: "server", Content: args.Message})
+		}
+		return nil, nil
+	case "reload-balance":
+		ARCHETYPES = cmd.Archetypes
+		// Everyone fights with the new stats in their next battle. Battles going on keep the old ones.
+		for _, user := range clients {
+			user.Archetype = getArchetypeByName(user.Archetype.Name)
+		}
+		return nil, nil
+	}
+	return nil, errors.Errorf("there's no admin action called %q", cmd.Action)
+}
+
+// findConn finds the connection an admin action is about, by its ID or by the user's name. It returns nil if
+// they aren't connected.
+func findConn(clients map[*ConnInfo]*User, args adminArgs) *ConnInfo {
+	if args.Conn != 0 {
+		for conn := range clients {
+			if conn.ID == args.Conn {
+				return conn
+			}
+		}
+		return nil
+	}
+	if args.Name == "" {
+		return nil
+	}
+	return connByName(clients, args.Name)
+}
+
+// validAdminAddr returns an error if the admin API's address isn't on the local machine.
+func validAdminAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrap(err, "bad admin address")
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return errors.Errorf("the admin address %q has to be on localhost", addr)
+	}
+	return nil
+}
+
+// adminHandler serves the admin API, passing actions to the dispatcher through commands. The balance file is
+// what reload-balance loads, and it's an error to reload it if it's empty.
+func adminHandler(commands chan<- adminCommand, token, balanceFile string, audit *AuditLog) http.Handler {
+	mux := http.NewServeMux()
+	for _, action := range []string{"connections", "matches", "bans"} {
+		mux.HandleFunc("/"+action, adminAction(commands, action, http.MethodGet, "", audit))
+	}
+	for _, action := range []string{"kick", "mute", "ban", "end-match", "notice", "reload-balance"} {
+		mux.HandleFunc("/"+action, adminAction(commands, action, http.MethodPost, balanceFile, audit))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			audit.Record(AuditEntry{Action: strings.TrimPrefix(r.URL.Path, "/"), Remote: r.RemoteAddr,
+				Error: "bad token"})
+			writeAdminReply(w, http.StatusUnauthorized, nil, errors.New("bad token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminAction handles one of the admin API's actions, which has to be requested with the given method.
+func adminAction(commands chan<- adminCommand, action, method, balanceFile string, audit *AuditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeAdminReply(w, http.StatusMethodNotAllowed, nil, errors.New(action+" has to be a "+method))
+			return
+		}
+		cmd := adminCommand{Action: action, Reply: make(chan adminReply, 1)}
+		entry := AuditEntry{Action: action, Remote: r.RemoteAddr}
+		// The listings don't change anything, so they aren't worth auditing.
+		audited := method == http.MethodPost
+		fail := func(status int, err error) {
+			if audited {
+				entry.Error = err.Error()
+				audit.Record(entry)
+			}
+			writeAdminReply(w, status, nil, err)
+		}
+		if r.Method == http.MethodPost && r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&cmd.Args); err != nil {
+				fail(http.StatusBadRequest, errors.Wrap(err, "bad request"))
+				return
+			}
+		}
+		entry.Args = cmd.Args
+		if action == "reload-balance" {
+			if balanceFile == "" {
+				fail(http.StatusBadRequest, errors.New("there's no balance file configured"))
+				return
+			}
+			var err error
+			if cmd.Archetypes, err = LoadBalance(balanceFile); err != nil {
+				fail(http.StatusBadRequest, err)
+				return
+			}
+		}
+		var reply adminReply
+		select {
+		case commands <- cmd:
+			reply = <-cmd.Reply
+		case <-r.Context().Done():
+			return
+		}
+		if reply.Err == errNotFound {
+			fail(http.StatusNotFound, reply.Err)
+			return
+		} else if reply.Err != nil {
+			fail(http.StatusBadRequest, reply.Err)
+			return
+		}
+		if audited {
+			audit.Record(entry)
+		}
+		writeAdminReply(w, http.StatusOK, reply.Result, nil)
+	}
+}
+
+// writeAdminReply writes the result of an admin request, or the error if there is one.
+func writeAdminReply(w http.ResponseWriter, status int, result interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err != nil {
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	} else if result != nil {
+		json.NewEncoder(w).Encode(result)
+	} else {
+		json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+	}
+}
+
+// AuditEntry is what the audit log says about an admin action.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Args   adminArgs `json:"args"`
+	Remote string    `json:"remote"`
+	// Why the action failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// AuditLog records admin actions, both in the server's log and, if it has a file, as a line of JSON in the file.
+// Unlike the results log, every entry is written out right away. It's safe to use from more than one goroutine.
+type AuditLog struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// OpenAuditLog opens the audit log at the given path, creating it if it isn't there yet. If the path is empty,
+// the audit log only goes to the server's log.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if path == "" {
+		return &AuditLog{}, nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "when opening audit log")
+	}
+	return &AuditLog{file: file}, nil
+}
+
+// Record adds an admin action to the log.
+func (l *AuditLog) Record(entry AuditEntry) {
+	entry.Time = time.Now()
+	slog.Info("admin action", "action", entry.Action, "args", entry.Args, "remote", entry.Remote, "error", entry.Error)
+	if l.file == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("couldn't encode audit entry", "err", err)
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		slog.Error("couldn't write audit log", "err", err)
+	}
+}
+
+// Close closes the audit log's file.
+func (l *AuditLog) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return errors.Wrap(l.file.Close(), "when closing audit log")
+}
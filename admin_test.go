@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const TEST_ADMIN_TOKEN = "0123456789abcdef"
+
+// adminRequest makes a request to the admin API and returns the status and the decoded response.
+func adminRequest(t *testing.T, handler http.Handler, method, path, body string) (int, interface{}) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+TEST_ADMIN_TOKEN)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	var decoded interface{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &decoded), recorder.Body.String())
+	return recorder.Code, decoded
+}
+
+func TestAdminAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit")
+	audit, err := OpenAuditLog(path)
+	assert.Nil(t, err)
+	handler := adminHandler(nil, TEST_ADMIN_TOKEN, "", audit)
+	for _, header := range []string{"", "Bearer", "Bearer wrong", TEST_ADMIN_TOKEN + "x"} {
+		r := httptest.NewRequest("POST", "/kick", strings.NewReader(`{"name": "a"}`))
+		r.Header.Set("Authorization", header)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code, header)
+	}
+	// Tries without the token are audited too.
+	assert.Nil(t, audit.Close())
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, strings.Count(string(data), `"error":"bad token"`))
+
+	assert.Nil(t, validAdminAddr("localhost:8001"))
+	assert.Nil(t, validAdminAddr("127.0.0.1:8001"))
+	assert.Nil(t, validAdminAddr("[::1]:8001"))
+	for _, addr := range []string{":8001", "0.0.0.0:8001", "example.com:8001", "localhost"} {
+		assert.NotNil(t, validAdminAddr(addr), addr)
+	}
+	_, err = LoadConfig([]string{"-adminlisten", "localhost:8001", "-admintoken", "short"}, testEnv(nil))
+	assert.NotNil(t, err)
+}
+
+func TestAdminActions(t *testing.T) {
+	defer func(archetypes []Archetype) { ARCHETYPES = archetypes }(ARCHETYPES)
+	dir := t.TempDir()
+	audit, err := OpenAuditLog(filepath.Join(dir, "audit"))
+	assert.Nil(t, err)
+	balance := filepath.Join(dir, "balance.json")
+	assert.Nil(t, os.WriteFile(balance, []byte(`{"archetypes": [{"name": "brute", "life": 130}]}`), 0644))
+	ctx, cancel := context.WithCancel(context.Background())
+	newClients := make(chan ConnInfo)
+	commands := make(chan adminCommand)
+	stopped := make(chan struct{})
+	go func() {
+		dispatcher(ctx, newClients, commands, nil)
+		close(stopped)
+	}()
+	handler := adminHandler(commands, TEST_ADMIN_TOKEN, balance, audit)
+
+	alice, aliceLobby := fakeConn(newClients, "10.0.0.1")
+	defer close(alice.Done)
+	alice.Inbound <- Message{Username: "alice", Command: "SETNAME"}
+	bob, bobLobby := fakeConn(newClients, "10.0.0.2")
+	defer close(bob.Done)
+	bob.Inbound <- Message{Username: "bob", Command: "SETNAME"}
+	status, connections := adminRequest(t, handler, "GET", "/connections", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, len(connections.([]interface{})))
+
+	// Muted users can't chat, but can still see everyone else's.
+	status, _ = adminRequest(t, handler, "POST", "/mute", `{"name": "bob", "duration": "1m"}`)
+	assert.Equal(t, http.StatusOK, status)
+	bob.Inbound <- Message{Username: "bob", Content: "hi"}
+	assert.Equal(t, ERR_MUTED, expect(t, bobLobby).(ErrorPayload).Code)
+	alice.Inbound <- Message{Username: "alice", Content: "hi"}
+	assert.Equal(t, "hi", expect(t, aliceLobby).(Message).Content)
+	assert.Equal(t, "hi", expect(t, bobLobby).(Message).Content)
+
+	status, _ = adminRequest(t, handler, "POST", "/notice", `{"message": "restarting soon"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "restarting soon", expect(t, aliceLobby).(Message).Content)
+	assert.Equal(t, "restarting soon", expect(t, bobLobby).(Message).Content)
+
+	status, _ = adminRequest(t, handler, "POST", "/kick", `{"name": "alice"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.IsType(t, kick{}, expect(t, aliceLobby))
+	status, _ = adminRequest(t, handler, "POST", "/kick", `{"name": "nobody"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = adminRequest(t, handler, "GET", "/kick", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+
+	// Bans keep out whoever they're for, whether they're here already or come later.
+	status, _ = adminRequest(t, handler, "POST", "/ban", `{"ip": "10.0.0.2", "duration": "1h"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.IsType(t, kick{}, expect(t, bobLobby))
+	status, _ = adminRequest(t, handler, "POST", "/ban", `{"name": "Carol", "duration": "1h"}`)
+	assert.Equal(t, http.StatusOK, status)
+	again, againLobby := fakeConn(newClients, "10.0.0.2")
+	defer close(again.Done)
+	assert.IsType(t, kick{}, expect(t, againLobby))
+	carol, carolLobby := fakeConn(newClients, "10.0.0.3")
+	defer close(carol.Done)
+	carol.Inbound <- Message{Username: "carol", Command: "SETNAME"}
+	assert.IsType(t, kick{}, expect(t, carolLobby))
+	_, bans := adminRequest(t, handler, "GET", "/bans", "")
+	assert.Equal(t, 2, len(bans.([]interface{})))
+	for _, bad := range []string{`{"duration": "1h"}`, `{"name": "a", "ip": "10.0.0.1", "duration": "1h"}`,
+		`{"ip": "nowhere", "duration": "1h"}`, `{"name": "a"}`, `{"name": "a", "duration": "soon"}`} {
+		status, _ = adminRequest(t, handler, "POST", "/ban", bad)
+		assert.Equal(t, http.StatusBadRequest, status, bad)
+	}
+
+	// A battle an admin ends is a no-contest.
+	var lobbies []<-chan interface{}
+	for _, name := range []string{"dave", "erin"} {
+		conn, lobby := fakeConn(newClients, "10.0.0.4")
+		defer close(conn.Done)
+		conn.Inbound <- Message{Username: name, Command: "SETNAME"}
+		conn.Inbound <- Message{Content: "duel", Command: "READY"}
+		lobbies = append(lobbies, lobby)
+	}
+	for _, lobby := range lobbies {
+		assert.Equal(t, "START GAME", expect(t, lobby).(Message).Command)
+	}
+	_, matches := adminRequest(t, handler, "GET", "/matches", "")
+	assert.Equal(t, 1, len(matches.([]interface{})))
+	match := matches.([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, []interface{}{"dave", "erin"}, match["players"])
+	status, _ = adminRequest(t, handler, "POST", "/end-match", `{"match": 999999}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = adminRequest(t, handler, "POST", "/end-match", fmt.Sprintf(`{"match": %v}`, match["match"]))
+	assert.Equal(t, http.StatusOK, status)
+	for _, lobby := range lobbies {
+		assert.Equal(t, OUTCOME_NO_CONTEST, expect(t, lobby).(ResultPayload).Outcome)
+	}
+
+	status, _ = adminRequest(t, handler, "POST", "/reload-balance", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 130, getArchetypeByName("Brute").Life)
+	assert.Equal(t, "Brute", getArchetypeByName("Brute").Name)
+
+	cancel()
+	<-stopped
+	// Everything that changed something is in the audit log.
+	assert.Nil(t, audit.Close())
+	data, err := os.ReadFile(filepath.Join(dir, "audit"))
+	assert.Nil(t, err)
+	for _, action := range []string{"mute", "notice", "kick", "ban", "end-match", "reload-balance"} {
+		assert.Contains(t, string(data), `"action":"`+action+`"`)
+	}
+	assert.NotContains(t, string(data), `"action":"connections"`)
+}
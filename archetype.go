@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file defines the fighter archetypes players can pick in the lobby. An archetype is a stat block that
+// replaces the standard attack stats, plus an optional special move.
+
+package main
+
+import (
+	"strings"
+)
+
+// The JSON names are the ones used in the balance file (see balance.go).
+type Archetype struct {
+	Name string `json:"name"`
+	Life int    `json:"life"`
+	// How much stamina is regenerated per second.
+	Regen     float32 `json:"regen"`
+	LightDmg  int     `json:"lightDmg"`
+	LightTime int     `json:"lightTime"`
+	LightCost float32 `json:"lightCost"`
+	HeavyDmg  int     `json:"heavyDmg"`
+	HeavyTime int     `json:"heavyTime"`
+	HeavyCost float32 `json:"heavyCost"`
+	// Special is what the SPECIAL command does for this archetype. It's empty if the archetype doesn't have one.
+	Special string `json:"special"`
+}
+
+// The default archetype. Its stats are the same as the balance constants in battle.go.
+const DEFAULT_ARCHETYPE = "Fighter"
+
+// The lobby menus in index.html list these in the same order.
+var ARCHETYPES = []Archetype{
+	{
+		Name:      "Fighter",
+		Life:      100,
+		Regen:     10,
+		LightDmg:  LIGHT_ATK_DMG,
+		LightTime: LIGHT_ATK_TIME,
+		LightCost: LIGHT_ATK_COST,
+		HeavyDmg:  HEAVY_ATK_DMG,
+		HeavyTime: HEAVY_ATK_TIME,
+		HeavyCost: HEAVY_ATK_COST,
+	},
+	{
+		Name:      "Duelist",
+		Life:      85,
+		Regen:     10,
+		LightDmg:  3,
+		LightTime: 400,
+		LightCost: 7,
+		HeavyDmg:  5,
+		HeavyTime: 1000,
+		HeavyCost: 15,
+		Special:   "quickstep",
+	},
+	{
+		Name:      "Brute",
+		Life:      120,
+		Regen:     8,
+		LightDmg:  3,
+		LightTime: 550,
+		LightCost: 10,
+		HeavyDmg:  8,
+		HeavyTime: 1100,
+		HeavyCost: 18,
+		Special:   "slam",
+	},
+}
+
+// Special move parameters.
+const (
+	// The quickstep is a dodge that costs less and can be done later, but only works against light attacks.
+	QUICKSTEP_COST   float32 = 10.0
+	QUICKSTEP_WINDOW int     = 150
+	// The slam is a very slow attack that does full damage to a blocking enemy.
+	SLAM_DMG  int     = 8
+	SLAM_TIME int     = 1500
+	SLAM_COST float32 = 25.0
+)
+
+// getArchetypeByName returns the archetype with the given name (ignoring case), or nil if there isn't one.
+func getArchetypeByName(name string) *Archetype {
+	for i := range ARCHETYPES {
+		if strings.EqualFold(ARCHETYPES[i].Name, name) {
+			return &ARCHETYPES[i]
+		}
+	}
+	return nil
+}
+
+// resolveSpecial handles the SPECIAL command, which does something different for each archetype.
+func resolveSpecial(player, enemy Player) (Player, Player) {
+	switch player.Archetype.Special {
+	case "quickstep":
+		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= QUICKSTEP_COST && enemy.State == "light attack" &&
+			enemy.StateDuration+player.CommandLag > player.actionTime(QUICKSTEP_WINDOW) {
+			player.SpendStamina(QUICKSTEP_COST)
+			player.RemoveEffect("stagger")
+			enemy.SetState("standing", 0)
+		}
+	case "slam":
+		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= SLAM_COST {
+			player.SetState("slamming", player.actionTime(SLAM_TIME))
+			player.SpendStamina(SLAM_COST)
+			player.RemoveEffect("stagger")
+		}
+	}
+	return player, enemy
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetArchetypeByName(t *testing.T) {
+	assert.Equal(t, "Brute", getArchetypeByName("brute").Name)
+	assert.Nil(t, getArchetypeByName("Wizard"))
+	// The default has to exist and match the balance constants, since the rest of the tests assume it.
+	fighter := getArchetypeByName(DEFAULT_ARCHETYPE)
+	assert.Equal(t, NewPlayer().Archetype, fighter)
+	assert.Equal(t, LIGHT_ATK_DMG, fighter.LightDmg)
+	assert.Equal(t, HEAVY_ATK_TIME, fighter.HeavyTime)
+	// Everything the client might be told about has to be sendable.
+	for _, archetype := range ARCHETYPES {
+		assert.True(t, archetype.Life > 0, archetype.Name)
+		assert.True(t, archetype.Special == "" || archetype.Special == "quickstep" || archetype.Special == "slam", archetype.Name)
+	}
+}
+
+func TestArchetypeStats(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	brute := getArchetypeByName("Brute")
+	duelist := getArchetypeByName("Duelist")
+
+	p1 := NewPlayer()
+	p1.SetArchetype(brute)
+	assert.Equal(t, brute.Life, p1.Life)
+
+	// Attacks use the attacker's stats.
+	p1.Command = "HEAVY"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, brute.HeavyTime, p1.StateDuration)
+	assert.Equal(t, 100-brute.HeavyCost, p1.Stamina)
+	p1.Finished = "heavy attack"
+	_, p2 := resolveState(p1, NewPlayer())
+	assert.Equal(t, 100-brute.HeavyDmg, p2.Life)
+
+	// Including when the light attack decides whether it interrupts a heavy.
+	p1 = NewPlayer()
+	p1.SetArchetype(duelist)
+	p1.Command = "LIGHT"
+	p1, p2 = resolveCommand(p1, playerWith(100, 100, "heavy attack", duelist.LightTime+1), random)
+	assert.Equal(t, "interrupted heavy", p2.State[:len("interrupted heavy")])
+	assert.Equal(t, 100-duelist.LightDmg, p2.Life)
+
+	// Regen.
+	p1 = playerWith(100, 50, "standing", 0)
+	p1.SetArchetype(brute)
+	p1.PassTime(1000)
+	assert.Equal(t, 50+brute.Regen, p1.Stamina)
+}
+
+func TestSpecials(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	// The Fighter doesn't have one.
+	p1 := NewPlayer()
+	p1.Command = "SPECIAL"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, NewPlayer(), p1)
+
+	// The quickstep avoids a light attack later than a dodge could...
+	duelist := NewPlayer()
+	duelist.SetArchetype(getArchetypeByName("Duelist"))
+	p1 = duelist
+	p1.Command = "SPECIAL"
+	p1, p2 := resolveCommand(p1, playerWith(100, 100, "light attack", QUICKSTEP_WINDOW+1), random)
+	assert.Equal(t, 100-QUICKSTEP_COST, p1.Stamina)
+	assert.Equal(t, "standing", p2.State)
+	// ...but not a heavy one.
+	p1 = duelist
+	p1.Command = "SPECIAL"
+	p1, p2 = resolveCommand(p1, playerWith(100, 100, "heavy attack", 50), random)
+	assert.Equal(t, float32(100), p1.Stamina)
+	assert.Equal(t, "heavy attack", p2.State)
+
+	// The slam goes through blocks.
+	brute := NewPlayer()
+	brute.SetArchetype(getArchetypeByName("Brute"))
+	brute.Command = "SPECIAL"
+	brute, _ = resolveCommand(brute, NewPlayer(), random)
+	assert.Equal(t, "slamming", brute.State)
+	assert.Equal(t, SLAM_TIME, brute.StateDuration)
+	brute.SetState("standing", 0)
+	brute.Finished = "slamming"
+	_, p2 = resolveState(brute, playerWith(100, 100, "blocking", -10))
+	assert.Equal(t, playerWith(100-SLAM_DMG, 100, "standing", 0), p2)
+	// And can be parried.
+	brute.Finished = "slamming"
+	brute, _ = resolveState(brute, playerWith(100, 100, "parrying", 2))
+	assert.Equal(t, "parried", brute.State)
+}
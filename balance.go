@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file loads the balance file, which changes the archetypes' stats without rebuilding the server. It's a
+// JSON object with an "archetypes" list, and each archetype in it only needs the stats it changes, like
+//
+//	{"archetypes": [{"name": "Brute", "life": 130, "heavyTime": 1200}]}
+//
+// Archetypes can't be added or taken away this way, since the client's menus list them. Anything the file doesn't
+// mention keeps its built-in value, so taking a stat out of the file and reloading it puts the stat back.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// BUILTIN_ARCHETYPES is what ARCHETYPES starts as, before any balance file is loaded.
+var BUILTIN_ARCHETYPES = append([]Archetype(nil), ARCHETYPES...)
+
+// LoadBalance reads a balance file and returns the archetypes it describes, without putting them in use.
+func LoadBalance(path string) ([]Archetype, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "when reading balance file")
+	}
+	var balance struct {
+		Archetypes []json.RawMessage `json:"archetypes"`
+	}
+	if err := strictUnmarshal(data, &balance); err != nil {
+		return nil, errors.Wrap(err, "when decoding balance file")
+	}
+	archetypes := append([]Archetype(nil), BUILTIN_ARCHETYPES...)
+	for _, raw := range balance.Archetypes {
+		var named struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(raw, &named)
+		i := archetypeIndex(archetypes, named.Name)
+		if i == -1 {
+			return nil, errors.Errorf("there's no archetype called %q", named.Name)
+		}
+		if err := strictUnmarshal(raw, &archetypes[i]); err != nil {
+			return nil, errors.Wrapf(err, "when decoding %s", named.Name)
+		}
+		// The name might have been written in a different case.
+		archetypes[i].Name = BUILTIN_ARCHETYPES[i].Name
+		if err := archetypes[i].Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return archetypes, nil
+}
+
+// Validate returns an error if the archetype's stats would break battles.
+func (a Archetype) Validate() error {
+	if a.Life < 1 || a.Life > HANDICAP_MAX_LIFE {
+		return errors.Errorf("%s: life must be between 1 and %d", a.Name, HANDICAP_MAX_LIFE)
+	}
+	if a.Regen <= 0 {
+		return errors.Errorf("%s: stamina has to regenerate", a.Name)
+	}
+	if a.LightDmg < 0 || a.HeavyDmg < 0 || a.LightCost < 0 || a.HeavyCost < 0 {
+		return errors.Errorf("%s: damage and costs can't be negative", a.Name)
+	}
+	if a.LightTime <= 0 || a.HeavyTime <= 0 {
+		return errors.Errorf("%s: attacks have to take some time", a.Name)
+	}
+	// Each hit in a combo makes the next light attack COMBO_SPEEDUP faster, so a full combo has to leave it some time.
+	if a.LightTime <= COMBO_MAX*COMBO_SPEEDUP {
+		return errors.Errorf("%s: light attacks have to take more than %dms, since a full combo takes that off",
+			a.Name, COMBO_MAX*COMBO_SPEEDUP)
+	}
+	if a.Special != "" && a.Special != "quickstep" && a.Special != "slam" {
+		return errors.Errorf("%s: there's no special move called %q", a.Name, a.Special)
+	}
+	return nil
+}
+
+// archetypeIndex returns the index of the archetype with the given name (ignoring case), or -1 if there isn't one.
+func archetypeIndex(archetypes []Archetype, name string) int {
+	for i := range archetypes {
+		if strings.EqualFold(archetypes[i].Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// strictUnmarshal is json.Unmarshal, except that fields v doesn't have are an error instead of being ignored, so
+// misspelled stats get noticed.
+func strictUnmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
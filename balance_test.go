@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testBalanceFile writes a balance file with the given contents and returns its path.
+func testBalanceFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "balance.json")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadBalance(t *testing.T) {
+	archetypes, err := LoadBalance(testBalanceFile(t, `{"archetypes": [
+		{"name": "BRUTE", "life": 130, "heavyTime": 1200},
+		{"name": "Duelist", "special": ""}
+	]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, len(BUILTIN_ARCHETYPES), len(archetypes))
+	brute := archetypes[archetypeIndex(archetypes, "Brute")]
+	assert.Equal(t, "Brute", brute.Name)
+	assert.Equal(t, 130, brute.Life)
+	assert.Equal(t, 1200, brute.HeavyTime)
+	// Whatever isn't in the file keeps its built-in value.
+	assert.Equal(t, getArchetypeByName("Brute").HeavyDmg, brute.HeavyDmg)
+	assert.Equal(t, "", archetypes[archetypeIndex(archetypes, "Duelist")].Special)
+	assert.Equal(t, BUILTIN_ARCHETYPES[0], archetypes[0])
+	// Loading it doesn't put it in use.
+	assert.Equal(t, 120, getArchetypeByName("Brute").Life)
+
+	for _, bad := range []string{
+		`{"archetypes": [{"name": "Wizard", "life": 100}]}`,
+		`{"archetypes": [{"name": "Brute", "lfie": 100}]}`,
+		`{"archetypes": [{"name": "Brute", "life": 0}]}`,
+		`{"archetypes": [{"name": "Brute", "regen": -1}]}`,
+		`{"archetypes": [{"name": "Brute", "lightTime": 0}]}`,
+		// A full combo would take the whole light attack away.
+		`{"archetypes": [{"name": "Brute", "lightTime": 320}]}`,
+		`{"archetypes": [{"name": "Brute", "heavyDmg": -3}]}`,
+		`{"archetypes": [{"name": "Brute", "special": "fireball"}]}`,
+		`{"archetype": []}`,
+		`not json`,
+	} {
+		_, err := LoadBalance(testBalanceFile(t, bad))
+		assert.NotNil(t, err, bad)
+	}
+	_, err = LoadBalance(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NotNil(t, err)
+	for _, archetype := range BUILTIN_ARCHETYPES {
+		assert.Nil(t, archetype.Validate(), archetype.Name)
+	}
+}
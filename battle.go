@@ -6,15 +6,16 @@
 package main
 
 import (
-	"math/rand"
 	"strings"
 	"time"
 )
 
 type Player struct {
-	// These two channels are the same as the two from the corresponding User struct in server.go.
-	InputChan  chan Message
-	UpdateChan chan Update
+	// The player's name, for showing the others in battles with more than two players.
+	Name string
+	// Which side the player is on and who they picked to attack (see modes.go).
+	Team   int
+	Target int
 	// The Command field is the current input from the player (kept up to
 	// date by the concurrently running input func for the player).
 	Command string
@@ -23,39 +24,101 @@ type Player struct {
 	// The State field keeps track of what the player is doing. It
 	// has values like "standing", "blocking", "light attack", etc.
 	State string
-	// The StateDuration field shows how much longer the player will remain in their current state.
+	// The StateDuration field shows how much longer the player will remain in their current state. Like every
+	// other length of time in a battle, it's in milliseconds of game time (see BattleState.TickRate).
 	StateDuration int
+	// StateLength is what StateDuration was when the state started. It's still set when the state is over, so
+	// resolveState can tell how long the attack that just finished took.
+	StateLength int
 	// The Finished field shows what state the player just exited.
 	// It's used to know when an attack is supposed to land.
 	Finished string
+	// The player's connection latency. It's nil for bots.
+	Latency *Latency
+	// CommandLag is how many milliseconds before it arrived the current Command was really made, according to
+	// the client (see lagCompensation). Timing decisions about the command are judged as if it was made then.
+	CommandLag int
+	// The player's attack stats and special move (see archetype.go).
+	Archetype *Archetype
+	// How long until stamina starts regenerating again.
+	RegenDelay int
+	// Whether the player ran out of stamina and hasn't got enough back yet.
+	Exhausted bool
+	// How many light attacks in a row the player has landed, and how much longer they have to start the
+	// next one to keep the combo going.
+	Combo     int
+	ComboTime int
+	// The status effects on the player (see effects.go).
+	Effects []Effect
+	// How the player's stats are changed for this battle (see handicap.go).
+	Handicap Handicap
 }
 
 // NewPlayer returns a Player with all the starting values.
-func NewPlayer(inputChan chan Message, updateChan chan Update) Player {
+func NewPlayer() Player {
 	return Player{
-		InputChan:     inputChan,
-		UpdateChan:    updateChan,
+		Name:          "",
+		Team:          NO_TEAM,
+		Target:        NO_TARGET,
 		Command:       "NONE",
 		Life:          100,
 		Stamina:       100,
 		State:         "standing",
 		StateDuration: 0,
+		StateLength:   0,
 		Finished:      "",
+		Latency:       nil,
+		CommandLag:    0,
+		Archetype:     getArchetypeByName(DEFAULT_ARCHETYPE),
+		RegenDelay:    0,
+		Exhausted:     false,
+		Combo:         0,
+		ComboTime:     0,
+		Effects:       nil,
+		Handicap:      Handicap{},
 	}
 }
 
+// SetArchetype makes the player fight as the given archetype. It's only meant to be used before the battle starts,
+// since it resets their life.
+func (p *Player) SetArchetype(archetype *Archetype) {
+	p.Archetype = archetype
+	p.Life = archetype.Life
+}
+
 // Status returns a PlayerStatus from the Player, to be sent in an Update over the network.
 func (p *Player) Status() PlayerStatus {
-	return PlayerStatus{Life: p.Life, Stamina: p.Stamina, State: p.State, StateDuration: p.StateDuration}
-
+	return PlayerStatus{Life: p.Life, Stamina: p.Stamina, State: p.State, StateDuration: p.StateDuration,
+		Ping: int(p.Latency.RTT() / time.Millisecond), Exhausted: p.Exhausted, RegenDelay: p.RegenDelay,
+		Combo: p.Combo, Effects: p.effectStatus()}
 }
 
-// This is called every mainloop cycle, and does two things: regenerate stamina,
-// and make progress toward exiting the current state.
+// This is called every tick with how many milliseconds it is, and does two things: regenerate
+// stamina, and make progress toward exiting the current state.
 func (p *Player) PassTime(amount int) {
-	p.Stamina += 0.1
-	if p.Stamina > 100 {
-		p.Stamina = 100
+	if p.RegenDelay > 0 {
+		p.RegenDelay -= amount
+		if p.RegenDelay < 0 {
+			p.RegenDelay = 0
+		}
+	} else if p.State == "blocking" {
+		p.Stamina += p.regen() * BLOCKING_REGEN * float32(amount) / 1000
+	} else {
+		p.Stamina += p.regen() * float32(amount) / 1000
+	}
+	if p.Stamina > p.maxStamina() {
+		p.Stamina = p.maxStamina()
+	}
+	if p.Exhausted && p.Stamina >= EXHAUSTION_RECOVERY {
+		p.Exhausted = false
+	}
+	p.tickEffects(amount)
+	if p.ComboTime > 0 {
+		p.ComboTime -= amount
+		if p.ComboTime <= 0 {
+			p.ComboTime = 0
+			p.Combo = 0
+		}
 	}
 	p.StateDuration -= amount
 	// If it starts with "interrupt", it's one of the heavy attack interrupt states.
@@ -69,6 +132,52 @@ func (p *Player) PassTime(amount int) {
 func (p *Player) SetState(state string, duration int) {
 	p.State = state
 	p.StateDuration = duration
+	p.StateLength = duration
+}
+
+// SpendStamina takes stamina away from the player, whether they used it or it was knocked out of them. It
+// can't go below 0, but reaching 0 makes them exhausted.
+func (p *Player) SpendStamina(amount float32) {
+	p.Stamina -= amount
+	if p.Stamina <= 0 {
+		p.Stamina = 0
+		p.Exhausted = true
+	}
+	p.RegenDelay = REGEN_DELAY
+}
+
+// lightTime returns how long a light attack started by the player right now would take to land. Each hit
+// already landed in a combo makes the next one faster.
+func (p *Player) lightTime() int {
+	return p.actionTime(p.Archetype.LightTime) - p.Combo*COMBO_SPEEDUP
+}
+
+// actionTime returns how long something that normally takes the given time takes the player right now.
+// Whatever starts the action should also remove the stagger effect, since it only slows down one.
+func (p *Player) actionTime(duration int) int {
+	if p.Exhausted {
+		duration = int(float32(duration) * EXHAUSTED_SLOWDOWN)
+	}
+	if p.EffectStacks("stagger") > 0 {
+		duration = int(float32(duration) * STAGGER_SLOWDOWN)
+	}
+	return duration
+}
+
+// parryWindow returns how long the player's parry is up for. Whatever would make an action take longer makes
+// the parry shorter instead, since a longer parry is a better one. Like actionTime, whatever starts the parry
+// should remove the stagger effect.
+func (p *Player) parryWindow() int {
+	return PARRY_WINDOW * PARRY_WINDOW / p.actionTime(PARRY_WINDOW)
+}
+
+// blockCost returns how much stamina it costs the player to block something that normally costs the given
+// amount.
+func (p *Player) blockCost(cost float32) float32 {
+	if p.EffectStacks("guard crush") > 0 {
+		return cost * GUARD_CRUSH_FACTOR
+	}
+	return cost
 }
 
 // This struct is passed instead of Player to the client in Updates
@@ -78,106 +187,280 @@ type PlayerStatus struct {
 	Stamina       float32 `json:"stamina"`
 	State         string  `json:"state"`
 	StateDuration int     `json:"stateDur"`
+	// The player's round trip time in milliseconds.
+	Ping int `json:"ping"`
+	// Whether the player is exhausted and how long until their stamina regenerates.
+	Exhausted  bool `json:"exhausted"`
+	RegenDelay int  `json:"regenDelay"`
+	// How many hits are in the player's current combo.
+	Combo int `json:"combo"`
+	// The status effects on the player.
+	Effects EffectStatus `json:"effects"`
 }
 
-// One of these is sent back to each player every mainloop cycle. Note that the
+// One of these is sent back to each player UpdateRate times a second. Note that the
 // players don't know which player they are internally - it doesn't matter.
 type Update struct {
+	// Which tick this is. Clients stamp their inputs with it.
+	Tick  int          `json:"tick"`
 	Self  PlayerStatus `json:"self"`
 	Enemy PlayerStatus `json:"enemy"`
+	// Which ticks used the player's inputs since the last update they got.
+	Acks []InputAck `json:"acks,omitempty"`
+	// Everyone in the battle, in the same order every time, if there are more than two.
+	Combatants []Combatant `json:"combatants,omitempty"`
+	// Outcome is only set on the last update of a battle, when it's how the battle ended for the player (see
+	// ResultPayload). It isn't sent, since the result is sent separately.
+	Outcome string `json:"-"`
+}
+
+// Combatant is what players are told about each of the others in a battle with more than two players.
+type Combatant struct {
+	Name      string `json:"name"`
+	Archetype string `json:"archetype"`
+	Team      int    `json:"team"`
+	// Target is the index in the list of whoever the combatant is attacking.
+	Target int `json:"target"`
+	// Self is set on the combatant who's the player the update was sent to.
+	Self   bool         `json:"self,omitempty"`
+	Status PlayerStatus `json:"status"`
 }
 
-// Balance parameters.
+// Balance parameters. Lengths of time are in milliseconds, so they don't depend on the tick rate.
 const (
 	LIGHT_ATK_DMG      int     = 3
-	LIGHT_ATK_TIME     int     = 50
+	LIGHT_ATK_TIME     int     = 500
 	LIGHT_ATK_COST     float32 = 10.0
 	LIGHT_ATK_BLK_COST float32 = 12.0
 	// The counter window is how long you can counter for after the attacks
 	// starts - so a bigger value here means it's easier to counter.
-	LIGHT_ATK_CNTR_WINDOW int     = 25
-	LIGHT_ATK_CNTR_TIME   int     = 30
+	LIGHT_ATK_CNTR_WINDOW int     = 250
+	LIGHT_ATK_CNTR_TIME   int     = 300
 	LIGHT_ATK_CNTR_DMG    int     = 3
 	SAVE_COST             float32 = 4.0
 	HEAVY_ATK_DMG         int     = 6
-	HEAVY_ATK_TIME        int     = 100
+	HEAVY_ATK_TIME        int     = 1000
 	HEAVY_ATK_COST        float32 = 15.0
 	HEAVY_ATK_BLK_COST    float32 = 20.0
 	HEAVY_ATK_BLKED_DMG   int     = 2
 	DODGE_COST            float32 = 20.0
-	DODGE_WINDOW          int     = 30
+	DODGE_WINDOW          int     = 300
+	// The feint window is how long after starting an attack you can still
+	// feint it. You get FEINT_REFUND of the attack's cost back.
+	FEINT_WINDOW        int     = 300
+	FEINT_REFUND        float32 = 0.5
+	FEINT_RECOVERY_TIME int     = 200
+	// Stamina doesn't regenerate for REGEN_DELAY after any is lost, and regenerates at
+	// BLOCKING_REGEN times the normal rate while blocking. Running out makes you exhausted
+	// until you're back up to EXHAUSTION_RECOVERY, and while you're exhausted everything
+	// you do takes EXHAUSTED_SLOWDOWN times as long.
+	REGEN_DELAY         int     = 500
+	BLOCKING_REGEN      float32 = 0.5
+	EXHAUSTION_RECOVERY float32 = 30.0
+	EXHAUSTED_SLOWDOWN  float32 = 1.5
+	// Landing a light attack on an undefended enemy stuns them for HIT_STUN_TIME, and
+	// another light attack started within COMBO_WINDOW continues the combo. Each hit
+	// already in the combo makes the next one COMBO_SPEEDUP faster and do COMBO_DMG_BONUS
+	// more damage, up to COMBO_MAX hits. Saving while stunned costs BURST_COST and
+	// breaks the combo.
+	HIT_STUN_TIME   int     = 600
+	COMBO_WINDOW    int     = 200
+	COMBO_SPEEDUP   int     = 80
+	COMBO_DMG_BONUS int     = 1
+	COMBO_MAX       int     = 4
+	BURST_COST      float32 = 20.0
+	// Grabs are for breaking turtles. They only do anything to a blocking enemy, who
+	// loses GRAB_STAMINA_DMG stamina and can't act for GRAB_STUN_TIME. Against anything
+	// else you're left open for GRAB_WHIFF_TIME.
+	GRAB_TIME        int     = 400
+	GRAB_COST        float32 = 10.0
+	GRAB_STAMINA_DMG float32 = 25.0
+	GRAB_STUN_TIME   int     = 600
+	GRAB_WHIFF_TIME  int     = 400
+	// A parry is only active for PARRY_WINDOW. If an attack lands during it, the attack
+	// does nothing and the attacker can't act for PARRY_STUN_TIME. If not, the parrier
+	// can't act for PARRY_WHIFF_TIME.
+	PARRY_WINDOW     int     = 80
+	PARRY_COST       float32 = 5.0
+	PARRY_STUN_TIME  int     = 700
+	PARRY_WHIFF_TIME int     = 600
 )
 
 var INTERRUPTABLE_STATES = map[string]bool{"standing": true, "blocking": true}
 var TERMINAL_STATES = map[string]bool{"standing": true, "blocking": true, "countered": true}
 var ATTACK_STATES = map[string]bool{"light attack": true, "heavy attack": true}
 
+// States that get canceled if you're hit while in them. Being hit during a grab stops it, but it isn't an
+// attack for other purposes (you can't feint it or interrupt it).
+var CANCELABLE_STATES = map[string]bool{"light attack": true, "heavy attack": true, "grabbing": true, "slamming": true}
+
 // These are suffixes that can be attached to 'interrupted heavy' or 'interrupting heavy'
 // to form the a state value that includes which arrow needs to be pressed.
 var INTERRUPT_RESOLVE_KEYS = []string{"_up", "_down", "_left", "_right"}
 
-func battle(player1inputChan, player2inputChan chan Message, player1updateChan, player2updateChan chan Update) {
-	// Seed the random number generator and initialize the clock and players.
-	random := rand.New(rand.NewSource(time.Now().UnixNano()))
-	ticker := time.NewTicker(10 * time.Millisecond)
-	defer ticker.Stop()
-	players := []Player{
-		NewPlayer(player1inputChan, player1updateChan),
-		NewPlayer(player2inputChan, player2updateChan),
+// BattleState is the whole state of a battle's simulation. Step only looks at this and the inputs it's given,
+// so anyone with the same state and inputs - like a client predicting ahead of the server - gets the same result.
+type BattleState struct {
+	Tick int
+	// How many ticks there are per second. 0 means DEFAULT_TICK_RATE.
+	TickRate int
+	Seed     int64
+	Players  []Player
+}
+
+// DEFAULT_TICK_RATE is how many ticks per second battles are simulated at, and how many updates per second are
+// sent, unless the server is told otherwise.
+const DEFAULT_TICK_RATE = 100
+
+// TickRate and UpdateRate are how many ticks per second new battles are simulated at and how many updates per
+// second the players are sent. They're set by the -tickrate and -updaterate flags. Since every length of time in
+// the simulation is in milliseconds, the tick rate can't be more than 1000.
+var TickRate = DEFAULT_TICK_RATE
+var UpdateRate = DEFAULT_TICK_RATE
+
+// Time returns how many milliseconds of game time have gone by at the start of the given tick. Ticks that aren't
+// a whole number of milliseconds long are rounded so they still add up.
+func (s BattleState) Time(tick int) int {
+	rate := s.TickRate
+	if rate == 0 {
+		rate = DEFAULT_TICK_RATE
 	}
-	for players[0].Life > 0 && players[1].Life > 0 {
-		select {
-		// Each mainloop cycle:
-		case <-ticker.C:
-			// Send updates to the clients.
-			select {
-			case players[0].UpdateChan <- Update{Self: players[0].Status(), Enemy: players[1].Status()}:
-			default:
-			}
-			select {
-			case players[1].UpdateChan <- Update{Self: players[1].Status(), Enemy: players[0].Status()}:
-			default:
-			}
-			players[0].PassTime(1)
-			players[1].PassTime(1)
-			if players[0].Finished != "" {
-				players[0], players[1] = resolveState(players[0], players[1])
-			}
-			if players[1].Finished != "" {
-				players[1], players[0] = resolveState(players[1], players[0])
-			}
-			players[0], players[1] = resolveCommand(players[0], players[1], random)
-			players[1], players[0] = resolveCommand(players[1], players[0], random)
-		case input := <-players[0].InputChan:
-			players[0].Command = input.Content
-		case input := <-players[1].InputChan:
-			players[1].Command = input.Content
+	return tick * 1000 / rate
+}
+
+// TickLength returns how long a tick of the battle is in real time.
+func (s BattleState) TickLength() time.Duration {
+	if s.TickRate == 0 {
+		return time.Second / DEFAULT_TICK_RATE
+	}
+	return time.Second / time.Duration(s.TickRate)
+}
+
+// TickInput is an input to be applied on a tick, as the Command it sets on a player.
+type TickInput struct {
+	// The player's index in BattleState.Players.
+	Player  int
+	Command string
+	// How many milliseconds before this tick the input was really made (see lagCompensation).
+	Lag int
+	// The client's number for the input, so it can be told which tick used it.
+	Seq int
+	// For the TARGET command, the index of the player to attack.
+	Target int
+}
+
+// InputAck tells a client which tick one of its inputs was used on.
+type InputAck struct {
+	Seq  int `json:"seq"`
+	Tick int `json:"tick"`
+}
+
+// Step advances a battle by one tick. The inputs are applied in order before anything else happens,
+// so if a player has more than one only the last counts (apart from how it affects the others' lag). The state
+// passed in isn't changed.
+//
+// Each player's attacks land on their target, and the players take turns in the order they're listed, so in a
+// duel it's the same as it always was.
+func Step(state BattleState, inputs []TickInput) BattleState {
+	players := append([]Player(nil), state.Players...)
+	for _, input := range inputs {
+		// Picking a target isn't a move, so it doesn't replace whatever key the player is holding.
+		if input.Command == "TARGET" {
+			chooseTarget(players, input.Player, input.Target)
+			continue
+		}
+		// Giving up knocks the player out on the spot.
+		if input.Command == "FORFEIT" {
+			players[input.Player].Life = 0
+			continue
+		}
+		players[input.Player].Command = input.Command
+		players[input.Player].CommandLag = input.Lag
+	}
+	amount := state.Time(state.Tick+1) - state.Time(state.Tick)
+	state.Tick++
+	random := newTickRandom(state.Seed, state.Tick)
+	// Players who were knocked out before this tick sit out the rest of the battle. Anyone knocked out during
+	// it still gets their turn, like in a duel.
+	active := make([]bool, len(players))
+	for i := range players {
+		active[i] = players[i].Life > 0
+		if active[i] {
+			players[i].PassTime(amount)
 		}
 	}
-	// Send one last update to the players so they know how the battle ended.
-	players[0].UpdateChan <- Update{Self: players[0].Status(), Enemy: players[1].Status()}
-	players[1].UpdateChan <- Update{Self: players[1].Status(), Enemy: players[0].Status()}
-
-	// Make some goroutines to catch the last couple inputs from the players. This is necessary to stop
-	// server.go from getting stuck trying to send their input through after the battle is over.
-	stop1 := make(chan bool)
-	stop2 := make(chan bool)
-	go catchInput(players[0].InputChan, stop1)
-	go catchInput(players[1].InputChan, stop2)
-	time.Sleep(5 * time.Second)
-	stop1 <- true
-	stop2 <- true
+	for i := range players {
+		if t := target(players, i); active[i] && t != NO_TARGET && players[i].Finished != "" {
+			players[i], players[t] = resolveState(players[i], players[t])
+			bindTarget(players, i, t)
+		}
+	}
+	for i := range players {
+		if t := target(players, i); active[i] && t != NO_TARGET {
+			players[i], players[t] = resolveCommand(players[i], players[t], random)
+			bindTarget(players, i, t)
+		}
+	}
+	state.Players = players
+	return state
+}
+
+// UpdateFor returns the Update to send the i-th player. Their enemy is whoever they're attacking, and in
+// battles with more than two players they're told about everyone.
+func (s BattleState) UpdateFor(i int, acks []InputAck) Update {
+	update := Update{Tick: s.Tick, Self: s.Players[i].Status(), Acks: acks}
+	if t := target(s.Players, i); t != NO_TARGET {
+		update.Enemy = s.Players[t].Status()
+	}
+	if len(s.Players) > 2 {
+		update.Combatants = make([]Combatant, len(s.Players))
+		for j, p := range s.Players {
+			update.Combatants[j] = Combatant{Name: p.Name, Archetype: p.Archetype.Name, Team: p.Team,
+				Target: target(s.Players, j), Self: j == i, Status: p.Status()}
+		}
+	}
+	if s.Over() {
+		update.Outcome = s.Outcome(i)
+	}
+	return update
+}
+
+// Random is the part of *rand.Rand that resolveCommand needs.
+type Random interface {
+	Intn(n int) int
+}
+
+// tickRandom is a Random whose rolls only depend on the battle's seed and the tick, so stepping the same tick
+// again rolls the same numbers. It's splitmix64.
+type tickRandom struct {
+	state uint64
+}
+
+func newTickRandom(seed int64, tick int) *tickRandom {
+	return &tickRandom{state: uint64(seed) ^ uint64(tick)*0x9e3779b97f4a7c15}
+}
+
+func (r *tickRandom) Intn(n int) int {
+	r.state += 0x9e3779b97f4a7c15
+	z := r.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return int(z % uint64(n))
 }
 
 // Called when a state finishes its duration (such as an attack landing).
 func resolveState(player, enemy Player) (Player, Player) {
 	switch player.Finished {
 	case "light attack":
-		if enemy.State == "blocking" {
-			if enemy.Stamina >= LIGHT_ATK_BLK_COST {
-				enemy.Stamina -= LIGHT_ATK_BLK_COST
+		if enemy.State == "parrying" {
+			player.SetState("parried", PARRY_STUN_TIME)
+			enemy.SetState("standing", 0)
+		} else if enemy.State == "blocking" {
+			if enemy.Stamina >= enemy.blockCost(LIGHT_ATK_BLK_COST) {
+				enemy.SpendStamina(enemy.blockCost(LIGHT_ATK_BLK_COST))
 				// If the enemy blocked inside the counterattack window...
-				if -enemy.StateDuration >= LIGHT_ATK_TIME-LIGHT_ATK_CNTR_WINDOW {
+				if -enemy.StateDuration >= player.StateLength-LIGHT_ATK_CNTR_WINDOW-enemy.Handicap.CounterWindow {
 					// The player is counterattacked. They are placed in a stunned state that they
 					// must press a button to escape before the counterattack lands.
 					player.SetState("countered", 0)
@@ -186,44 +469,79 @@ func resolveState(player, enemy Player) (Player, Player) {
 			} else {
 				// If you try to block an attack but you don't have enough stamina,
 				// you still lose your stamina and you also take damage.
-				enemy.Stamina = 0.0
-				enemy.Life -= LIGHT_ATK_DMG
+				enemy.SpendStamina(enemy.Stamina)
+				enemy.Life -= player.damage(player.Archetype.LightDmg)
 			}
 		} else {
-			// If the enemy wasn't blocking, they just take damage and have their attack canceled.
-			enemy.Life -= LIGHT_ATK_DMG
+			// If the enemy wasn't blocking, they take damage, have their attack canceled, and are
+			// stunned long enough for a combo.
+			enemy.Life -= player.damage(player.Archetype.LightDmg + player.Combo*COMBO_DMG_BONUS)
 			// We cancel heavy attacks here too because if it was supposed to count as an interrupt,
 			// that would have happened at the resolveCommand stage. We only get here if someone
 			// starts a heavy attack into a in-progress light attack.
-			if enemy.State == "light attack" || enemy.State == "heavy attack" {
-				enemy.SetState("standing", 0)
+			if CANCELABLE_STATES[enemy.State] || enemy.State == "standing" || enemy.State == "hit stun" {
+				enemy.SetState("hit stun", HIT_STUN_TIME)
 			}
+			if player.Combo < COMBO_MAX {
+				player.Combo++
+			}
+			player.ComboTime = COMBO_WINDOW
+			break
 		}
+		// The combo is over if it didn't hit.
+		player.Combo = 0
 	case "counterattack":
 		// No conditions here because if you save against the counter attack it puts the enemy
 		// out of the counterattacking state (so if you're here then they must not have saved).
-		enemy.Life -= LIGHT_ATK_CNTR_DMG
+		enemy.Life -= player.damage(LIGHT_ATK_CNTR_DMG)
 		enemy.SetState("standing", 0)
 	case "heavy attack":
-		if enemy.State == "blocking" {
-			if enemy.Stamina >= HEAVY_ATK_BLK_COST {
-				enemy.Stamina -= HEAVY_ATK_BLK_COST
-				enemy.Life -= HEAVY_ATK_BLKED_DMG
+		if enemy.State == "parrying" {
+			player.SetState("parried", PARRY_STUN_TIME)
+			enemy.SetState("standing", 0)
+		} else if enemy.State == "blocking" {
+			if enemy.Stamina >= enemy.blockCost(HEAVY_ATK_BLK_COST) {
+				enemy.SpendStamina(enemy.blockCost(HEAVY_ATK_BLK_COST))
+				enemy.Life -= player.damage(HEAVY_ATK_BLKED_DMG)
+				enemy.AddEffect("stagger")
 			} else {
-				enemy.Stamina = 0.0
-				enemy.Life -= HEAVY_ATK_DMG
+				enemy.SpendStamina(enemy.Stamina)
+				enemy.Life -= player.damage(player.Archetype.HeavyDmg)
+				enemy.AddEffectFrom("bleed", &player)
 			}
 		} else {
-			enemy.Life -= HEAVY_ATK_DMG
+			enemy.Life -= player.damage(player.Archetype.HeavyDmg)
+			enemy.SetState("standing", 0)
+			enemy.AddEffectFrom("bleed", &player)
+		}
+	case "slamming":
+		if enemy.State == "parrying" {
+			player.SetState("parried", PARRY_STUN_TIME)
 			enemy.SetState("standing", 0)
+		} else {
+			enemy.Life -= player.damage(SLAM_DMG)
+			if CANCELABLE_STATES[enemy.State] || enemy.State == "blocking" {
+				enemy.SetState("standing", 0)
+			}
 		}
+	case "grabbing":
+		if enemy.State == "blocking" {
+			enemy.SpendStamina(GRAB_STAMINA_DMG)
+			enemy.SetState("grabbed", GRAB_STUN_TIME)
+			enemy.AddEffect("guard crush")
+		} else {
+			player.SetState("grab whiff", GRAB_WHIFF_TIME)
+		}
+	case "parrying":
+		// If we get here, nothing landed while the parry was up.
+		player.SetState("parry whiff", PARRY_WHIFF_TIME)
 	}
 	player.Finished = ""
 	return player, enemy
 }
 
 // Called when a player command is received.
-func resolveCommand(player, enemy Player, random *rand.Rand) (Player, Player) {
+func resolveCommand(player, enemy Player, random Random) (Player, Player) {
 	// Interrupt resolution has to be handled first, otherwise non-arrow keys can't be punished.
 	if strings.HasPrefix(player.State, "interrupt") && player.Command != "NONE" {
 		// If we hit the right button (position 10 is just after the '_'):
@@ -231,13 +549,13 @@ func resolveCommand(player, enemy Player, random *rand.Rand) (Player, Player) {
 			// If we're not the interrupting player, we're the heavy
 			// attack player, so the heavy attack hits.
 			if !strings.HasPrefix(player.State, "interrupting") {
-				enemy.Life -= HEAVY_ATK_DMG
+				enemy.Life -= player.damage(player.Archetype.HeavyDmg)
 			}
 		} else {
 			// Same as above only this time we hit the wrong button, so the condition
 			// is reversed - we take damage if we're the interrupting player.
 			if strings.HasPrefix(player.State, "interrupting") {
-				player.Life -= HEAVY_ATK_DMG
+				player.Life -= enemy.damage(enemy.Archetype.HeavyDmg)
 			}
 		}
 		player.SetState("standing", 0)
@@ -257,58 +575,108 @@ func resolveCommand(player, enemy Player, random *rand.Rand) (Player, Player) {
 		}
 	case "BLOCK":
 		if INTERRUPTABLE_STATES[player.State] && player.State != "blocking" {
-			player.SetState("blocking", 0)
+			// If the block was made a little while ago, it's been going since then as far
+			// as the counter window is concerned.
+			player.SetState("blocking", -player.CommandLag)
 		}
 	case "DODGE":
 		// Dodges take time, unlike blocks which can be started at the last second.
-		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= DODGE_COST && enemy.StateDuration > DODGE_WINDOW {
-			player.Stamina -= DODGE_COST
-			if ATTACK_STATES[enemy.State] {
+		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= DODGE_COST &&
+			enemy.StateDuration+player.CommandLag > player.actionTime(DODGE_WINDOW) {
+			player.SpendStamina(DODGE_COST)
+			player.RemoveEffect("stagger")
+			if CANCELABLE_STATES[enemy.State] {
 				enemy.SetState("standing", 0)
 			}
 		}
 	case "SAVE":
 		if player.State == "countered" && player.Stamina >= SAVE_COST {
-			player.Stamina -= SAVE_COST
+			player.SpendStamina(SAVE_COST)
 			player.SetState("standing", 0)
 			enemy.SetState("standing", 0)
+		} else if player.State == "hit stun" && player.Stamina >= BURST_COST {
+			// Bursting out of a combo knocks the enemy out of their next hit too.
+			player.SpendStamina(BURST_COST)
+			player.SetState("standing", 0)
+			if enemy.State == "light attack" {
+				enemy.SetState("standing", 0)
+			}
+			enemy.Combo = 0
+			enemy.ComboTime = 0
 		}
 	case "LIGHT":
-		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= LIGHT_ATK_COST {
-			player.Stamina -= LIGHT_ATK_COST
+		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= player.Archetype.LightCost {
+			// A light attack soon after landing one continues the combo, unless it's already as long as it gets.
+			if player.ComboTime == 0 || player.Combo >= COMBO_MAX {
+				player.Combo = 0
+			}
+			player.ComboTime = 0
+			// This has to be worked out before spending the stamina, since that could make the player exhausted.
+			lightTime := player.lightTime()
+			player.SpendStamina(player.Archetype.LightCost)
+			player.RemoveEffect("stagger")
 			// If the attack is going to interrupt a heavy attack, enter the interrupt mode.
-			if enemy.State == "heavy attack" && enemy.StateDuration > LIGHT_ATK_TIME {
+			if enemy.State == "heavy attack" && enemy.StateDuration+player.CommandLag > lightTime {
 				key := INTERRUPT_RESOLVE_KEYS[random.Intn(4)]
 				player.SetState("interrupting heavy"+key, 0)
 				enemy.SetState("interrupted heavy"+key, 0)
-				enemy.Life -= LIGHT_ATK_DMG
+				enemy.Life -= player.damage(player.Archetype.LightDmg)
 			} else {
-				player.SetState("light attack", LIGHT_ATK_TIME)
+				player.SetState("light attack", lightTime)
 			}
 		}
 	case "HEAVY":
-		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= HEAVY_ATK_COST {
-			player.SetState("heavy attack", HEAVY_ATK_TIME)
-			player.Stamina -= HEAVY_ATK_COST
+		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= player.Archetype.HeavyCost {
+			player.SetState("heavy attack", player.actionTime(player.Archetype.HeavyTime))
+			player.SpendStamina(player.Archetype.HeavyCost)
+			player.RemoveEffect("stagger")
+		}
+	case "SPECIAL":
+		player, enemy = resolveSpecial(player, enemy)
+	case "GRAB":
+		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= GRAB_COST {
+			player.SetState("grabbing", player.actionTime(GRAB_TIME))
+			player.SpendStamina(GRAB_COST)
+			player.RemoveEffect("stagger")
+		}
+	case "PARRY":
+		if INTERRUPTABLE_STATES[player.State] && player.Stamina >= PARRY_COST {
+			// This has to be worked out before spending the stamina, since that could make the player exhausted.
+			window := player.parryWindow()
+			player.SpendStamina(PARRY_COST)
+			player.SetState("parrying", window)
+			player.RemoveEffect("stagger")
+		}
+	case "FEINT":
+		// You can only feint an attack you started recently.
+		var attackCost float32
+		switch player.State {
+		case "light attack":
+			attackCost = player.Archetype.LightCost
+		case "heavy attack":
+			attackCost = player.Archetype.HeavyCost
+		}
+		if attackCost != 0 && player.StateLength-player.StateDuration <= FEINT_WINDOW {
+			player.Stamina += attackCost * FEINT_REFUND
+			if player.Stamina > player.maxStamina() {
+				player.Stamina = player.maxStamina()
+			}
+			player.SetState("feint recovery", FEINT_RECOVERY_TIME)
+			// A block that was started against the feinted attack has to be started over
+			// to counter the next one.
+			if enemy.State == "blocking" {
+				enemy.SetState("blocking", 0)
+			}
 		}
 	}
 	// Reset the command so it doesn't register again; except for blocking, because that would un-block the player.
 	if player.Command != "BLOCK" {
 		player.Command = "NONE"
 	}
+	player.CommandLag = 0
 	return player, enemy
 }
 
-func catchInput(channel chan Message, stopChan chan bool) {
-	for true {
-		select {
-		case <-channel:
-		case <-stopChan:
-			return
-		}
-	}
-}
-
 // This function accepts an interrupt state and returns the key that must be pressed to resolve it favorably.
 func getInterruptKey(state string) string {
 	return state[strings.Index(state, "_")+1:]
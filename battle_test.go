@@ -7,153 +7,597 @@ package main
 
 import (
 	"math/rand"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// playerWith returns a new Player with the given fields changed.
+func playerWith(life int, stamina float32, state string, duration int) Player {
+	p := NewPlayer()
+	p.Life = life
+	p.Stamina = stamina
+	p.SetState(state, duration)
+	return p
+}
+
+// midway returns the player partway through a state that takes the given time in total.
+func midway(p Player, length int) Player {
+	p.StateLength = length
+	return p
+}
+
+// spent returns the player as they'd be right after losing some stamina.
+func spent(p Player) Player {
+	p.RegenDelay = REGEN_DELAY
+	return p
+}
+
+// comboing returns the player as they'd be right after landing the given hit of a combo.
+func comboing(p Player, hits int) Player {
+	p.Combo = hits
+	p.ComboTime = COMBO_WINDOW
+	return p
+}
+
 func TestResolveState(t *testing.T) {
-	p1 := NewPlayer(nil, nil)
-	p2 := NewPlayer(nil, nil)
+	p1 := NewPlayer()
+	p2 := NewPlayer()
 
 	// Test light attack against no defense
 	p1.Finished = "light attack"
 	newp1, newp2 := resolveState(p1, p2)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, Player{nil, nil, "NONE", 100 - LIGHT_ATK_DMG, 100.0, "standing", 0, ""})
+	assert.Equal(t, newp1, comboing(NewPlayer(), 1))
+	assert.Equal(t, newp2, playerWith(100-LIGHT_ATK_DMG, 100.0, "hit stun", HIT_STUN_TIME))
 
 	// Test light attack canceling light attack
 	p1.Finished = "light attack"
 	p2.SetState("light attack", 5)
 	newp1, newp2 = resolveState(p1, p2)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, Player{nil, nil, "NONE", 100 - LIGHT_ATK_DMG, 100.0, "standing", 0, ""})
-	p2 = NewPlayer(nil, nil)
+	assert.Equal(t, newp1, comboing(NewPlayer(), 1))
+	assert.Equal(t, newp2, playerWith(100-LIGHT_ATK_DMG, 100.0, "hit stun", HIT_STUN_TIME))
+	p2 = NewPlayer()
 
 	// Test light attack against a block too slow to counter
+	p1 = midway(NewPlayer(), LIGHT_ATK_TIME)
 	p2.SetState("blocking", -1)
 	p1.Finished = "light attack"
 	newp1, newp2 = resolveState(p1, p2)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, Player{nil, nil, "NONE", 100, 100.0 - LIGHT_ATK_BLK_COST, "blocking", -1, ""})
-	p2 = NewPlayer(nil, nil)
+	assert.Equal(t, newp1, midway(NewPlayer(), LIGHT_ATK_TIME))
+	assert.Equal(t, newp2, spent(playerWith(100, 100.0-LIGHT_ATK_BLK_COST, "blocking", -1)))
+	p2 = NewPlayer()
 
 	// Test light attack against a block fast enough to counter
-	p2.SetState("blocking", -(LIGHT_ATK_SPD - LIGHT_ATK_CNTR_WINDOW))
+	p2.SetState("blocking", -(LIGHT_ATK_TIME - LIGHT_ATK_CNTR_WINDOW))
 	p1.Finished = "light attack"
 	newp1, newp2 = resolveState(p1, p2)
-	assert.Equal(t, newp1, Player{nil, nil, "NONE", 100, 100.0, "countered", 0, ""})
-	assert.Equal(t, newp2, Player{nil, nil, "NONE", 100, 100.0 - LIGHT_ATK_BLK_COST, "counterattack", 30, ""})
-	p2 = NewPlayer(nil, nil)
+	assert.Equal(t, newp1, playerWith(100, 100.0, "countered", 0))
+	assert.Equal(t, newp2, spent(playerWith(100, 100.0-LIGHT_ATK_BLK_COST, "counterattack", LIGHT_ATK_CNTR_TIME)))
+	p1 = NewPlayer()
+	p2 = NewPlayer()
 
 	// Test counterattack hitting
 	p1.Finished = "counterattack"
 	newp1, newp2 = resolveState(p1, p2)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, Player{nil, nil, "NONE", 100 - LIGHT_ATK_CNTR_DMG, 100.0, "standing", 0, ""})
+	assert.Equal(t, newp1, NewPlayer())
+	assert.Equal(t, newp2, playerWith(100-LIGHT_ATK_CNTR_DMG, 100.0, "standing", 0))
 
 	// Test heavy attack against no defense
 	p1.Finished = "heavy attack"
 	newp1, newp2 = resolveState(p1, p2)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, Player{nil, nil, "NONE", 100 - HEAVY_ATK_DMG, 100.0, "standing", 0, ""})
+	assert.Equal(t, newp1, NewPlayer())
+	bleeding := playerWith(100-HEAVY_ATK_DMG, 100.0, "standing", 0)
+	bleeding.AddEffect("bleed")
+	assert.Equal(t, newp2, bleeding)
 
 	// Test blocked heavy attack
 	p2.State = "blocking"
 	p1.Finished = "heavy attack"
 	newp1, newp2 = resolveState(p1, p2)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, Player{nil, nil, "NONE", 100 - HEAVY_ATK_BLKED_DMG, 100 - DODGE_COST, "blocking", 0, ""})
-	p2 = NewPlayer(nil, nil)
+	assert.Equal(t, newp1, NewPlayer())
+	staggered := spent(playerWith(100-HEAVY_ATK_BLKED_DMG, 100-DODGE_COST, "blocking", 0))
+	staggered.AddEffect("stagger")
+	assert.Equal(t, newp2, staggered)
+	p2 = NewPlayer()
 }
 
-func testResolveCommand(t *testing.T) {
-	p1 := NewPlayer(nil, nil)
-	p2 := NewPlayer(nil, nil)
+func TestResolveCommand(t *testing.T) {
 	random := rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	// Test light attack
+	p1 := NewPlayer()
 	p1.Command = "LIGHT"
-	newp1, newp2 := resolveCommand(p1, p2, random)
-	assert.Equal(t, newp1, Player{nil, nil, "NONE", 100, 100.0 - LIGHT_ATK_COST, "light attack", LIGHT_ATK_SPD, ""})
+	newp1, newp2 := resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, spent(playerWith(100, 100.0-LIGHT_ATK_COST, "light attack", LIGHT_ATK_TIME)), newp1)
+	assert.Equal(t, NewPlayer(), newp2)
 
 	// Test save
-	p1.SetState("countered", 0)
-	p2.SetState("countering", LIGHT_ATK_SPD)
+	p1 = playerWith(100, 100.0, "countered", 0)
 	p1.Command = "SAVE"
-	newp1, newp2 = resolveCommand(p1, p2, random)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, NewPlayer(nil, nil))
+	newp1, newp2 = resolveCommand(p1, playerWith(100, 100.0, "counterattack", LIGHT_ATK_CNTR_TIME), random)
+	assert.Equal(t, spent(playerWith(100, 100.0-SAVE_COST, "standing", 0)), newp1)
+	assert.Equal(t, NewPlayer(), newp2)
 
 	// Test that save does nothing when not in a countered state
-	p1.SetState("standing", 0)
-	p2.SetState("light attack", LIGHT_ATK_SPD)
+	p1 = NewPlayer()
 	p1.Command = "SAVE"
-	newp1, newp2 = resolveCommand(p1, p2, random)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, Player{nil, nil, "NONE", 100, 100.0, "light attack", LIGHT_ATK_SPD, ""})
+	newp1, newp2 = resolveCommand(p1, playerWith(100, 100.0, "light attack", LIGHT_ATK_TIME), random)
+	assert.Equal(t, NewPlayer(), newp1)
+	assert.Equal(t, playerWith(100, 100.0, "light attack", LIGHT_ATK_TIME), newp2)
 
 	// Test light attack interrupting a heavy
-	p2.SetState("heavy attack", 100)
+	p1 = NewPlayer()
 	p1.Command = "LIGHT"
-	newp1, newp2 = resolveCommand(p1, p2, random)
-	assert.Equal(t, newp1.Life, 100)
-	assert.Equal(t, newp1.Stamina, 90)
-	assert.Contains(t, newp1.State, "interruping heavy")
-	assert.Equal(t, newp2.Life, 100-LIGHT_ATK_DMG)
-	assert.Equal(t, newp2.Stamina, 100)
+	newp1, newp2 = resolveCommand(p1, playerWith(100, 100.0, "heavy attack", HEAVY_ATK_TIME), random)
+	assert.Equal(t, 100, newp1.Life)
+	assert.Equal(t, float32(100.0-LIGHT_ATK_COST), newp1.Stamina)
+	assert.Contains(t, newp1.State, "interrupting heavy")
+	assert.Equal(t, 100-LIGHT_ATK_DMG, newp2.Life)
+	assert.Equal(t, float32(100.0), newp2.Stamina)
 	assert.Contains(t, newp2.State, "interrupted heavy")
+	assert.Equal(t, getInterruptKey(newp1.State), getInterruptKey(newp2.State))
 
 	// Test that the interrupt resolution keys don't do anything outside of interrupt mode
-	p1.SetState("standing", 0)
-	p2.SetState("standing", 0)
+	p1 = NewPlayer()
 	p1.Command = "INTERRUPT_UP"
-	newp1, newp2 = resolveCommand(p1, p2, random)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, NewPlayer(nil, nil))
+	newp1, newp2 = resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, NewPlayer(), newp1)
+	assert.Equal(t, NewPlayer(), newp2)
 
 	// Test interrupt resolution: the light attack player hits it first
-	p1.SetState("interrupting heavy_up", 0)
-	p2.SetState("interrupted heavy_up", 0)
+	p1 = playerWith(100, 100.0, "interrupting heavy_up", 0)
 	p1.Command = "INTERRUPT_UP"
-	newp1, newp2 = resolveCommand(p1, p2, random)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, NewPlayer(nil, nil))
+	newp1, newp2 = resolveCommand(p1, playerWith(100, 100.0, "interrupted heavy_up", 0), random)
+	assert.Equal(t, NewPlayer(), newp1)
+	assert.Equal(t, NewPlayer(), newp2)
 
 	// Test interrupt resolution: the light attack player hits the wrong button
-	p1.SetState("interrupting heavy_up", 0)
-	p2.SetState("interrupted heavy_up", 0)
+	p1 = playerWith(100, 100.0, "interrupting heavy_up", 0)
 	p1.Command = "INTERRUPT_DOWN"
-	newp1, newp2 = resolveCommand(p1, p2, random)
-	assert.Equal(t, newp1, Player{nil, nil, "NONE", 100 - HEAVY_ATK_DMG, 100.0, "standing", 0, ""})
-	assert.Equal(t, newp2, NewPlayer(nil, nil))
+	newp1, newp2 = resolveCommand(p1, playerWith(100, 100.0, "interrupted heavy_up", 0), random)
+	assert.Equal(t, playerWith(100-HEAVY_ATK_DMG, 100.0, "standing", 0), newp1)
+	assert.Equal(t, NewPlayer(), newp2)
 
 	// Test interrupt resolution: the heavy attack player hits it first
-	p1.SetState("interrupted heavy_up", 0)
-	p2.SetState("interrupting heavy_up", 0)
+	p1 = playerWith(100, 100.0, "interrupted heavy_up", 0)
 	p1.Command = "INTERRUPT_UP"
-	newp1, newp2 = resolveCommand(p1, p2, random)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, Player{nil, nil, "NONE", 100 - HEAVY_ATK_DMG, 100.0, "standing", 0, ""})
+	newp1, newp2 = resolveCommand(p1, playerWith(100, 100.0, "interrupting heavy_up", 0), random)
+	assert.Equal(t, NewPlayer(), newp1)
+	assert.Equal(t, playerWith(100-HEAVY_ATK_DMG, 100.0, "standing", 0), newp2)
 
 	// Test interrupt resolution: the heavy attack player hits the wrong button
-	p1.SetState("interrupted heavy_up", 0)
-	p2.SetState("interrupting heavy_up", 0)
+	p1 = playerWith(100, 100.0, "interrupted heavy_up", 0)
 	p1.Command = "INTERRUPT_DOWN"
-	newp1, newp2 = resolveCommand(p1, p2, random)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, NewPlayer(nil, nil))
+	newp1, newp2 = resolveCommand(p1, playerWith(100, 100.0, "interrupting heavy_up", 0), random)
+	assert.Equal(t, NewPlayer(), newp1)
+	assert.Equal(t, NewPlayer(), newp2)
 
 	// Test dodging: too slow
-	p1.SetState("standing", 0)
-	p2.SetState("light attack", DODGE_SPD-1)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, Player{nil, nil, "NONE", 100, 100.0, "light attack", DODGE_SPD - 1, ""})
+	p1 = NewPlayer()
+	p1.Command = "DODGE"
+	newp1, newp2 = resolveCommand(p1, playerWith(100, 100.0, "light attack", DODGE_WINDOW), random)
+	assert.Equal(t, NewPlayer(), newp1)
+	assert.Equal(t, playerWith(100, 100.0, "light attack", DODGE_WINDOW), newp2)
 
 	// Test dodging: in time
-	p1.SetState("standing", 0)
-	p2.SetState("light attack", DODGE_SPD)
-	assert.Equal(t, newp1, NewPlayer(nil, nil))
-	assert.Equal(t, newp2, NewPlayer(nil, nil))
+	p1 = NewPlayer()
+	p1.Command = "DODGE"
+	newp1, newp2 = resolveCommand(p1, playerWith(100, 100.0, "light attack", DODGE_WINDOW+1), random)
+	assert.Equal(t, spent(playerWith(100, 100.0-DODGE_COST, "standing", 0)), newp1)
+	assert.Equal(t, NewPlayer(), newp2)
+}
+
+func TestLaggedCommands(t *testing.T) {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// A lagged block has been going since it was made, so it can get a counter it otherwise wouldn't.
+	p1 := NewPlayer()
+	p2 := NewPlayer()
+	p1.Command = "BLOCK"
+	p1.CommandLag = 10
+	p1, p2 = resolveCommand(p1, p2, random)
+	assert.Equal(t, "blocking", p1.State)
+	assert.Equal(t, -10, p1.StateDuration)
+	assert.Equal(t, 0, p1.CommandLag)
+
+	// A dodge that arrived too late still counts if it was made in time.
+	p1 = NewPlayer()
+	p2 = playerWith(100, 100, "heavy attack", DODGE_WINDOW-2)
+	p1.Command = "DODGE"
+	p1.CommandLag = 5
+	p1, p2 = resolveCommand(p1, p2, random)
+	assert.Equal(t, float32(100-DODGE_COST), p1.Stamina)
+	assert.Equal(t, "standing", p2.State)
+
+	// Same for a light attack interrupting a heavy.
+	p1 = NewPlayer()
+	p2 = playerWith(100, 100, "heavy attack", LIGHT_ATK_TIME-2)
+	p1.Command = "LIGHT"
+	p1.CommandLag = 5
+	p1, p2 = resolveCommand(p1, p2, random)
+	assert.Contains(t, p1.State, "interrupting heavy")
+	assert.Contains(t, p2.State, "interrupted heavy")
+}
+
+func TestStep(t *testing.T) {
+	start := BattleState{Seed: 42, Players: []Player{NewPlayer(), NewPlayer()}}
+
+	// Stepping doesn't touch the state it was given.
+	next := Step(start, []TickInput{{Player: 0, Command: "LIGHT"}})
+	assert.Equal(t, NewPlayer(), start.Players[0])
+	assert.Equal(t, 0, start.Tick)
+	assert.Equal(t, 1, next.Tick)
+	assert.Equal(t, "light attack", next.Players[0].State)
+
+	// Only a player's last input on a tick counts.
+	next = Step(start, []TickInput{{Player: 1, Command: "LIGHT"}, {Player: 1, Command: "HEAVY"}})
+	assert.Equal(t, "heavy attack", next.Players[1].State)
+
+	// The same state and inputs always give the same result, including which key resolves an interrupt.
+	inputs := [][]TickInput{{{Player: 1, Command: "HEAVY"}}, nil, {{Player: 0, Command: "LIGHT", Lag: 3}}, nil}
+	run := func() BattleState {
+		state := start
+		for _, tickInputs := range inputs {
+			state = Step(state, tickInputs)
+		}
+		return state
+	}
+	first := run()
+	assert.Contains(t, first.Players[0].State, "interrupting heavy")
+	assert.Equal(t, first, run())
+
+	// But a different seed can give a different key.
+	keys := make(map[string]bool)
+	for seed := int64(0); seed < 20; seed++ {
+		start.Seed = seed
+		keys[getInterruptKey(run().Players[0].State)] = true
+	}
+	assert.True(t, len(keys) > 1)
+}
+
+func TestFeint(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	// Feinting a heavy attack early refunds part of its cost and resets the enemy's block.
+	p1 := midway(playerWith(100, 50, "heavy attack", HEAVY_ATK_TIME-FEINT_WINDOW), HEAVY_ATK_TIME)
+	p1.Command = "FEINT"
+	p2 := playerWith(100, 100, "blocking", -40)
+	p1, p2 = resolveCommand(p1, p2, random)
+	assert.Equal(t, playerWith(100, 50+HEAVY_ATK_COST*FEINT_REFUND, "feint recovery", FEINT_RECOVERY_TIME), p1)
+	assert.Equal(t, playerWith(100, 100, "blocking", 0), p2)
+
+	// Light attacks can be feinted too, and the refund doesn't go over 100.
+	p1 = playerWith(100, 99, "light attack", LIGHT_ATK_TIME)
+	p1.Command = "FEINT"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, playerWith(100, 100, "feint recovery", FEINT_RECOVERY_TIME), p1)
+
+	// Too late to feint.
+	p1 = midway(playerWith(100, 50, "heavy attack", HEAVY_ATK_TIME-FEINT_WINDOW-1), HEAVY_ATK_TIME)
+	p1.Command = "FEINT"
+	p1, p2 = resolveCommand(p1, playerWith(100, 100, "blocking", -40), random)
+	assert.Equal(t, midway(playerWith(100, 50, "heavy attack", HEAVY_ATK_TIME-FEINT_WINDOW-1), HEAVY_ATK_TIME), p1)
+	assert.Equal(t, playerWith(100, 100, "blocking", -40), p2)
+
+	// Nothing to feint.
+	for _, state := range []string{"standing", "blocking", "counterattack", "feint recovery"} {
+		p1 = playerWith(100, 50, state, 10)
+		p1.Command = "FEINT"
+		p1, _ = resolveCommand(p1, NewPlayer(), random)
+		assert.Equal(t, playerWith(100, 50, state, 10), p1, state)
+	}
+
+	// You can't do anything else until the recovery is over.
+	p1 = playerWith(100, 100, "feint recovery", 5)
+	p1.Command = "LIGHT"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, playerWith(100, 100, "feint recovery", 5), p1)
+	p1.PassTime(5)
+	assert.Equal(t, "standing", p1.State)
+}
+
+func TestGrab(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	// Starting a grab only works from an interruptable state with enough stamina.
+	for _, state := range BINARY_STATES {
+		// In an interrupt, any key but the right arrow resolves it, which is tested elsewhere.
+		if strings.HasPrefix(state, "interrupt") {
+			continue
+		}
+		p1 := playerWith(100, 100, state, 10)
+		p1.Command = "GRAB"
+		p1, _ = resolveCommand(p1, NewPlayer(), random)
+		if INTERRUPTABLE_STATES[state] {
+			assert.Equal(t, spent(playerWith(100, 100-GRAB_COST, "grabbing", GRAB_TIME)), p1, state)
+		} else {
+			assert.Equal(t, playerWith(100, 100, state, 10), p1, state)
+		}
+	}
+	p1 := playerWith(100, GRAB_COST-1, "standing", 0)
+	p1.Command = "GRAB"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, playerWith(100, GRAB_COST-1, "standing", 0), p1)
+
+	// A grab landing beats a block and whiffs against everything else.
+	for _, state := range BINARY_STATES {
+		p1 := NewPlayer()
+		p1.Finished = "grabbing"
+		newp1, newp2 := resolveState(p1, playerWith(100, 50, state, -10))
+		if state == "blocking" {
+			assert.Equal(t, NewPlayer(), newp1)
+			crushed := spent(playerWith(100, 50-GRAB_STAMINA_DMG, "grabbed", GRAB_STUN_TIME))
+			crushed.AddEffect("guard crush")
+			assert.Equal(t, crushed, newp2)
+		} else {
+			assert.Equal(t, playerWith(100, 100, "grab whiff", GRAB_WHIFF_TIME), newp1, state)
+			assert.Equal(t, playerWith(100, 50, state, -10), newp2, state)
+		}
+	}
+	// Stamina doesn't go negative.
+	p1 = NewPlayer()
+	p1.Finished = "grabbing"
+	_, p2 := resolveState(p1, playerWith(100, 5, "blocking", 0))
+	expected := spent(playerWith(100, 0, "grabbed", GRAB_STUN_TIME))
+	expected.Exhausted = true
+	expected.AddEffect("guard crush")
+	assert.Equal(t, expected, p2)
+
+	// Any attack landing on someone who's grabbing stops the grab.
+	for attack, dmg := range map[string]int{"light attack": LIGHT_ATK_DMG, "heavy attack": HEAVY_ATK_DMG, "counterattack": LIGHT_ATK_CNTR_DMG} {
+		p1 := NewPlayer()
+		p1.Finished = attack
+		_, p2 := resolveState(p1, playerWith(100, 100, "grabbing", 10))
+		assert.NotEqual(t, "grabbing", p2.State, attack)
+		assert.Equal(t, 100-dmg, p2.Life, attack)
+	}
+
+	// Grabs can be dodged.
+	p1 = NewPlayer()
+	p1.Command = "DODGE"
+	p1, p2 = resolveCommand(p1, playerWith(100, 100, "grabbing", GRAB_TIME), random)
+	assert.Equal(t, spent(playerWith(100, 100-DODGE_COST, "standing", 0)), p1)
+	assert.Equal(t, playerWith(100, 100, "standing", 0), p2)
+
+	// Played out in full: a grab against someone holding block stuns them until it wears off...
+	state := BattleState{Players: []Player{NewPlayer(), NewPlayer()}}
+	state = Step(state, []TickInput{{Player: 0, Command: "GRAB"}, {Player: 1, Command: "BLOCK"}})
+	for state.Players[1].State != "grabbed" {
+		state = Step(state, nil)
+		assert.True(t, state.Time(state.Tick) <= GRAB_TIME+10)
+	}
+	for state.Players[1].State == "grabbed" {
+		state = Step(state, nil)
+	}
+	assert.Equal(t, GRAB_TIME+GRAB_STUN_TIME+10, state.Time(state.Tick))
+	// ...and then they go back to blocking because they're still holding the key.
+	assert.Equal(t, "blocking", state.Players[1].State)
+
+	// ...and against a light attack started at the same time, the grab whiffs and the attack lands.
+	state = BattleState{Players: []Player{NewPlayer(), NewPlayer()}}
+	state = Step(state, []TickInput{{Player: 0, Command: "GRAB"}, {Player: 1, Command: "LIGHT"}})
+	for state.Players[1].State == "light attack" {
+		state = Step(state, nil)
+	}
+	assert.Equal(t, "grab whiff", state.Players[0].State)
+	assert.Equal(t, 100-LIGHT_ATK_DMG, state.Players[0].Life)
+}
+
+func TestParry(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	// Parries start from the same states as blocks.
+	p1 := playerWith(100, 100, "blocking", -10)
+	p1.Command = "PARRY"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, spent(playerWith(100, 100-PARRY_COST, "parrying", PARRY_WINDOW)), p1)
+	// Being staggered makes the parry shorter, and uses up the stagger.
+	p1 = playerWith(100, 100, "standing", 0)
+	p1.AddEffect("stagger")
+	p1.Command = "PARRY"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, "parrying", p1.State)
+	assert.Equal(t, float32(100-PARRY_COST), p1.Stamina)
+	assert.True(t, p1.StateDuration < PARRY_WINDOW)
+	assert.Equal(t, 0, p1.EffectStacks("stagger"))
+	p1 = playerWith(100, 100, "light attack", 10)
+	p1.Command = "PARRY"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, playerWith(100, 100, "light attack", 10), p1)
+
+	// A parry negates either attack and leaves the attacker stunned.
+	for _, attack := range []string{"light attack", "heavy attack"} {
+		p1 := NewPlayer()
+		p1.Finished = attack
+		p1, p2 := resolveState(p1, playerWith(100, 50, "parrying", 3))
+		assert.Equal(t, playerWith(100, 100, "parried", PARRY_STUN_TIME), p1, attack)
+		assert.Equal(t, playerWith(100, 50, "standing", 0), p2, attack)
+	}
+
+	// A parry that runs out without catching anything leaves you open.
+	p1 = NewPlayer()
+	p1.Finished = "parrying"
+	p1, _ = resolveState(p1, NewPlayer())
+	assert.Equal(t, playerWith(100, 100, "parry whiff", PARRY_WHIFF_TIME), p1)
+
+	// Played out: parrying a heavy right before it lands...
+	state := BattleState{Players: []Player{NewPlayer(), NewPlayer()}}
+	state = Step(state, []TickInput{{Player: 0, Command: "HEAVY"}})
+	for state.Time(state.Tick) < HEAVY_ATK_TIME-PARRY_WINDOW/2 {
+		state = Step(state, nil)
+	}
+	state = Step(state, []TickInput{{Player: 1, Command: "PARRY"}})
+	for state.Players[0].State == "heavy attack" {
+		state = Step(state, nil)
+	}
+	assert.Equal(t, "parried", state.Players[0].State)
+	assert.Equal(t, 100, state.Players[1].Life)
+	// ...gives time for a free light attack.
+	state = Step(state, []TickInput{{Player: 1, Command: "LIGHT"}})
+	for state.Players[1].State == "light attack" {
+		state = Step(state, nil)
+	}
+	assert.Equal(t, 100-LIGHT_ATK_DMG, state.Players[0].Life)
+
+	// Parrying too early whiffs, and the heavy lands during the recovery.
+	state = BattleState{Players: []Player{NewPlayer(), NewPlayer()}}
+	state = Step(state, []TickInput{{Player: 0, Command: "HEAVY"}})
+	for state.Time(state.Tick) < HEAVY_ATK_TIME-PARRY_WINDOW*2 {
+		state = Step(state, nil)
+	}
+	state = Step(state, []TickInput{{Player: 1, Command: "PARRY"}})
+	for state.Players[0].State == "heavy attack" {
+		state = Step(state, nil)
+	}
+	assert.Equal(t, 100-HEAVY_ATK_DMG, state.Players[1].Life)
+}
+
+func TestStamina(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	// Regen stops for a while after spending stamina.
+	p1 := NewPlayer()
+	p1.Command = "LIGHT"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	for i := 0; i < REGEN_DELAY; i++ {
+		p1.PassTime(1)
+	}
+	assert.Equal(t, 100-LIGHT_ATK_COST, p1.Stamina)
+	assert.Equal(t, 0, p1.RegenDelay)
+	p1.PassTime(10)
+	assert.Equal(t, 100-LIGHT_ATK_COST+0.1, p1.Stamina)
+
+	// It's slower while blocking.
+	p1 = playerWith(100, 50, "blocking", 0)
+	p1.PassTime(10)
+	assert.Equal(t, 50+0.1*BLOCKING_REGEN, p1.Stamina)
+
+	// Running out makes you exhausted, which makes everything slower.
+	p1 = playerWith(100, HEAVY_ATK_COST, "standing", 0)
+	p1.Command = "HEAVY"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	assert.True(t, p1.Exhausted)
+	assert.True(t, p1.Status().Exhausted)
+	assert.Equal(t, HEAVY_ATK_TIME, p1.StateDuration)
+	p1 = playerWith(100, 50, "standing", 0)
+	p1.Exhausted = true
+	p1.Command = "HEAVY"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, int(float32(HEAVY_ATK_TIME)*EXHAUSTED_SLOWDOWN), p1.StateDuration)
+	// The feint window still starts from when the slower attack did.
+	p1.StateDuration -= FEINT_WINDOW + 1
+	p1.Command = "FEINT"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, "heavy attack", p1.State)
+	p1.StateDuration++
+	p1.Command = "FEINT"
+	p1, _ = resolveCommand(p1, NewPlayer(), random)
+	assert.Equal(t, "feint recovery", p1.State)
+
+	// Failing a block exhausts you too.
+	p1 = NewPlayer()
+	p1.Finished = "heavy attack"
+	_, p2 := resolveState(p1, playerWith(100, HEAVY_ATK_BLK_COST-1, "blocking", 0))
+	assert.True(t, p2.Exhausted)
+	assert.Equal(t, float32(0), p2.Stamina)
+
+	// It wears off once you've got enough stamina back.
+	p1 = playerWith(100, EXHAUSTION_RECOVERY-0.05, "standing", 0)
+	p1.Exhausted = true
+	p1.PassTime(10)
+	assert.False(t, p1.Exhausted)
+}
+
+func TestTickRate(t *testing.T) {
+	// Ticks that aren't a whole number of milliseconds still add up.
+	state := BattleState{TickRate: 60}
+	assert.Equal(t, []int{0, 16, 33, 1000}, []int{state.Time(0), state.Time(1), state.Time(2), state.Time(60)})
+	assert.Equal(t, 10, BattleState{}.Time(1))
+
+	// The same things take the same time whatever the tick rate.
+	for _, rate := range []int{50, 60, 100, 120, 1000} {
+		state := BattleState{TickRate: rate, Players: []Player{NewPlayer(), NewPlayer()}}
+		state.Players[1].Stamina = 50
+		state = Step(state, []TickInput{{Player: 0, Command: "HEAVY"}})
+		for state.Players[0].State == "heavy attack" {
+			state = Step(state, nil)
+		}
+		landed := state.Time(state.Tick)
+		assert.True(t, landed >= HEAVY_ATK_TIME && landed < HEAVY_ATK_TIME+state.Time(1)+1, "%d: %d", rate, landed)
+		assert.InDelta(t, 50+float32(landed)*state.Players[1].Archetype.Regen/1000, state.Players[1].Stamina, 0.01, "%d", rate)
+		// The bleed from the heavy attack hurts the same number of times too.
+		for len(state.Players[1].Effects) > 0 {
+			state = Step(state, nil)
+		}
+		assert.Equal(t, 100-HEAVY_ATK_DMG-5*BLEED_DMG, state.Players[1].Life, "%d", rate)
+	}
+}
+
+func TestCombo(t *testing.T) {
+	// stepUntilLanded steps until player 0's light attack lands.
+	stepUntilLanded := func(state BattleState) BattleState {
+		for state.Players[0].State == "light attack" {
+			state = Step(state, nil)
+		}
+		return state
+	}
+
+	// A full chain, each hit started as soon as the last one lands.
+	state := BattleState{Players: []Player{NewPlayer(), NewPlayer()}}
+	state.Players[1].Life = 1000
+	life := 1000
+	for hit := 0; hit < COMBO_MAX; hit++ {
+		state = Step(state, []TickInput{{Player: 0, Command: "LIGHT"}})
+		assert.Equal(t, LIGHT_ATK_TIME-hit*COMBO_SPEEDUP, state.Players[0].StateDuration, "hit %d", hit)
+		state = stepUntilLanded(state)
+		life -= LIGHT_ATK_DMG + hit*COMBO_DMG_BONUS
+		assert.Equal(t, life, state.Players[1].Life, "hit %d", hit)
+		assert.Equal(t, hit+1, state.Players[0].Combo)
+		assert.Equal(t, hit+1, state.Players[0].Status().Combo)
+		assert.Equal(t, "hit stun", state.Players[1].State)
+	}
+	// After the longest chain, the next one starts over.
+	state = Step(state, []TickInput{{Player: 0, Command: "LIGHT"}})
+	assert.Equal(t, LIGHT_ATK_TIME, state.Players[0].StateDuration)
+	assert.Equal(t, 0, state.Players[0].Combo)
+
+	// Waiting too long drops the combo.
+	state = BattleState{Players: []Player{NewPlayer(), NewPlayer()}}
+	state = stepUntilLanded(Step(state, []TickInput{{Player: 0, Command: "LIGHT"}}))
+	for i := 0; i < COMBO_WINDOW; i++ {
+		state = Step(state, nil)
+	}
+	assert.Equal(t, 0, state.Players[0].Combo)
+	state = Step(state, []TickInput{{Player: 0, Command: "LIGHT"}})
+	assert.Equal(t, LIGHT_ATK_TIME, state.Players[0].StateDuration)
+
+	// A blocked hit ends it.
+	p1 := midway(comboing(NewPlayer(), 2), LIGHT_ATK_TIME-2*COMBO_SPEEDUP)
+	p1.Finished = "light attack"
+	p1, p2 := resolveState(p1, playerWith(100, 100, "blocking", 0))
+	assert.Equal(t, 0, p1.Combo)
+	assert.Equal(t, "blocking", p2.State)
+
+	// Bursting out of the stun stops the next hit and ends the combo.
+	state = BattleState{Players: []Player{NewPlayer(), NewPlayer()}}
+	state = stepUntilLanded(Step(state, []TickInput{{Player: 0, Command: "LIGHT"}}))
+	state = Step(state, []TickInput{{Player: 0, Command: "LIGHT"}})
+	state = Step(state, []TickInput{{Player: 1, Command: "SAVE"}})
+	assert.Equal(t, playerWith(100-LIGHT_ATK_DMG, 100-BURST_COST, "standing", 0), clearRegen(state.Players[1]))
+	assert.Equal(t, "standing", state.Players[0].State)
+	assert.Equal(t, 0, state.Players[0].Combo)
+	// Without enough stamina you can't.
+	p2 = playerWith(100, BURST_COST-1, "hit stun", 10)
+	p2.Command = "SAVE"
+	p2, _ = resolveCommand(p2, playerWith(100, 100, "light attack", 10), rand.New(rand.NewSource(1)))
+	assert.Equal(t, "hit stun", p2.State)
+}
+
+// clearRegen zeroes the regen delay so players can be compared without counting the cycles since they spent
+// stamina.
+func clearRegen(p Player) Player {
+	p.RegenDelay = 0
+	return p
 }
@@ -0,0 +1,467 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file has the compact binary encoding for battle traffic, which clients can ask for in their hello instead
+// of JSON. Only inputs, updates and deltas are ever binary; everything else stays JSON in text frames, so the
+// two can always be told apart by the websocket frame type.
+//
+// Every binary message starts with a byte saying what kind it is. After that:
+//   - An input is a byte with the input's index in BINARY_INPUTS, then the tick it was made on and its sequence
+//     number as uvarints.
+//   - An update is the tick as a uvarint, two encoded statuses (self and then enemy) and the acks.
+//   - A delta is the tick as a uvarint, a byte with bit 0 set if self changed and bit 1 if the enemy did, the
+//     changed statuses, and the acks. Each status starts with a uvarint of STATUS_FIELD_* flags and then has
+//     only the flagged fields.
+//
+// Acks are a uvarint count followed by that many pairs of uvarints, the sequence number and then the tick.
+//
+// There's no binary form for the combatants list, so updates and deltas that have one go as JSON.
+//
+// In a status, life and state duration are zigzag varints, stamina is a big-endian uint16 in hundredths, the
+// state is its index in BINARY_STATES, ping, regen delay and combo are uvarints, exhausted is a byte that's 0
+// or 1, and effects are the stacks of bleed, stagger and guard crush as uvarints. The same tables are in app.js,
+// so the order of both must never change - new values only go on the end. Adding any means bumping
+// BINARY_PROTOCOL_VERSION along with PROTOCOL_VERSION, so clients with the old tables get JSON instead.
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ENCODING_JSON   = "json"
+	ENCODING_BINARY = "binary"
+	// The first protocol version in which the binary encoding can be asked for.
+	BINARY_PROTOCOL_VERSION = 14
+)
+
+// The kinds of binary message.
+const (
+	BIN_UPDATE byte = 1
+	BIN_DELTA  byte = 2
+	BIN_INPUT  byte = 3
+)
+
+// The flags in a delta's status header, one for each field that's present.
+const (
+	STATUS_FIELD_LIFE uint = 1 << iota
+	STATUS_FIELD_STAMINA
+	STATUS_FIELD_STATE
+	STATUS_FIELD_STATE_DURATION
+	STATUS_FIELD_PING
+	STATUS_FIELD_EXHAUSTED
+	STATUS_FIELD_REGEN_DELAY
+	STATUS_FIELD_COMBO
+	STATUS_FIELD_EFFECTS
+	STATUS_FIELD_ALL = STATUS_FIELD_LIFE | STATUS_FIELD_STAMINA | STATUS_FIELD_STATE | STATUS_FIELD_STATE_DURATION |
+		STATUS_FIELD_PING | STATUS_FIELD_EXHAUSTED | STATUS_FIELD_REGEN_DELAY | STATUS_FIELD_COMBO | STATUS_FIELD_EFFECTS
+)
+
+// Stamina is sent as a whole number of these.
+const STAMINA_FIXED_POINT = 100
+
+var BINARY_INPUTS = []string{"NONE", "BLOCK", "LIGHT", "HEAVY", "DODGE", "SAVE",
+	"INTERRUPT_UP", "INTERRUPT_DOWN", "INTERRUPT_LEFT", "INTERRUPT_RIGHT", "FEINT", "GRAB", "PARRY", "SPECIAL"}
+
+var BINARY_STATES = []string{"standing", "blocking", "light attack", "heavy attack", "counterattack", "countered",
+	"interrupting heavy_up", "interrupting heavy_down", "interrupting heavy_left", "interrupting heavy_right",
+	"interrupted heavy_up", "interrupted heavy_down", "interrupted heavy_left", "interrupted heavy_right",
+	"feint recovery", "grabbing", "grabbed", "grab whiff",
+	"parrying", "parried", "parry whiff", "slamming", "hit stun"}
+
+// These are the reverse of the tables above.
+var binaryInputCodes = indexTable(BINARY_INPUTS)
+var binaryStateCodes = indexTable(BINARY_STATES)
+
+func indexTable(values []string) map[string]byte {
+	codes := make(map[string]byte, len(values))
+	for i, value := range values {
+		codes[value] = byte(i)
+	}
+	return codes
+}
+
+// encodeBinary encodes an Update, an UpdateDelta or an InputPayload. ok is false for anything else, and for
+// updates with combatants, which means it has to go as JSON.
+func encodeBinary(msg interface{}) (data []byte, ok bool, err error) {
+	switch msg := msg.(type) {
+	case Update:
+		if msg.Combatants != nil {
+			return nil, false, nil
+		}
+		data = binary.AppendUvarint([]byte{BIN_UPDATE}, uint64(msg.Tick))
+		if data, err = appendStatus(data, msg.Self, STATUS_FIELD_ALL); err != nil {
+			return nil, false, err
+		}
+		if data, err = appendStatus(data, msg.Enemy, STATUS_FIELD_ALL); err != nil {
+			return nil, false, err
+		}
+		data = appendAcks(data, msg.Acks)
+	case UpdateDelta:
+		if msg.Combatants != nil {
+			return nil, false, nil
+		}
+		var present byte
+		if msg.Self != nil {
+			present |= 1
+		}
+		if msg.Enemy != nil {
+			present |= 2
+		}
+		data = append(binary.AppendUvarint([]byte{BIN_DELTA}, uint64(msg.Tick)), present)
+		if msg.Self != nil {
+			if data, err = appendStatusDelta(data, msg.Self); err != nil {
+				return nil, false, err
+			}
+		}
+		if msg.Enemy != nil {
+			if data, err = appendStatusDelta(data, msg.Enemy); err != nil {
+				return nil, false, err
+			}
+		}
+		data = appendAcks(data, msg.Acks)
+	case InputPayload:
+		code, known := binaryInputCodes[msg.Input]
+		if !known {
+			return nil, false, errors.Errorf("no binary code for input %q", msg.Input)
+		}
+		if msg.Tick < 0 || msg.Seq < 0 {
+			return nil, false, errors.New("negative tick or sequence number")
+		}
+		data = binary.AppendUvarint([]byte{BIN_INPUT, code}, uint64(msg.Tick))
+		data = binary.AppendUvarint(data, uint64(msg.Seq))
+	default:
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// appendAcks encodes a list of acks with its count in front.
+func appendAcks(data []byte, acks []InputAck) []byte {
+	data = binary.AppendUvarint(data, uint64(len(acks)))
+	for _, ack := range acks {
+		data = binary.AppendUvarint(data, uint64(ack.Seq))
+		data = binary.AppendUvarint(data, uint64(ack.Tick))
+	}
+	return data
+}
+
+// appendStatus encodes the given fields of a PlayerStatus, without a header.
+func appendStatus(data []byte, status PlayerStatus, fields uint) ([]byte, error) {
+	if fields&STATUS_FIELD_LIFE != 0 {
+		data = binary.AppendVarint(data, int64(status.Life))
+	}
+	if fields&STATUS_FIELD_STAMINA != 0 {
+		stamina := math.Round(float64(status.Stamina) * STAMINA_FIXED_POINT)
+		if stamina < 0 || stamina > math.MaxUint16 {
+			return nil, errors.Errorf("stamina %v out of range for binary encoding", status.Stamina)
+		}
+		data = binary.BigEndian.AppendUint16(data, uint16(stamina))
+	}
+	if fields&STATUS_FIELD_STATE != 0 {
+		code, known := binaryStateCodes[status.State]
+		if !known {
+			return nil, errors.Errorf("no binary code for state %q", status.State)
+		}
+		data = append(data, code)
+	}
+	if fields&STATUS_FIELD_STATE_DURATION != 0 {
+		data = binary.AppendVarint(data, int64(status.StateDuration))
+	}
+	if fields&STATUS_FIELD_PING != 0 {
+		if status.Ping < 0 {
+			return nil, errors.Errorf("negative ping %d", status.Ping)
+		}
+		data = binary.AppendUvarint(data, uint64(status.Ping))
+	}
+	if fields&STATUS_FIELD_EXHAUSTED != 0 {
+		var exhausted byte
+		if status.Exhausted {
+			exhausted = 1
+		}
+		data = append(data, exhausted)
+	}
+	if fields&STATUS_FIELD_REGEN_DELAY != 0 {
+		if status.RegenDelay < 0 {
+			return nil, errors.Errorf("negative regen delay %d", status.RegenDelay)
+		}
+		data = binary.AppendUvarint(data, uint64(status.RegenDelay))
+	}
+	if fields&STATUS_FIELD_COMBO != 0 {
+		if status.Combo < 0 {
+			return nil, errors.Errorf("negative combo %d", status.Combo)
+		}
+		data = binary.AppendUvarint(data, uint64(status.Combo))
+	}
+	if fields&STATUS_FIELD_EFFECTS != 0 {
+		for _, stacks := range []int{status.Effects.Bleed, status.Effects.Stagger, status.Effects.GuardCrush} {
+			if stacks < 0 {
+				return nil, errors.Errorf("negative effect stacks %d", stacks)
+			}
+			data = binary.AppendUvarint(data, uint64(stacks))
+		}
+	}
+	return data, nil
+}
+
+// appendStatusDelta encodes a PlayerStatusDelta with its header.
+func appendStatusDelta(data []byte, delta *PlayerStatusDelta) ([]byte, error) {
+	var fields uint
+	var status PlayerStatus
+	if delta.Life != nil {
+		fields |= STATUS_FIELD_LIFE
+		status.Life = *delta.Life
+	}
+	if delta.Stamina != nil {
+		fields |= STATUS_FIELD_STAMINA
+		status.Stamina = *delta.Stamina
+	}
+	if delta.State != nil {
+		fields |= STATUS_FIELD_STATE
+		status.State = *delta.State
+	}
+	if delta.StateDuration != nil {
+		fields |= STATUS_FIELD_STATE_DURATION
+		status.StateDuration = *delta.StateDuration
+	}
+	if delta.Ping != nil {
+		fields |= STATUS_FIELD_PING
+		status.Ping = *delta.Ping
+	}
+	if delta.Exhausted != nil {
+		fields |= STATUS_FIELD_EXHAUSTED
+		status.Exhausted = *delta.Exhausted
+	}
+	if delta.RegenDelay != nil {
+		fields |= STATUS_FIELD_REGEN_DELAY
+		status.RegenDelay = *delta.RegenDelay
+	}
+	if delta.Combo != nil {
+		fields |= STATUS_FIELD_COMBO
+		status.Combo = *delta.Combo
+	}
+	if delta.Effects != nil {
+		fields |= STATUS_FIELD_EFFECTS
+		status.Effects = *delta.Effects
+	}
+	return appendStatus(binary.AppendUvarint(data, uint64(fields)), status, fields)
+}
+
+// decodeBinary decodes a binary message into an Update, an UpdateDelta or an InputPayload. The server only ever
+// receives inputs, but it can decode everything so the encoding can be tested.
+func decodeBinary(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty binary message")
+	}
+	r := binaryReader{data: data[1:]}
+	var msg interface{}
+	switch data[0] {
+	case BIN_UPDATE:
+		tick := r.uvarint()
+		msg = Update{Tick: tick, Self: r.status(STATUS_FIELD_ALL), Enemy: r.status(STATUS_FIELD_ALL), Acks: r.acks()}
+	case BIN_DELTA:
+		delta := UpdateDelta{Tick: r.uvarint()}
+		present := r.byte()
+		if present&1 != 0 {
+			delta.Self = r.statusDelta()
+		}
+		if present&2 != 0 {
+			delta.Enemy = r.statusDelta()
+		}
+		delta.Acks = r.acks()
+		if present&^3 != 0 {
+			r.fail(errors.Errorf("bad delta header %#x", present))
+		}
+		msg = delta
+	case BIN_INPUT:
+		code := r.byte()
+		tick, seq := r.uvarint(), r.uvarint()
+		if r.err == nil && int(code) >= len(BINARY_INPUTS) {
+			r.fail(errors.Errorf("unknown input code %d", code))
+		}
+		if r.err == nil {
+			msg = InputPayload{Input: BINARY_INPUTS[code], Tick: tick, Seq: seq}
+		}
+	default:
+		return nil, errors.Errorf("unknown binary message kind %d", data[0])
+	}
+	if r.err == nil && len(r.data) > 0 {
+		r.fail(errors.Errorf("%d bytes left over", len(r.data)))
+	}
+	if r.err != nil {
+		return nil, errors.Wrap(r.err, "when decoding binary message")
+	}
+	return msg, nil
+}
+
+// binaryReader reads fields off the front of a binary message. After the first error it stops reading and
+// returns zero values, so callers can check err once at the end.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *binaryReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 1 {
+		r.fail(errors.New("message too short"))
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *binaryReader) varint() int {
+	if r.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(r.data)
+	if n <= 0 || value > math.MaxInt32 || value < math.MinInt32 {
+		r.fail(errors.New("bad varint"))
+		return 0
+	}
+	r.data = r.data[n:]
+	return int(value)
+}
+
+func (r *binaryReader) uvarint() int {
+	if r.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 || value > math.MaxInt32 {
+		r.fail(errors.New("bad uvarint"))
+		return 0
+	}
+	r.data = r.data[n:]
+	return int(value)
+}
+
+func (r *binaryReader) acks() []InputAck {
+	count := r.uvarint()
+	// Each ack takes at least two bytes, so this stops a bogus count from allocating a huge slice.
+	if r.err != nil || count == 0 || count > len(r.data)/2 {
+		if count > len(r.data)/2 {
+			r.fail(errors.Errorf("%d acks can't fit in what's left", count))
+		}
+		return nil
+	}
+	acks := make([]InputAck, count)
+	for i := range acks {
+		acks[i] = InputAck{Seq: r.uvarint(), Tick: r.uvarint()}
+	}
+	return acks
+}
+
+func (r *binaryReader) status(fields uint) PlayerStatus {
+	var status PlayerStatus
+	if fields&STATUS_FIELD_LIFE != 0 {
+		status.Life = r.varint()
+	}
+	if fields&STATUS_FIELD_STAMINA != 0 {
+		high, low := r.byte(), r.byte()
+		status.Stamina = float32(uint16(high)<<8|uint16(low)) / STAMINA_FIXED_POINT
+	}
+	if fields&STATUS_FIELD_STATE != 0 {
+		code := r.byte()
+		if r.err == nil && int(code) >= len(BINARY_STATES) {
+			r.fail(errors.Errorf("unknown state code %d", code))
+		}
+		if r.err == nil {
+			status.State = BINARY_STATES[code]
+		}
+	}
+	if fields&STATUS_FIELD_STATE_DURATION != 0 {
+		status.StateDuration = r.varint()
+	}
+	if fields&STATUS_FIELD_PING != 0 {
+		status.Ping = r.uvarint()
+	}
+	if fields&STATUS_FIELD_EXHAUSTED != 0 {
+		switch r.byte() {
+		case 0:
+		case 1:
+			status.Exhausted = true
+		default:
+			r.fail(errors.New("exhausted flag isn't 0 or 1"))
+		}
+	}
+	if fields&STATUS_FIELD_REGEN_DELAY != 0 {
+		status.RegenDelay = r.uvarint()
+	}
+	if fields&STATUS_FIELD_COMBO != 0 {
+		status.Combo = r.uvarint()
+	}
+	if fields&STATUS_FIELD_EFFECTS != 0 {
+		status.Effects = EffectStatus{Bleed: r.uvarint(), Stagger: r.uvarint(), GuardCrush: r.uvarint()}
+	}
+	return status
+}
+
+func (r *binaryReader) statusDelta() *PlayerStatusDelta {
+	fields := uint(r.uvarint())
+	if fields&^STATUS_FIELD_ALL != 0 {
+		r.fail(errors.Errorf("bad status header %#x", fields))
+	}
+	status := r.status(fields)
+	delta := &PlayerStatusDelta{}
+	if fields&STATUS_FIELD_LIFE != 0 {
+		delta.Life = &status.Life
+	}
+	if fields&STATUS_FIELD_STAMINA != 0 {
+		delta.Stamina = &status.Stamina
+	}
+	if fields&STATUS_FIELD_STATE != 0 {
+		delta.State = &status.State
+	}
+	if fields&STATUS_FIELD_STATE_DURATION != 0 {
+		delta.StateDuration = &status.StateDuration
+	}
+	if fields&STATUS_FIELD_PING != 0 {
+		delta.Ping = &status.Ping
+	}
+	if fields&STATUS_FIELD_EXHAUSTED != 0 {
+		delta.Exhausted = &status.Exhausted
+	}
+	if fields&STATUS_FIELD_REGEN_DELAY != 0 {
+		delta.RegenDelay = &status.RegenDelay
+	}
+	if fields&STATUS_FIELD_COMBO != 0 {
+		delta.Combo = &status.Combo
+	}
+	if fields&STATUS_FIELD_EFFECTS != 0 {
+		delta.Effects = &status.Effects
+	}
+	return delta
+}
+
+// decodeBinaryInbound decodes a binary frame from a client, which can only be a battle input.
+func decodeBinaryInbound(data []byte) (Message, error) {
+	msg, err := decodeBinary(data)
+	if err != nil {
+		return Message{}, err
+	}
+	input, ok := msg.(InputPayload)
+	if !ok {
+		return Message{}, errors.Errorf("clients can't send %T", msg)
+	}
+	return Message{Content: input.Input, Tick: input.Tick, Seq: input.Seq}, nil
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// quantize rounds the stamina in an Update the same way the binary encoding does.
+func quantize(update Update) Update {
+	update.Self.Stamina = float32(math.Round(float64(update.Self.Stamina)*STAMINA_FIXED_POINT)) / STAMINA_FIXED_POINT
+	update.Enemy.Stamina = float32(math.Round(float64(update.Enemy.Stamina)*STAMINA_FIXED_POINT)) / STAMINA_FIXED_POINT
+	return update
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	e := newDeltaEncoder()
+	var state Update
+	for _, update := range simulateUpdates(2000) {
+		// Full updates come back as they went, apart from stamina rounding.
+		data, ok, err := encodeBinary(update)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		decoded, err := decodeBinary(data)
+		assert.Nil(t, err)
+		assert.Equal(t, quantize(update), decoded)
+
+		// And so does the state rebuilt from deltas.
+		msg, changed := e.Next(update)
+		if !changed {
+			state.Tick = update.Tick
+			continue
+		}
+		data, ok, err = encodeBinary(msg)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		decoded, err = decodeBinary(data)
+		assert.Nil(t, err)
+		switch decoded := decoded.(type) {
+		case Update:
+			state = decoded
+		case UpdateDelta:
+			state.Tick = decoded.Tick
+			applyStatusDelta(&state.Self, decoded.Self)
+			applyStatusDelta(&state.Enemy, decoded.Enemy)
+		}
+		assert.Equal(t, quantize(update), state)
+	}
+
+	for _, input := range BINARY_INPUTS {
+		data, ok, err := encodeBinary(InputPayload{Input: input})
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		msg, err := decodeBinaryInbound(data)
+		assert.Nil(t, err)
+		assert.Equal(t, Message{Content: input}, msg)
+	}
+	data, _, err := encodeBinary(InputPayload{Input: "BLOCK", Tick: 1234, Seq: 56})
+	assert.Nil(t, err)
+	msg, err := decodeBinaryInbound(data)
+	assert.Nil(t, err)
+	assert.Equal(t, Message{Content: "BLOCK", Tick: 1234, Seq: 56}, msg)
+
+	// Acks survive in both updates and deltas.
+	acks := []InputAck{{Seq: 1, Tick: 300}, {Seq: 2, Tick: 301}}
+	update := Update{Tick: 301, Self: PlayerStatus{State: "standing"}, Enemy: PlayerStatus{State: "blocking"}, Acks: acks}
+	data, _, err = encodeBinary(update)
+	assert.Nil(t, err)
+	decoded, err := decodeBinary(data)
+	assert.Nil(t, err)
+	assert.Equal(t, update, decoded)
+	delta := UpdateDelta{Tick: 301, Acks: acks}
+	data, _, err = encodeBinary(delta)
+	assert.Nil(t, err)
+	decoded, err = decodeBinary(data)
+	assert.Nil(t, err)
+	assert.Equal(t, delta, decoded)
+}
+
+func applyStatusDelta(status *PlayerStatus, delta *PlayerStatusDelta) {
+	if delta == nil {
+		return
+	}
+	if delta.Life != nil {
+		status.Life = *delta.Life
+	}
+	if delta.Stamina != nil {
+		status.Stamina = *delta.Stamina
+	}
+	if delta.State != nil {
+		status.State = *delta.State
+	}
+	if delta.StateDuration != nil {
+		status.StateDuration = *delta.StateDuration
+	}
+	if delta.Ping != nil {
+		status.Ping = *delta.Ping
+	}
+	if delta.Exhausted != nil {
+		status.Exhausted = *delta.Exhausted
+	}
+	if delta.RegenDelay != nil {
+		status.RegenDelay = *delta.RegenDelay
+	}
+	if delta.Combo != nil {
+		status.Combo = *delta.Combo
+	}
+	if delta.Effects != nil {
+		status.Effects = *delta.Effects
+	}
+}
+
+func TestBinaryErrors(t *testing.T) {
+	// Things that can't be encoded.
+	_, _, err := encodeBinary(InputPayload{Input: "TAUNT"})
+	assert.NotNil(t, err)
+	_, _, err = encodeBinary(Update{Self: PlayerStatus{State: "dancing"}})
+	assert.NotNil(t, err)
+	_, _, err = encodeBinary(Update{Self: PlayerStatus{State: "standing", Stamina: -1}})
+	assert.NotNil(t, err)
+	_, _, err = encodeBinary(Update{Self: PlayerStatus{State: "standing", Ping: -1}})
+	assert.NotNil(t, err)
+	_, _, err = encodeBinary(Update{Self: PlayerStatus{State: "standing", RegenDelay: -1}})
+	assert.NotNil(t, err)
+	_, _, err = encodeBinary(Update{Self: PlayerStatus{State: "standing", Combo: -1}})
+	assert.NotNil(t, err)
+	_, _, err = encodeBinary(Update{Self: PlayerStatus{State: "standing", Effects: EffectStatus{Stagger: -1}}})
+	assert.NotNil(t, err)
+	// Things that just aren't sent as binary.
+	_, ok, err := encodeBinary(ResultPayload{Outcome: "win"})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, ok, err = encodeBinary(battleOf(NO_TEAM, NO_TEAM, NO_TEAM).UpdateFor(0, nil))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, ok, err = encodeBinary(UpdateDelta{Combatants: map[int]Combatant{2: {Name: "bob"}}})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// Things that can't be decoded.
+	for _, data := range [][]byte{
+		{},
+		{99},
+		{BIN_INPUT},
+		{BIN_INPUT, 200},
+		{BIN_INPUT, 1, 1, 1, 1},
+		{BIN_UPDATE, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 5},
+		{BIN_UPDATE, 1},
+		{BIN_DELTA, 4},
+		{BIN_DELTA, 1, 0x80},
+		{BIN_DELTA, 1, 0x80, 0x04},
+	} {
+		_, err := decodeBinary(data)
+		assert.NotNil(t, err, "%v", data)
+	}
+
+	// Clients can only send inputs.
+	data, _, _ := encodeBinary(Update{Self: PlayerStatus{State: "standing"}, Enemy: PlayerStatus{State: "standing"}})
+	_, err = decodeBinaryInbound(data)
+	assert.NotNil(t, err)
+}
+
+// Arbitrary bytes must never crash the decoder, and anything it accepts has to survive being encoded again.
+func FuzzDecodeBinary(f *testing.F) {
+	for _, update := range simulateUpdates(200) {
+		data, _, _ := encodeBinary(update)
+		f.Add(data)
+	}
+	e := newDeltaEncoder()
+	for _, update := range simulateUpdates(200) {
+		if msg, ok := e.Next(update); ok {
+			data, _, _ := encodeBinary(msg)
+			f.Add(data)
+		}
+	}
+	f.Add([]byte{BIN_INPUT, 2, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := decodeBinary(data)
+		if err != nil {
+			return
+		}
+		encoded, ok, err := encodeBinary(msg)
+		if err != nil || !ok {
+			t.Fatalf("couldn't re-encode %#v: %v", msg, err)
+		}
+		again, err := decodeBinary(encoded)
+		if err != nil {
+			t.Fatalf("couldn't decode re-encoded %#v: %v", msg, err)
+		}
+		assert.Equal(t, msg, again)
+	})
+}
+
+// This is the binary counterpart to BenchmarkDeltaUpdates in delta_test.go.
+func BenchmarkBinaryDeltaUpdates(b *testing.B) {
+	updates := simulateUpdates(1000)
+	e := newDeltaEncoder()
+	b.ResetTimer()
+	var bytes int
+	for i := 0; i < b.N; i++ {
+		msg, ok := e.Next(updates[i%len(updates)])
+		if !ok {
+			continue
+		}
+		data, _, err := encodeBinary(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		bytes += len(data)
+	}
+	b.ReportMetric(float64(bytes)/float64(b.N), "wire-bytes/op")
+}
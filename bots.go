@@ -4,7 +4,8 @@
  */
 
 // This file contains bots, which are functions spawned in goroutines for
-// each battle against them. They connect with channels just like a player.
+// each battle against them. They get their updates from the match just like a player, and give up once the
+// updates stop coming.
 
 package main
 
@@ -14,24 +15,90 @@ import (
 	"time"
 )
 
-// getBotByName is a convenience function to convert a bot's name to the function.
-func getBotByName(bot string) func(chan Message, chan Update) {
+// getBotByName is a convenience function to convert a bot's name to the function. Bots are told which archetype
+// they're fighting as so they know what their attacks cost.
+func getBotByName(bot string) func(<-chan Update, func(Message), *Archetype) {
 	switch bot {
 	case "AttackBot":
 		return AttackBot
 	case "AttackBotSlow":
 		return AttackBotSlow
+	case "FeintBot":
+		return FeintBot
 	default:
 		return nil
 	}
 }
 
+// runBot plays the seat-th player in a match with the given bot until the battle's over, logging what it does.
+func runBot(name string, bot func(<-chan Update, func(Message), *Archetype), match *Match, seat int,
+	archetype *Archetype) {
+	log := match.Log.With("bot", name)
+	log.Debug("bot starting")
+	bot(match.Updates(seat), func(input Message) {
+		log.Debug("bot input", "input", input.Content)
+		match.Input(seat, input)
+	}, archetype)
+	log.Debug("bot stopped")
+}
+
+// How long bots wait before they start fighting, since the battle starts during the client's countdown.
+const BOT_COUNTDOWN = 4500 * time.Millisecond
+
+// botWait waits for the given time, skipping the updates that come in meanwhile since they'll be out of date by
+// then. It returns false if the battle ends first.
+func botWait(updates <-chan Update, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case _, ok := <-updates:
+			if !ok {
+				return false
+			}
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// interruptTimer decides when a bot answers an interrupt, which is a random .5 to .75 seconds after it starts.
+// Updates can come less often than ticks, so the bot can't count on seeing the tick an interrupt started on.
+// Instead it notices a new one by the state changing, or by less time having passed in it than at the last
+// update, for a new interrupt with the same state.
+type interruptTimer struct {
+	state   string
+	elapsed int
+	resolve time.Time
+}
+
+// due says whether it's time to answer the interrupt the bot is in, given its status as of now. It's false
+// when the bot isn't in one.
+func (t *interruptTimer) due(self PlayerStatus, now time.Time, random *rand.Rand) bool {
+	if !strings.HasPrefix(self.State, "interrupt") {
+		t.state = ""
+		return false
+	}
+	// Interrupt states start with a duration of 0 and count down from there until they're resolved.
+	elapsed := -self.StateDuration
+	if self.State != t.state || elapsed < t.elapsed {
+		t.resolve = now.Add(time.Duration(random.Intn(250)+500) * time.Millisecond)
+	}
+	t.state, t.elapsed = self.State, elapsed
+	return now.After(t.resolve)
+}
+
 // AttackBot spams random attacks whenever it can.
-func AttackBot(inputChan chan Message, updateChan chan Update) {
+func AttackBot(updates <-chan Update, send func(Message), archetype *Archetype) {
 	// Don't attack during the countdown.
-	time.Sleep(4500 * time.Millisecond)
+	if !botWait(updates, BOT_COUNTDOWN) {
+		return
+	}
 	random := rand.New(rand.NewSource(time.Now().UnixNano()))
-	update := <-updateChan
+	update, ok := <-updates
+	if !ok {
+		return
+	}
 	input := "NONE"
 	attacks := []string{"LIGHT", "HEAVY"}
 	// waitingState is a way to know whether the bot's last input has been acknowledged, by keeping track of the
@@ -39,25 +106,15 @@ func AttackBot(inputChan chan Message, updateChan chan Update) {
 	// because that could cause it to auto-lose interrupt it initiates. We won't send a command if waitingState is
 	// set.
 	waitingState := ""
-	// The time at which the bot will resolve the interrupt.
-	var interruptResolveTime time.Time
+	var interrupts interruptTimer
 	for update.Self.Life > 0 && update.Enemy.Life > 0 {
 		// Resolve interrupts after a while.
-		if strings.HasPrefix(update.Self.State, "interrupt") {
-			// If the interrupt just started, set a new resolution time, so we don't insta-resolve the
-			// second interrupt.
-			if update.Self.StateDuration == 0 {
-				// From .5 to .75 seconds after now.
-				interruptResolveTime = time.Now().Add(
-					time.Duration(random.Intn(250)+500) * time.Millisecond)
-			} else if time.Now().After(interruptResolveTime) {
-				inputChan <- Message{Username: "AttackBot",
-					Content: "INTERRUPT_" + getInterruptKey(update.Self.State)}
-			}
+		if interrupts.due(update.Self, time.Now(), random) {
+			send(Message{Username: "AttackBot", Content: "INTERRUPT_" + getInterruptKey(update.Self.State)})
 		}
 		// Now handle the neutral game. It doesn't do any attacks unless it has enough stamina for a heavy,
 		// because otherwise it would get stuck spamming light attacks at low stamina.
-		if INTERRUPTABLE_STATES[update.Self.State] && update.Self.Stamina >= HEAVY_ATK_COST && update.Self.State != waitingState {
+		if INTERRUPTABLE_STATES[update.Self.State] && update.Self.Stamina >= archetype.HeavyCost && update.Self.State != waitingState {
 			// Don't send another command if we're still waiting for our state to change.
 			// Don't do light attacks into a prepared block.
 			if update.Enemy.State == "blocking" {
@@ -65,10 +122,12 @@ func AttackBot(inputChan chan Message, updateChan chan Update) {
 			} else {
 				input = attacks[random.Intn(2)]
 			}
-			inputChan <- Message{Username: "AttackBot", Content: input}
+			send(Message{Username: "AttackBot", Content: input})
 			waitingState = update.Self.State
 		}
-		update = <-updateChan
+		if update, ok = <-updates; !ok {
+			return
+		}
 		// If our state has changed, we can stop waiting and it's safe to send commands again.
 		if update.Self.State != waitingState {
 			waitingState = ""
@@ -77,11 +136,16 @@ func AttackBot(inputChan chan Message, updateChan chan Update) {
 }
 
 // AttackBotSlow is like AttackBot, but doesn't have perfect reaction time.
-func AttackBotSlow(inputChan chan Message, updateChan chan Update) {
+func AttackBotSlow(updates <-chan Update, send func(Message), archetype *Archetype) {
 	// Don't attack during the countdown.
-	time.Sleep(4500 * time.Millisecond)
+	if !botWait(updates, BOT_COUNTDOWN) {
+		return
+	}
 	random := rand.New(rand.NewSource(time.Now().UnixNano()))
-	update := <-updateChan
+	update, ok := <-updates
+	if !ok {
+		return
+	}
 	input := "NONE"
 	attacks := []string{"LIGHT", "HEAVY"}
 	// waitingState is a way to know whether the bot's last input has been acknowledged, by keeping track of the
@@ -89,26 +153,15 @@ func AttackBotSlow(inputChan chan Message, updateChan chan Update) {
 	// because that could cause it to auto-lose interrupt it initiates. We won't send a command if waitingState is
 	// set.
 	waitingState := ""
-	// This value doesn't count down; it's set when an interrupt occurs and the bot resolves it when it's been
-	// longer than this.
-	var interruptResolveTime time.Time
+	var interrupts interruptTimer
 	for update.Self.Life > 0 && update.Enemy.Life > 0 {
 		// Resolve interrupts after a while.
-		if strings.HasPrefix(update.Self.State, "interrupt") {
-			// If the interrupt just started, set a new resolution time, so we don't insta-resolve the
-			// second interrupt.
-			if update.Self.StateDuration == 0 {
-				// From .5 to .75 seconds after now.
-				interruptResolveTime = time.Now().Add(
-					time.Duration(random.Intn(250)+500) * time.Millisecond)
-			} else if time.Now().After(interruptResolveTime) {
-				inputChan <- Message{Username: "AttackBotSlow",
-					Content: "INTERRUPT_" + getInterruptKey(update.Self.State)}
-			}
+		if interrupts.due(update.Self, time.Now(), random) {
+			send(Message{Username: "AttackBotSlow", Content: "INTERRUPT_" + getInterruptKey(update.Self.State)})
 		}
 		// It doesn't do any attacks unless it has enough stamina for a heavy,
 		// because otherwise it would get stuck spamming light attacks at low stamina.
-		if INTERRUPTABLE_STATES[update.Self.State] && update.Self.Stamina >= HEAVY_ATK_COST && update.Self.State != waitingState {
+		if INTERRUPTABLE_STATES[update.Self.State] && update.Self.Stamina >= archetype.HeavyCost && update.Self.State != waitingState {
 			// Don't send another command if we're still waiting for our state to change.
 			// Don't do light attacks into a prepared block.
 			if update.Enemy.State == "blocking" {
@@ -117,11 +170,64 @@ func AttackBotSlow(inputChan chan Message, updateChan chan Update) {
 				input = attacks[random.Intn(2)]
 			}
 			// Wait a small randomized delay before acting.
-			time.Sleep(time.Duration((200 + random.Intn(133))) * time.Millisecond)
-			inputChan <- Message{Username: "AttackBotSlow", Content: input}
+			if !botWait(updates, time.Duration((200+random.Intn(133)))*time.Millisecond) {
+				return
+			}
+			send(Message{Username: "AttackBotSlow", Content: input})
 			waitingState = update.Self.State
 		}
-		update = <-updateChan
+		if update, ok = <-updates; !ok {
+			return
+		}
+		// If our state has changed, we can stop waiting and it's safe to send commands again.
+		if update.Self.State != waitingState {
+			waitingState = ""
+		}
+	}
+}
+
+// FeintBot opens with heavy attacks, but feints them if the enemy blocks early, and tries to catch them with a
+// light attack when they let go of the block.
+func FeintBot(updates <-chan Update, send func(Message), archetype *Archetype) {
+	// Don't attack during the countdown.
+	if !botWait(updates, BOT_COUNTDOWN) {
+		return
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	update, ok := <-updates
+	if !ok {
+		return
+	}
+	// See AttackBot.
+	waitingState := ""
+	var interrupts interruptTimer
+	for update.Self.Life > 0 && update.Enemy.Life > 0 {
+		if interrupts.due(update.Self, time.Now(), random) {
+			send(Message{Username: "FeintBot", Content: "INTERRUPT_" + getInterruptKey(update.Self.State)})
+		}
+		input := ""
+		switch {
+		case update.Self.State == waitingState:
+			// Still waiting for the last command to take effect.
+		// If the enemy has already started blocking our heavy attack, feint it while we still can.
+		case update.Self.State == "heavy attack" && update.Enemy.State == "blocking" &&
+			archetype.HeavyTime-update.Self.StateDuration <= FEINT_WINDOW:
+			input = "FEINT"
+		case INTERRUPTABLE_STATES[update.Self.State] && update.Self.Stamina >= archetype.HeavyCost:
+			// A light attack into someone who isn't blocking, a heavy attack to bait out a block otherwise.
+			if update.Enemy.State == "standing" && update.Self.Stamina >= archetype.HeavyCost+archetype.LightCost {
+				input = "LIGHT"
+			} else if update.Enemy.State != "blocking" || update.Self.Stamina >= 2*archetype.HeavyCost {
+				input = "HEAVY"
+			}
+		}
+		if input != "" {
+			send(Message{Username: "FeintBot", Content: input})
+			waitingState = update.Self.State
+		}
+		if update, ok = <-updates; !ok {
+			return
+		}
 		// If our state has changed, we can stop waiting and it's safe to send commands again.
 		if update.Self.State != waitingState {
 			waitingState = ""
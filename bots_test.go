@@ -0,0 +1,55 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBotInterruptTiming(t *testing.T) {
+	// Updates come a fifth as often as ticks, so the bot never sees the tick the interrupt starts on.
+	const tickRate, updateRate = 100, 20
+	state := BattleState{TickRate: tickRate, Seed: 42, Players: []Player{NewPlayer(), NewPlayer()}}
+	inputs := map[int][]TickInput{0: {{Player: 1, Command: "HEAVY"}}, 2: {{Player: 0, Command: "LIGHT"}}}
+	random := rand.New(rand.NewSource(1))
+	var interrupts interruptTimer
+	now := time.Unix(0, 0)
+	var started, answered time.Time
+	var interrupt string
+	for tick := 0; answered.IsZero(); tick++ {
+		state = Step(state, inputs[tick])
+		if state.Tick%(tickRate/updateRate) != 0 {
+			continue
+		}
+		now = now.Add(time.Second / updateRate)
+		self := state.UpdateFor(0, nil).Self
+		if started.IsZero() && strings.HasPrefix(self.State, "interrupt") {
+			assert.NotEqual(t, 0, self.StateDuration)
+			started, interrupt = now, self.State
+		}
+		if interrupts.due(self, now, random) {
+			answered = now
+		}
+		if tick > 2*tickRate {
+			t.Fatal("the bot never answered the interrupt")
+		}
+	}
+	assert.True(t, answered.Sub(started) >= 500*time.Millisecond, "answered after %v", answered.Sub(started))
+	assert.True(t, answered.Sub(started) <= 750*time.Millisecond+time.Second/updateRate)
+
+	// Once the interrupt is over, a new one with the same state gets a new delay.
+	assert.False(t, interrupts.due(PlayerStatus{State: "standing"}, now, random))
+	assert.False(t, interrupts.due(PlayerStatus{State: interrupt, StateDuration: -40}, now, random))
+	// So does one that's started since the last update, without the bot seeing it end.
+	now = now.Add(time.Second)
+	assert.True(t, interrupts.due(PlayerStatus{State: interrupt, StateDuration: -1040}, now, random))
+	assert.False(t, interrupts.due(PlayerStatus{State: interrupt, StateDuration: -30}, now, random))
+}
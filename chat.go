@@ -0,0 +1,199 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file moderates the lobby chat. Each user can only chat so fast, and anyone who floods it anyway is muted
+// for a while, for longer each time. Messages can only be so long, words in the word filter are starred out, and
+// users can ignore each other, which stops the server sending them the ignored user's messages at all.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// The longest a chat message can be, in characters.
+const CHAT_MAX_LENGTH = 300
+
+// Users can send CHAT_BURST messages in a row, and after that one every CHAT_INTERVAL.
+const (
+	CHAT_BURST    = 5
+	CHAT_INTERVAL = time.Second
+)
+
+// How long a user is muted for flooding the first time. Each time after that it's twice as long, up to
+// FLOOD_MUTE_MAX. Once a user has gone FLOOD_FORGIVE_TIME without flooding, it starts over.
+const (
+	FLOOD_MUTE_FIRST   = 30 * time.Second
+	FLOOD_MUTE_MAX     = time.Hour
+	FLOOD_FORGIVE_TIME = time.Hour
+)
+
+// The most users one user can ignore.
+const MAX_IGNORED = 100
+
+// ChatFilter is the word filter chat goes through, or nil if there isn't one. It's set from the config when the
+// server starts.
+var ChatFilter *WordFilter
+
+// chatLimiter keeps track of how fast a user is chatting and how often they've flooded.
+type chatLimiter struct {
+	// How many messages the user can send right now, as of last.
+	allowance float64
+	last      time.Time
+	// How many times the user has been muted for flooding, and when the last time was.
+	floods    int
+	lastFlood time.Time
+}
+
+// allow says whether a message sent at the given time is within the limit, and counts it if it is. If it isn't,
+// it returns how long the user should be muted for.
+func (l *chatLimiter) allow(now time.Time) (bool, time.Duration) {
+	if l.last.IsZero() {
+		l.allowance = CHAT_BURST
+	} else {
+		l.allowance += float64(now.Sub(l.last)) / float64(CHAT_INTERVAL)
+		if l.allowance > CHAT_BURST {
+			l.allowance = CHAT_BURST
+		}
+	}
+	l.last = now
+	if l.allowance >= 1 {
+		l.allowance--
+		return true, 0
+	}
+	if now.Sub(l.lastFlood) > FLOOD_FORGIVE_TIME {
+		l.floods = 0
+	}
+	mute := FLOOD_MUTE_FIRST << l.floods
+	if mute > FLOOD_MUTE_MAX || mute <= 0 {
+		mute = FLOOD_MUTE_MAX
+	}
+	l.floods++
+	l.lastFlood = now
+	// They get a clean slate once the mute is over.
+	l.allowance = CHAT_BURST
+	l.last = now.Add(mute)
+	return false, mute
+}
+
+// WordFilter stars out words that aren't allowed in chat.
+type WordFilter struct {
+	pattern *regexp.Regexp
+}
+
+// LoadWordFilter reads a word filter file, which has a word or phrase to filter on each line. Blank lines and
+// lines starting with # are skipped. Case doesn't matter, and only whole words are filtered, so filtering "ass"
+// doesn't touch "class".
+func LoadWordFilter(path string) (*WordFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "when opening word filter")
+	}
+	defer file.Close()
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, regexp.QuoteMeta(line))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "when reading word filter")
+	}
+	return NewWordFilter(words...), nil
+}
+
+// NewWordFilter makes a word filter for the given words, which are regular expressions.
+func NewWordFilter(words ...string) *WordFilter {
+	if len(words) == 0 {
+		return &WordFilter{}
+	}
+	return &WordFilter{pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)}
+}
+
+// Filter returns the text with every filtered word starred out, and whether there were any.
+func (f *WordFilter) Filter(text string) (string, bool) {
+	if f == nil || f.pattern == nil {
+		return text, false
+	}
+	filtered := false
+	text = f.pattern.ReplaceAllStringFunc(text, func(word string) string {
+		filtered = true
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+	return text, filtered
+}
+
+// handleChat checks a chat message from a user and sends it to everyone who isn't ignoring them.
+func handleChat(clients map[*ConnInfo]*User, msg MessageInfo) {
+	user := msg.User
+	conn := connOf(clients, user)
+	now := time.Now()
+	if now.Before(user.MutedUntil) {
+		conn.Send(ErrorPayload{Code: ERR_MUTED,
+			Message: "you're muted until " + user.MutedUntil.UTC().Format(time.RFC1123)})
+		return
+	}
+	text := strings.TrimSpace(msg.Message.Content)
+	if text == "" {
+		return
+	}
+	if utf8.RuneCountInString(text) > CHAT_MAX_LENGTH {
+		user.Log.Info("chat message too long", "length", utf8.RuneCountInString(text))
+		conn.Send(ErrorPayload{Code: ERR_BAD_MESSAGE, Message: "chat messages can't be longer than " +
+			strconv.Itoa(CHAT_MAX_LENGTH) + " characters"})
+		return
+	}
+	if ok, mute := user.chat.allow(now); !ok {
+		user.MutedUntil = now.Add(mute)
+		user.Log.Warn("muted for flooding chat", "duration", mute, "times", user.chat.floods)
+		conn.Send(ErrorPayload{Code: ERR_MUTED, Message: "you're sending messages too fast, so you've been muted for " +
+			mute.String()})
+		return
+	}
+	text, filtered := ChatFilter.Filter(text)
+	if filtered {
+		user.Log.Info("filtered chat message")
+	}
+	// Whatever name the client put on the message, it's from the user who sent it.
+	chat := Message{Username: user.Name, Content: text}
+	for other, otherUser := range clients {
+		if !otherUser.Ignoring[strings.ToLower(user.Name)] {
+			other.Send(chat)
+		}
+	}
+}
+
+// ignore handles IGNORE and UNIGNORE, which add a name to the user's ignore list or take it off.
+func ignore(conn *ConnInfo, user *User, name string, ignoring bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return
+	}
+	if !ignoring {
+		delete(user.Ignoring, name)
+		user.Log.Info("unignored user", "name", name)
+		return
+	}
+	if len(user.Ignoring) >= MAX_IGNORED {
+		conn.Send(ErrorPayload{Code: ERR_BAD_MESSAGE, Message: "you can't ignore more than " +
+			strconv.Itoa(MAX_IGNORED) + " people"})
+		return
+	}
+	if user.Ignoring == nil {
+		user.Ignoring = make(map[string]bool)
+	}
+	user.Ignoring[name] = true
+	user.Log.Info("ignored user", "name", name)
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatLimiter(t *testing.T) {
+	var limiter chatLimiter
+	now := time.Now()
+	for i := 0; i < CHAT_BURST; i++ {
+		ok, _ := limiter.allow(now)
+		assert.True(t, ok)
+	}
+	ok, mute := limiter.allow(now)
+	assert.False(t, ok)
+	assert.Equal(t, FLOOD_MUTE_FIRST, mute)
+	// After the mute, they can chat again, but flooding again gets a longer mute.
+	now = now.Add(mute)
+	for i := 0; i < CHAT_BURST; i++ {
+		ok, _ = limiter.allow(now)
+		assert.True(t, ok)
+	}
+	_, mute = limiter.allow(now)
+	assert.Equal(t, 2*FLOOD_MUTE_FIRST, mute)
+	// Chatting at a reasonable pace is fine forever.
+	now = now.Add(mute)
+	for i := 0; i < 3*CHAT_BURST; i++ {
+		now = now.Add(CHAT_INTERVAL)
+		ok, _ = limiter.allow(now)
+		assert.True(t, ok)
+	}
+	// Mutes never get longer than the maximum, and they're forgiven after a while.
+	for i := 0; i < 10; i++ {
+		for ok = true; ok; ok, mute = limiter.allow(now) {
+		}
+		now = now.Add(mute)
+	}
+	assert.Equal(t, FLOOD_MUTE_MAX, mute)
+	now = now.Add(FLOOD_FORGIVE_TIME + time.Second)
+	for ok = true; ok; ok, mute = limiter.allow(now) {
+	}
+	assert.Equal(t, FLOOD_MUTE_FIRST, mute)
+}
+
+func TestWordFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("# Words to star out\n\ndarn\n  heck  \nbad word\n"), 0644))
+	filter, err := LoadWordFilter(path)
+	assert.Nil(t, err)
+	text, filtered := filter.Filter("Darn it, what the HECK is this bad word doing here?")
+	assert.True(t, filtered)
+	assert.Equal(t, "**** it, what the **** is this ******** doing here?", text)
+	// Only whole words are filtered.
+	text, filtered = filter.Filter("darned heckler")
+	assert.False(t, filtered)
+	assert.Equal(t, "darned heckler", text)
+	// Without a filter, nothing is.
+	text, filtered = (*WordFilter)(nil).Filter("darn")
+	assert.False(t, filtered)
+	assert.Equal(t, "darn", text)
+	_, err = LoadWordFilter(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.NotNil(t, err)
+}
+
+func TestLobbyChat(t *testing.T) {
+	defer func(filter *WordFilter) { ChatFilter = filter }(ChatFilter)
+	ChatFilter = NewWordFilter("darn")
+	ctx, cancel := context.WithCancel(context.Background())
+	newClients := make(chan ConnInfo)
+	stopped := make(chan struct{})
+	go func() {
+		dispatcher(ctx, newClients, nil, nil)
+		close(stopped)
+	}()
+
+	alice, aliceLobby := fakeConn(newClients, "10.0.0.1")
+	defer close(alice.Done)
+	alice.Inbound <- Message{Username: "alice", Command: "SETNAME"}
+	bob, bobLobby := fakeConn(newClients, "10.0.0.2")
+	defer close(bob.Done)
+	bob.Inbound <- Message{Username: "bob", Command: "SETNAME"}
+
+	// Chat is filtered, and says who really sent it.
+	bob.Inbound <- Message{Username: "alice", Content: "darn"}
+	for _, lobby := range []<-chan interface{}{aliceLobby, bobLobby} {
+		assert.Equal(t, Message{Username: "bob", Content: "****"}, expect(t, lobby))
+	}
+	bob.Inbound <- Message{Content: strings.Repeat("a", CHAT_MAX_LENGTH+1)}
+	assert.Equal(t, ERR_BAD_MESSAGE, expect(t, bobLobby).(ErrorPayload).Code)
+
+	// Ignored users' messages aren't sent, whatever case their name was ignored in. Alice's own messages coming
+	// back show that the server has gotten to everything she sent before them.
+	alice.Inbound <- Message{Command: "IGNORE", Content: "Bob"}
+	alice.Inbound <- Message{Content: "anyone there?"}
+	assert.Equal(t, "anyone there?", expect(t, aliceLobby).(Message).Content)
+	assert.Equal(t, "anyone there?", expect(t, bobLobby).(Message).Content)
+	bob.Inbound <- Message{Content: "hi"}
+	assert.Equal(t, "hi", expect(t, bobLobby).(Message).Content)
+	alice.Inbound <- Message{Command: "UNIGNORE", Content: "bob"}
+	alice.Inbound <- Message{Content: "hello?"}
+	assert.Equal(t, "hello?", expect(t, aliceLobby).(Message).Content)
+	assert.Equal(t, "hello?", expect(t, bobLobby).(Message).Content)
+
+	// Flooding gets a user muted.
+	for i := 2; i < CHAT_BURST; i++ {
+		bob.Inbound <- Message{Content: "spam"}
+		assert.Equal(t, "spam", expect(t, aliceLobby).(Message).Content)
+		assert.Equal(t, "spam", expect(t, bobLobby).(Message).Content)
+	}
+	bob.Inbound <- Message{Content: "spam"}
+	assert.Equal(t, ERR_MUTED, expect(t, bobLobby).(ErrorPayload).Code)
+	bob.Inbound <- Message{Content: "spam"}
+	assert.Equal(t, ERR_MUTED, expect(t, bobLobby).(ErrorPayload).Code)
+	alice.Inbound <- Message{Content: "quiet now"}
+	assert.Equal(t, "quiet now", expect(t, aliceLobby).(Message).Content)
+	assert.Equal(t, "quiet now", expect(t, bobLobby).(Message).Content)
+	cancel()
+	<-stopped
+}
@@ -0,0 +1,336 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file handles the server's configuration. Every setting can come from a JSON config file, an environment
+// variable or a command-line flag, and each of those overrides the one before it. The flag names are the JSON
+// field names in lower case, and the environment variables are the flag names in upper case with COUNTERPLAY_ in
+// front, like COUNTERPLAY_LISTEN.
+
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Config is everything about the server that can be configured.
+type Config struct {
+	// The address to listen on, like ":8000" or "localhost:8080".
+	Listen string `json:"listen"`
+	// The directory the client is served from. Nothing outside it is served.
+	StaticDir string `json:"staticDir"`
+	// The certificate and key to serve HTTPS with. If they're left out, the server speaks plain HTTP, unless
+	// SelfSigned is set, in which case it makes up a certificate for localhost (see tls.go).
+	TLSCert    string `json:"tlsCert"`
+	TLSKey     string `json:"tlsKey"`
+	SelfSigned bool   `json:"selfSigned"`
+	// The origins websocket connections are allowed to come from besides the server's own, like
+	// "https://example.com".
+	Origins []string `json:"origins"`
+	// Where the server keeps what it saves, like the results log. If it's left out, nothing is saved.
+	DataDir string `json:"dataDir"`
+	// The least important log messages that are written: DEBUG, INFO, WARN or ERROR.
+	LogLevel slog.Level `json:"logLevel"`
+	// How log lines are written: LOG_FORMAT_TEXT or LOG_FORMAT_JSON (see logging.go).
+	LogFormat string `json:"logFormat"`
+	// The mode players queue for if they don't say.
+	DefaultMode string `json:"defaultMode"`
+	// How many ticks per second battles are simulated at, and how many updates per second players are sent. The
+	// update rate can't be more than the tick rate, and 0 means it's the same.
+	TickRate   int `json:"tickRate"`
+	UpdateRate int `json:"updateRate"`
+	// The furthest back in time an input can be moved to make up for the player's lag (see latency.go). 0 turns
+	// lag compensation off.
+	LagCompensationLimit Duration `json:"lagCompensationLimit"`
+	// How long battles are given to finish when the server is shutting down.
+	DrainTimeout Duration `json:"drainTimeout"`
+	// The balance file, which changes the archetypes' stats (see balance.go). It's read when the server starts,
+	// and again whenever an admin asks.
+	BalanceFile string `json:"balanceFile"`
+	// The word filter file, which lists words to star out of chat (see chat.go).
+	WordFilter string `json:"wordFilter"`
+	// The address to serve the admin API on, which has to be on localhost, and the token admins need to use it
+	// (see admin.go). If the address is left out, there's no admin API.
+	AdminListen string `json:"adminListen"`
+	AdminToken  string `json:"adminToken"`
+	// The address to serve the metrics on, and the token needed to see them (see metrics.go). If the address is
+	// left out, the metrics aren't served, and if the token is, anyone who can reach the address can see them.
+	MetricsListen string `json:"metricsListen"`
+	MetricsToken  string `json:"metricsToken"`
+	// The token workers need to connect to the lobby. A lobby with one takes workers at /workers (see workers.go).
+	WorkerToken string `json:"workerToken"`
+	// The lobby's /workers URL, which makes this server a worker for it instead of a lobby, and the websocket URL
+	// players can reach this worker at (see worker.go).
+	Lobby     string `json:"lobby"`
+	PublicURL string `json:"publicURL"`
+}
+
+// The prefix of the environment variables settings can be taken from.
+const CONFIG_ENV_PREFIX = "COUNTERPLAY_"
+
+// DefaultConfig returns the configuration the server runs with if nothing else is set.
+func DefaultConfig() Config {
+	return Config{
+		Listen:               ":8000",
+		StaticDir:            "static",
+		LogLevel:             slog.LevelInfo,
+		LogFormat:            LOG_FORMAT_TEXT,
+		DefaultMode:          DEFAULT_MODE,
+		TickRate:             DEFAULT_TICK_RATE,
+		DrainTimeout:         Duration(2 * time.Minute),
+		LagCompensationLimit: Duration(DEFAULT_LAG_COMPENSATION_LIMIT),
+	}
+}
+
+// LoadConfig works out the configuration from the command-line arguments (not including the program name) and
+// the environment, which is read with getenv. The config file is named by the -config flag or the
+// COUNTERPLAY_CONFIG environment variable.
+func LoadConfig(args []string, getenv func(string) string) (Config, error) {
+	// The flags are parsed once to find the config file, and again once the file and the environment have been
+	// read, so they can override them. The first time is also when -help is handled, so it shows the defaults.
+	config := DefaultConfig()
+	var path string
+	if err := config.flagSet(&path).Parse(args); err != nil {
+		return config, err
+	}
+	if path == "" {
+		path = getenv(CONFIG_ENV_PREFIX + "CONFIG")
+	}
+	config = DefaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return config, errors.Wrap(err, "when reading config file")
+		}
+		// A misspelled setting would otherwise be silently ignored.
+		if err := strictUnmarshal(data, &config); err != nil {
+			return config, errors.Wrap(err, "when decoding config file")
+		}
+	}
+	flags := config.flagSet(&path)
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		env := CONFIG_ENV_PREFIX + strings.ToUpper(f.Name)
+		if value := getenv(env); value != "" && err == nil {
+			err = errors.Wrap(f.Value.Set(value), "bad value for "+env)
+		}
+	})
+	if err != nil {
+		return config, err
+	}
+	if err := flags.Parse(args); err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+// flagSet returns the flags for every setting, which set them on the config. The defaults they show are whatever
+// the config has already. The -config flag sets path.
+func (c *Config) flagSet(path *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("counterplay-infinity", flag.ContinueOnError)
+	flags.StringVar(path, "config", "", "a JSON file to read settings from")
+	flags.StringVar(&c.Listen, "listen", c.Listen, "the address to listen on")
+	flags.StringVar(&c.StaticDir, "staticdir", c.StaticDir, "the directory the client is served from")
+	flags.StringVar(&c.TLSCert, "tlscert", c.TLSCert, "the certificate file to serve HTTPS with")
+	flags.StringVar(&c.TLSKey, "tlskey", c.TLSKey, "the key file to serve HTTPS with")
+	flags.BoolVar(&c.SelfSigned, "selfsigned", c.SelfSigned, "serve HTTPS with a self-signed certificate, for development")
+	flags.Var((*listValue)(&c.Origins), "origins", "comma-separated origins besides this server's own that "+
+		"websocket connections can come from")
+	flags.StringVar(&c.DataDir, "datadir", c.DataDir, "the directory to save the results log and such in")
+	flags.TextVar(&c.LogLevel, "loglevel", c.LogLevel, "the least important log messages to write")
+	flags.StringVar(&c.LogFormat, "logformat", c.LogFormat, "how to write log lines: text or json")
+	flags.StringVar(&c.DefaultMode, "defaultmode", c.DefaultMode, "the mode players queue for if they don't say")
+	flags.IntVar(&c.TickRate, "tickrate", c.TickRate, "how many ticks per second battles are simulated at")
+	flags.IntVar(&c.UpdateRate, "updaterate", c.UpdateRate, "how many updates per second players are sent in battle; 0 means one every tick")
+	flags.Var(&c.LagCompensationLimit, "lagcompensationlimit", "the furthest back in time an input can be moved "+
+		"to make up for lag; 0 turns lag compensation off")
+	flags.Var(&c.DrainTimeout, "draintimeout", "how long battles get to finish when the server is shutting down")
+	flags.StringVar(&c.BalanceFile, "balancefile", c.BalanceFile, "a JSON file to change the archetypes' stats with")
+	flags.StringVar(&c.WordFilter, "wordfilter", c.WordFilter, "a file of words to star out of chat, one on each line")
+	flags.StringVar(&c.AdminListen, "adminlisten", c.AdminListen, "the localhost address to serve the admin API on")
+	flags.StringVar(&c.AdminToken, "admintoken", c.AdminToken, "the token admins need to use the admin API; "+
+		"it's safer in the environment, where other users can't see it")
+	flags.StringVar(&c.MetricsListen, "metricslisten", c.MetricsListen, "the address to serve the metrics on")
+	flags.StringVar(&c.MetricsToken, "metricstoken", c.MetricsToken, "the token needed to see the metrics, if any; "+
+		"it's safer in the environment, where other users can't see it")
+	flags.StringVar(&c.WorkerToken, "workertoken", c.WorkerToken, "the token workers need to connect to the lobby; "+
+		"it's safer in the environment, where other users can't see it")
+	flags.StringVar(&c.Lobby, "lobby", c.Lobby, "the /workers URL of a lobby to run battles for, "+
+		"which makes this server a worker")
+	flags.StringVar(&c.PublicURL, "publicurl", c.PublicURL, "the websocket URL players can reach this worker at")
+	return flags
+}
+
+// Validate returns an error if any of the settings don't make sense.
+func (c Config) Validate() error {
+	if c.Listen == "" {
+		return errors.New("the listen address can't be empty")
+	}
+	if info, err := os.Stat(c.StaticDir); err != nil || !info.IsDir() {
+		return errors.Errorf("the static directory %q doesn't exist", c.StaticDir)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("the TLS certificate and key have to be given together")
+	}
+	if c.SelfSigned && c.TLSCert != "" {
+		return errors.New("a self-signed certificate can't be used along with a real one")
+	}
+	for _, origin := range c.Origins {
+		if err := validOrigin(origin); err != nil {
+			return err
+		}
+	}
+	if c.LogFormat != LOG_FORMAT_TEXT && c.LogFormat != LOG_FORMAT_JSON {
+		return errors.Errorf("the log format must be %s or %s", LOG_FORMAT_TEXT, LOG_FORMAT_JSON)
+	}
+	if c.DefaultMode == "" || getModeByName(c.DefaultMode) == nil {
+		return errors.Errorf("there's no mode called %q", c.DefaultMode)
+	}
+	// Lengths of time in battles are in whole milliseconds, so a tick can't be any shorter.
+	if c.TickRate < 1 || c.TickRate > 1000 {
+		return errors.New("the tick rate must be between 1 and 1000")
+	}
+	// Updates are sent between ticks, so more of them than ticks would only repeat themselves.
+	if c.UpdateRate < 0 || c.UpdateRate > c.TickRate {
+		return errors.New("the update rate can't be negative or more than the tick rate")
+	}
+	if c.LagCompensationLimit < 0 || time.Duration(c.LagCompensationLimit) > MAX_LAG_COMPENSATION_LIMIT {
+		return errors.Errorf("the lag compensation limit must be between 0 and %s", MAX_LAG_COMPENSATION_LIMIT)
+	}
+	if c.DrainTimeout < 0 {
+		return errors.New("the drain timeout can't be negative")
+	}
+	if c.AdminListen != "" {
+		if err := validAdminAddr(c.AdminListen); err != nil {
+			return err
+		}
+		if len(c.AdminToken) < ADMIN_TOKEN_MIN_LENGTH {
+			return errors.Errorf("the admin token has to be at least %d characters", ADMIN_TOKEN_MIN_LENGTH)
+		}
+	}
+	if c.MetricsToken != "" {
+		if c.MetricsListen == "" {
+			return errors.New("there's no metrics address for the metrics token to be used on")
+		}
+		if len(c.MetricsToken) < METRICS_TOKEN_MIN_LENGTH {
+			return errors.Errorf("the metrics token has to be at least %d characters", METRICS_TOKEN_MIN_LENGTH)
+		}
+	}
+	if c.WorkerToken != "" && len(c.WorkerToken) < WORKER_TOKEN_MIN_LENGTH {
+		return errors.Errorf("the worker token has to be at least %d characters", WORKER_TOKEN_MIN_LENGTH)
+	}
+	if c.Lobby == "" {
+		if c.PublicURL != "" {
+			return errors.New("only workers have a public URL")
+		}
+		return nil
+	}
+	if err := validWebsocketURL(c.Lobby); err != nil {
+		return errors.Wrap(err, "bad lobby URL")
+	}
+	if err := validWebsocketURL(c.PublicURL); err != nil {
+		return errors.Wrap(err, "bad public URL")
+	}
+	if c.WorkerToken == "" {
+		return errors.New("workers need the worker token")
+	}
+	if c.AdminListen != "" {
+		return errors.New("workers don't have an admin API; the lobby's covers their battles")
+	}
+	return nil
+}
+
+// validWebsocketURL returns an error if the URL isn't a ws:// or wss:// URL.
+func validWebsocketURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return errors.Errorf("%q isn't a ws:// or wss:// URL", raw)
+	}
+	return nil
+}
+
+// LogValue lets the configuration be logged as a group of its settings.
+func (c Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("listen", c.Listen),
+		slog.String("staticDir", c.StaticDir),
+		slog.String("tlsCert", c.TLSCert),
+		slog.String("tlsKey", c.TLSKey),
+		slog.Bool("selfSigned", c.SelfSigned),
+		slog.Any("origins", c.Origins),
+		slog.String("dataDir", c.DataDir),
+		slog.String("logLevel", c.LogLevel.String()),
+		slog.String("logFormat", c.LogFormat),
+		slog.String("defaultMode", c.DefaultMode),
+		slog.Int("tickRate", c.TickRate),
+		slog.Int("updateRate", c.UpdateRate),
+		slog.String("lagCompensationLimit", c.LagCompensationLimit.String()),
+		slog.String("drainTimeout", c.DrainTimeout.String()),
+		slog.String("balanceFile", c.BalanceFile),
+		slog.String("wordFilter", c.WordFilter),
+		slog.String("adminListen", c.AdminListen),
+		// The tokens are secrets, so they're left out of the logs.
+		slog.Bool("adminToken", c.AdminToken != ""),
+		slog.String("metricsListen", c.MetricsListen),
+		slog.Bool("metricsToken", c.MetricsToken != ""),
+		slog.Bool("workerToken", c.WorkerToken != ""),
+		slog.String("lobby", c.Lobby),
+		slog.String("publicURL", c.PublicURL),
+	)
+}
+
+// Duration is a time.Duration that's written like "2m30s" in the config file and environment.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+// listValue is a list of strings that's written with commas between them on the command line and in the
+// environment.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testEnv returns a getenv that looks things up in the given map.
+func testEnv(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+// testConfigFile writes a config file with the given contents and returns its path.
+func testConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDefaultConfig(t *testing.T) {
+	config, err := LoadConfig(nil, testEnv(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultConfig(), config)
+	assert.Nil(t, DefaultConfig().Validate())
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := testConfigFile(t, `{"listen": ":9000", "dataDir": "/var/lib/cp", "tickRate": 60, "logLevel": "DEBUG",
+		"drainTimeout": "30s", "origins": ["https://a.example"], "lagCompensationLimit": "100ms"}`)
+	// The environment overrides the file, and the flags override the environment.
+	env := map[string]string{
+		"COUNTERPLAY_CONFIG":   path,
+		"COUNTERPLAY_TICKRATE": "50",
+		"COUNTERPLAY_LISTEN":   ":9100",
+		"COUNTERPLAY_ORIGINS":  "https://b.example, https://c.example",
+	}
+	config, err := LoadConfig([]string{"-listen", "localhost:9200", "-defaultmode", "ffa"}, testEnv(env))
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost:9200", config.Listen)
+	assert.Equal(t, 50, config.TickRate)
+	assert.Equal(t, "/var/lib/cp", config.DataDir)
+	assert.Equal(t, slog.LevelDebug, config.LogLevel)
+	assert.Equal(t, Duration(30*time.Second), config.DrainTimeout)
+	assert.Equal(t, Duration(100*time.Millisecond), config.LagCompensationLimit)
+	assert.Equal(t, []string{"https://b.example", "https://c.example"}, config.Origins)
+	assert.Equal(t, "ffa", config.DefaultMode)
+	// Whatever isn't set anywhere keeps its default.
+	assert.Equal(t, DefaultConfig().StaticDir, config.StaticDir)
+
+	// The -config flag beats the environment too.
+	other := testConfigFile(t, `{"updateRate": 20}`)
+	config, err = LoadConfig([]string{"-config", other}, testEnv(env))
+	assert.Nil(t, err)
+	assert.Equal(t, 20, config.UpdateRate)
+	assert.Equal(t, "", config.DataDir)
+}
+
+func TestBadConfig(t *testing.T) {
+	for _, args := range [][]string{
+		{"-tickrate", "0"}, {"-tickrate", "2000"}, {"-updaterate", "-1"}, {"-updaterate", "2000000000"},
+		{"-tickrate", "50", "-updaterate", "60"}, {"-defaultmode", "chess"},
+		{"-staticdir", "no such directory"}, {"-tlscert", "cert.pem"}, {"-listen", ""}, {"-draintimeout", "soon"},
+		{"-lagcompensationlimit", "-1ms"}, {"-lagcompensationlimit", "1m"}, {"-loglevel", "LOUD"}, {"-config", "no such file"}, {"-nosuchflag"},
+		// Workers need a lobby to work for, somewhere players can reach them, and a long enough token.
+		{"-workertoken", "short"}, {"-publicurl", "ws://localhost:8101/ws"},
+		{"-lobby", "ws://localhost:8000/workers", "-publicurl", "ws://localhost:8101/ws"},
+		{"-lobby", "http://localhost:8000/workers", "-publicurl", "ws://localhost:8101/ws",
+			"-workertoken", "0123456789abcdef"},
+		{"-lobby", "ws://localhost:8000/workers", "-workertoken", "0123456789abcdef"},
+		// A metrics token has to be long enough, and needs somewhere to be used.
+		{"-metricstoken", "0123456789abcdef"}, {"-metricslisten", ":9100", "-metricstoken", "short"},
+	} {
+		_, err := LoadConfig(args, testEnv(nil))
+		assert.NotNil(t, err, "%v", args)
+	}
+	_, err := LoadConfig(nil, testEnv(map[string]string{"COUNTERPLAY_TICKRATE": "fast"}))
+	assert.NotNil(t, err)
+	_, err = LoadConfig([]string{"-lobby", "ws://localhost:8000/workers", "-publicurl", "ws://localhost:8101/ws"},
+		testEnv(map[string]string{"COUNTERPLAY_WORKERTOKEN": "0123456789abcdef"}))
+	assert.Nil(t, err)
+	// Workers can serve metrics, even though they can't have an admin API.
+	_, err = LoadConfig([]string{"-lobby", "ws://localhost:8000/workers", "-publicurl", "ws://localhost:8101/ws",
+		"-metricslisten", ":9101", "-metricstoken", "0123456789abcdef"},
+		testEnv(map[string]string{"COUNTERPLAY_WORKERTOKEN": "0123456789abcdef"}))
+	assert.Nil(t, err)
+	// Misspelled settings in the file aren't ignored.
+	_, err = LoadConfig([]string{"-config", testConfigFile(t, `{"tickRates": 60}`)}, testEnv(nil))
+	assert.NotNil(t, err)
+}
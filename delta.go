@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file handles delta compression of battle updates. Instead of sending the whole Update every time,
+// the server sends a keyframe (a full Update) and then only the fields that changed since the last thing
+// it sent. A fresh keyframe goes out every KEYFRAME_INTERVAL updates so a client that somehow got out of sync
+// recovers quickly.
+
+package main
+
+// The first protocol version whose clients understand deltas. Older clients keep getting full Updates.
+const DELTA_PROTOCOL_VERSION = 2
+
+// The first protocol version whose clients understand deltas with only the combatants that changed. Older clients
+// get the whole list whenever any of them did.
+const COMBATANT_DELTA_PROTOCOL_VERSION = 15
+
+// How many updates can go by between keyframes.
+const KEYFRAME_INTERVAL = 100
+
+// UpdateDelta holds only the parts of an Update that changed. A nil field means that player's status didn't
+// change at all. The tick is always there, but it changing doesn't count as a change by itself, otherwise there
+// would never be an update that didn't need sending; clients count the ticks in between on their own.
+type UpdateDelta struct {
+	Tick  int                `json:"tick"`
+	Self  *PlayerStatusDelta `json:"self,omitempty"`
+	Enemy *PlayerStatusDelta `json:"enemy,omitempty"`
+	// Acks aren't state, so they're passed along whenever there are any.
+	Acks []InputAck `json:"acks,omitempty"`
+	// The combatants that changed, by their place in the list. They aren't broken down any further; a combatant
+	// that changed at all is sent whole. all is the whole list, for clients that need it (see
+	// wholeCombatantsDelta).
+	Combatants map[int]Combatant `json:"combatants,omitempty"`
+	all        []Combatant
+}
+
+// wholeCombatantsDelta is how an UpdateDelta is sent to clients from before COMBATANT_DELTA_PROTOCOL_VERSION,
+// which expect the whole list of combatants whenever any of them changed.
+type wholeCombatantsDelta struct {
+	UpdateDelta
+	Combatants []Combatant `json:"combatants,omitempty"`
+}
+
+// PlayerStatusDelta mirrors PlayerStatus, but every field is a pointer that's only set if that field changed.
+// Any new field on PlayerStatus needs a matching one here and a line in diffStatus.
+type PlayerStatusDelta struct {
+	Life          *int     `json:"life,omitempty"`
+	Stamina       *float32 `json:"stamina,omitempty"`
+	State         *string  `json:"state,omitempty"`
+	StateDuration *int     `json:"stateDur,omitempty"`
+	Ping          *int     `json:"ping,omitempty"`
+	Exhausted     *bool    `json:"exhausted,omitempty"`
+	RegenDelay    *int     `json:"regenDelay,omitempty"`
+	Combo         *int     `json:"combo,omitempty"`
+	// Effects are sent all together if any of them changed.
+	Effects *EffectStatus `json:"effects,omitempty"`
+}
+
+// deltaEncoder remembers what was last sent on a connection so it can work out the next delta.
+type deltaEncoder struct {
+	last Update
+	// How many updates have gone by since the last keyframe. -1 means the next update has to be a keyframe.
+	sinceKeyframe int
+}
+
+func newDeltaEncoder() *deltaEncoder {
+	return &deltaEncoder{sinceKeyframe: -1}
+}
+
+// Next returns what to send for the given update: the Update itself if it's time for a keyframe, or an
+// UpdateDelta otherwise. ok is false if nothing changed, in which case nothing needs to be sent at all.
+func (e *deltaEncoder) Next(update Update) (msg interface{}, ok bool) {
+	// Combatants can only be changed by a delta, not added or taken away, so a list of a different length
+	// needs a keyframe.
+	if e.sinceKeyframe < 0 || e.sinceKeyframe >= KEYFRAME_INTERVAL || len(update.Combatants) != len(e.last.Combatants) {
+		e.last = update
+		e.sinceKeyframe = 0
+		return update, true
+	}
+	e.sinceKeyframe++
+	combatants := diffCombatants(e.last.Combatants, update.Combatants)
+	if update.Self == e.last.Self && update.Enemy == e.last.Enemy && combatants == nil && len(update.Acks) == 0 {
+		return nil, false
+	}
+	delta := UpdateDelta{Tick: update.Tick, Self: diffStatus(e.last.Self, update.Self),
+		Enemy: diffStatus(e.last.Enemy, update.Enemy), Acks: update.Acks, Combatants: combatants}
+	if combatants != nil {
+		delta.all = update.Combatants
+	}
+	e.last = update
+	return delta, true
+}
+
+// diffCombatants returns the combatants in new that differ from the ones in the same place in old, which has to be
+// as long, or nil if none do.
+func diffCombatants(old, new []Combatant) map[int]Combatant {
+	var changed map[int]Combatant
+	for i := range new {
+		if new[i] != old[i] {
+			if changed == nil {
+				changed = make(map[int]Combatant)
+			}
+			changed[i] = new[i]
+		}
+	}
+	return changed
+}
+
+// Reset makes the next update a keyframe. It should be called between battles.
+func (e *deltaEncoder) Reset() {
+	e.sinceKeyframe = -1
+}
+
+// diffStatus returns a PlayerStatusDelta with the fields of new that differ from old, or nil if none do.
+func diffStatus(old, new PlayerStatus) *PlayerStatusDelta {
+	if old == new {
+		return nil
+	}
+	var delta PlayerStatusDelta
+	if new.Life != old.Life {
+		delta.Life = &new.Life
+	}
+	if new.Stamina != old.Stamina {
+		delta.Stamina = &new.Stamina
+	}
+	if new.State != old.State {
+		delta.State = &new.State
+	}
+	if new.StateDuration != old.StateDuration {
+		delta.StateDuration = &new.StateDuration
+	}
+	if new.Ping != old.Ping {
+		delta.Ping = &new.Ping
+	}
+	if new.Exhausted != old.Exhausted {
+		delta.Exhausted = &new.Exhausted
+	}
+	if new.RegenDelay != old.RegenDelay {
+		delta.RegenDelay = &new.RegenDelay
+	}
+	if new.Combo != old.Combo {
+		delta.Combo = &new.Combo
+	}
+	if new.Effects != old.Effects {
+		delta.Effects = &new.Effects
+	}
+	return &delta
+}
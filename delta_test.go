@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeltaEncoder(t *testing.T) {
+	e := newDeltaEncoder()
+	first := Update{Self: PlayerStatus{Life: 100, Stamina: 100, State: "standing"}, Enemy: PlayerStatus{Life: 100, Stamina: 100, State: "standing"}}
+
+	// The first update is always a keyframe.
+	msg, ok := e.Next(first)
+	assert.True(t, ok)
+	assert.Equal(t, first, msg)
+
+	// Nothing changed, so nothing is sent.
+	_, ok = e.Next(first)
+	assert.False(t, ok)
+
+	// Only the changed fields are sent.
+	second := first
+	second.Enemy.State = "light attack"
+	second.Enemy.StateDuration = LIGHT_ATK_TIME
+	second.Enemy.Stamina = 100 - LIGHT_ATK_COST
+	msg, ok = e.Next(second)
+	assert.True(t, ok)
+	data, err := json.Marshal(msg)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"tick":0,"enemy":{"state":"light attack","stateDur":500,"stamina":90}}`, string(data))
+
+	// A new tick alone isn't worth sending.
+	third := second
+	third.Tick++
+	_, ok = e.Next(third)
+	assert.False(t, ok)
+
+	// After KEYFRAME_INTERVAL updates another keyframe goes out even if nothing changed.
+	for i := 0; i < KEYFRAME_INTERVAL-3; i++ {
+		_, ok = e.Next(second)
+		assert.False(t, ok)
+	}
+	msg, ok = e.Next(second)
+	assert.True(t, ok)
+	assert.Equal(t, second, msg)
+
+	// Resetting forces a keyframe.
+	e.Reset()
+	msg, ok = e.Next(second)
+	assert.True(t, ok)
+	assert.Equal(t, second, msg)
+}
+
+func TestDeltaCombatants(t *testing.T) {
+	state := battleOf(NO_TEAM, NO_TEAM, NO_TEAM)
+	e := newDeltaEncoder()
+	_, ok := e.Next(state.UpdateFor(0, nil))
+	assert.True(t, ok)
+	_, ok = e.Next(state.UpdateFor(0, nil))
+	assert.False(t, ok)
+
+	// A change to someone who isn't the player or their enemy still has to be sent, but only that combatant goes.
+	state.Players[2].Life = 50
+	update := state.UpdateFor(0, nil)
+	msg, ok := e.Next(update)
+	assert.True(t, ok)
+	delta := msg.(UpdateDelta)
+	assert.Nil(t, delta.Self)
+	assert.Nil(t, delta.Enemy)
+	assert.Equal(t, map[int]Combatant{2: update.Combatants[2]}, delta.Combatants)
+	out, _, err := encodeOutbound(PROTOCOL_VERSION, delta)
+	assert.Nil(t, err)
+	data, err := json.Marshal(out)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"combatants":{"2":{"name":`)
+
+	// Clients from before that get the whole list.
+	out, _, err = encodeOutbound(COMBATANT_DELTA_PROTOCOL_VERSION-1, delta)
+	assert.Nil(t, err)
+	data, err = json.Marshal(out)
+	assert.Nil(t, err)
+	var decoded struct {
+		Payload struct {
+			Combatants []Combatant `json:"combatants"`
+		} `json:"payload"`
+	}
+	assert.Nil(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, update.Combatants, decoded.Payload.Combatants)
+
+	// A list that's grown can't be sent as a delta.
+	state.Players = append(state.Players, NewPlayer())
+	msg, _ = e.Next(state.UpdateFor(0, nil))
+	assert.IsType(t, Update{}, msg)
+}
+
+// Applying every delta on top of the last keyframe, the way the client does, has to give back the real state.
+func TestDeltaReconstruction(t *testing.T) {
+	e := newDeltaEncoder()
+	var state map[string]interface{}
+	for _, update := range simulateUpdates(2000) {
+		msg, ok := e.Next(update)
+		if !ok {
+			// The client counts ticks itself when nothing is sent.
+			if state != nil {
+				state["tick"] = float64(update.Tick)
+			}
+			continue
+		}
+		data, err := json.Marshal(msg)
+		assert.Nil(t, err)
+		if _, keyframe := msg.(Update); keyframe {
+			state = nil
+		}
+		var decoded map[string]interface{}
+		assert.Nil(t, json.Unmarshal(data, &decoded))
+		state = mergeJSON(state, decoded)
+
+		expected, err := json.Marshal(update)
+		assert.Nil(t, err)
+		actual, err := json.Marshal(state)
+		assert.Nil(t, err)
+		assert.JSONEq(t, string(expected), string(actual))
+	}
+}
+
+// mergeJSON does the same thing as applyDelta in app.js.
+func mergeJSON(target, delta map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		return delta
+	}
+	for key, value := range delta {
+		nested, isObject := value.(map[string]interface{})
+		existing, wasObject := target[key].(map[string]interface{})
+		if isObject && wasObject {
+			target[key] = mergeJSON(existing, nested)
+		} else {
+			target[key] = value
+		}
+	}
+	return target
+}
+
+// simulateUpdates plays a battle between two players mashing random buttons and returns the Updates player 1
+// would have been sent.
+func simulateUpdates(ticks int) []Update {
+	random := rand.New(rand.NewSource(1))
+	commands := []string{"NONE", "NONE", "NONE", "BLOCK", "LIGHT", "HEAVY", "DODGE", "SAVE", "FEINT", "GRAB", "PARRY", "SPECIAL",
+		"INTERRUPT_UP", "INTERRUPT_DOWN", "INTERRUPT_LEFT", "INTERRUPT_RIGHT"}
+	p1, p2 := NewPlayer(), NewPlayer()
+	// Give them plenty of life so the battle doesn't end early.
+	p1.Life, p2.Life = 10000, 10000
+	updates := make([]Update, 0, ticks)
+	for i := 0; i < ticks; i++ {
+		updates = append(updates, Update{Tick: i + 1, Self: p1.Status(), Enemy: p2.Status()})
+		p1.PassTime(1)
+		p2.PassTime(1)
+		if p1.Finished != "" {
+			p1, p2 = resolveState(p1, p2)
+		}
+		if p2.Finished != "" {
+			p2, p1 = resolveState(p2, p1)
+		}
+		// Each player presses something about two and a half times a second, which is frantic for a human.
+		if random.Intn(40) == 0 {
+			p1.Command = commands[random.Intn(len(commands))]
+		}
+		if random.Intn(40) == 0 {
+			p2.Command = commands[random.Intn(len(commands))]
+		}
+		p1, p2 = resolveCommand(p1, p2, random)
+		p2, p1 = resolveCommand(p2, p1, random)
+	}
+	return updates
+}
+
+// These two benchmarks compare the cost of sending a battle's worth of updates to one player with and without
+// delta compression. Both report the bytes that would go over the wire per update.
+func BenchmarkFullUpdates(b *testing.B) {
+	updates := simulateUpdates(1000)
+	b.ResetTimer()
+	var bytes int
+	for i := 0; i < b.N; i++ {
+		update := updates[i%len(updates)]
+		out, _, err := encodeOutbound(PROTOCOL_VERSION, update)
+		if err != nil {
+			b.Fatal(err)
+		}
+		data, err := json.Marshal(out)
+		if err != nil {
+			b.Fatal(err)
+		}
+		bytes += len(data)
+	}
+	b.ReportMetric(float64(bytes)/float64(b.N), "wire-bytes/op")
+}
+
+func BenchmarkDeltaUpdates(b *testing.B) {
+	updates := simulateUpdates(1000)
+	e := newDeltaEncoder()
+	b.ResetTimer()
+	var bytes int
+	for i := 0; i < b.N; i++ {
+		msg, ok := e.Next(updates[i%len(updates)])
+		if !ok {
+			continue
+		}
+		out, _, err := encodeOutbound(PROTOCOL_VERSION, msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		data, err := json.Marshal(out)
+		if err != nil {
+			b.Fatal(err)
+		}
+		bytes += len(data)
+	}
+	b.ReportMetric(float64(bytes)/float64(b.N), "wire-bytes/op")
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file has status effects, which stay on a player for a while after whatever caused them. Each kind of
+// effect has a rule saying how long it lasts, how many times it can stack and what it does as time passes.
+
+package main
+
+// Effect is one status effect on a player.
+type Effect struct {
+	Name string
+	// How many more milliseconds it lasts.
+	Duration int
+	// How many times it's been applied without running out.
+	Stacks int
+	// The damage multiplier from the handicap of whoever applied it last, for effects that do damage. 0 means
+	// there's no handicap.
+	DamageMult float32
+}
+
+type EffectRule struct {
+	Duration int
+	// Applying an effect that's already there adds a stack, up to MaxStacks, and starts its duration over.
+	MaxStacks int
+	// Tick is run every tick the effect is on a player, with how many milliseconds the tick is. It's nil for
+	// effects that only change how other things work.
+	Tick func(p *Player, e Effect, amount int)
+}
+
+// Effect parameters.
+const (
+	// Heavy attacks that hit make you bleed, which does BLEED_DMG per stack every BLEED_INTERVAL.
+	BLEED_TIME       int = 3000
+	BLEED_INTERVAL   int = 500
+	BLEED_DMG        int = 1
+	BLEED_MAX_STACKS int = 3
+	// Blocking a heavy attack staggers you, which makes the next thing you do take STAGGER_SLOWDOWN times as
+	// long.
+	STAGGER_TIME     int     = 1000
+	STAGGER_SLOWDOWN float32 = 1.3
+	// Being grabbed crushes your guard, which makes blocking cost GUARD_CRUSH_FACTOR times as much stamina.
+	GUARD_CRUSH_TIME   int     = 3000
+	GUARD_CRUSH_FACTOR float32 = 1.5
+)
+
+var EFFECT_RULES = map[string]EffectRule{
+	"bleed":       {Duration: BLEED_TIME, MaxStacks: BLEED_MAX_STACKS, Tick: bleed},
+	"stagger":     {Duration: STAGGER_TIME, MaxStacks: 1},
+	"guard crush": {Duration: GUARD_CRUSH_TIME, MaxStacks: 1},
+}
+
+func bleed(p *Player, e Effect, amount int) {
+	// It hurts each time the time left passes a multiple of BLEED_INTERVAL, which a long enough tick could do
+	// more than once. It doesn't hurt until the first interval has gone by.
+	from := e.Duration
+	if from >= BLEED_TIME {
+		from = BLEED_TIME - 1
+	}
+	to := e.Duration - amount
+	if to < 0 {
+		to = 0
+	}
+	if hits := from/BLEED_INTERVAL - to/BLEED_INTERVAL; hits > 0 {
+		p.Life -= scaleDamage(BLEED_DMG*e.Stacks*hits, e.DamageMult)
+	}
+}
+
+// EffectStatus is what goes in a PlayerStatus about a player's effects: how many stacks of each they have.
+// It's a struct rather than a map so PlayerStatus can still be compared with ==, which means every new effect
+// needs a field here and a line in Player.effectStatus.
+type EffectStatus struct {
+	Bleed      int `json:"bleed"`
+	Stagger    int `json:"stagger"`
+	GuardCrush int `json:"guardCrush"`
+}
+
+func (p *Player) effectStatus() EffectStatus {
+	return EffectStatus{Bleed: p.EffectStacks("bleed"), Stagger: p.EffectStacks("stagger"),
+		GuardCrush: p.EffectStacks("guard crush")}
+}
+
+// AddEffect applies an effect to the player, following its rule for stacking.
+//
+// The Effects slice is never changed in place, only replaced, because Step only makes shallow copies of the
+// players and the old state has to stay as it was.
+func (p *Player) AddEffect(name string) {
+	p.AddEffectFrom(name, nil)
+}
+
+// AddEffectFrom is AddEffect for an effect another player caused, whose handicap changes how much damage it does
+// like it does their hits.
+func (p *Player) AddEffectFrom(name string, from *Player) {
+	rule := EFFECT_RULES[name]
+	var mult float32
+	if from != nil {
+		mult = from.Handicap.DamageMult
+	}
+	effects := make([]Effect, 0, len(p.Effects)+1)
+	found := false
+	for _, e := range p.Effects {
+		if e.Name == name {
+			found = true
+			e.Duration = rule.Duration
+			e.DamageMult = mult
+			if e.Stacks < rule.MaxStacks {
+				e.Stacks++
+			}
+		}
+		effects = append(effects, e)
+	}
+	if !found {
+		effects = append(effects, Effect{Name: name, Duration: rule.Duration, Stacks: 1, DamageMult: mult})
+	}
+	p.Effects = effects
+}
+
+// RemoveEffect takes an effect off the player completely.
+func (p *Player) RemoveEffect(name string) {
+	var effects []Effect
+	for _, e := range p.Effects {
+		if e.Name != name {
+			effects = append(effects, e)
+		}
+	}
+	p.Effects = effects
+}
+
+// EffectStacks returns how many stacks of the effect the player has, which is 0 if they don't have it.
+func (p *Player) EffectStacks(name string) int {
+	for _, e := range p.Effects {
+		if e.Name == name {
+			return e.Stacks
+		}
+	}
+	return 0
+}
+
+// tickEffects runs each effect for the given number of milliseconds and gets rid of the ones that run out. It's
+// called from PassTime.
+func (p *Player) tickEffects(amount int) {
+	if len(p.Effects) == 0 {
+		return
+	}
+	var effects []Effect
+	for _, e := range p.Effects {
+		if tick := EFFECT_RULES[e.Name].Tick; tick != nil {
+			tick(p, e, amount)
+		}
+		e.Duration -= amount
+		if e.Duration > 0 {
+			effects = append(effects, e)
+		}
+	}
+	p.Effects = effects
+}
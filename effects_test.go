@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddEffect(t *testing.T) {
+	p := NewPlayer()
+	p.AddEffect("bleed")
+	assert.Equal(t, []Effect{{Name: "bleed", Duration: BLEED_TIME, Stacks: 1}}, p.Effects)
+
+	// Applying it again adds a stack and starts the duration over, up to the most stacks it can have.
+	p.tickEffects(1)
+	for i := 0; i < BLEED_MAX_STACKS+2; i++ {
+		p.AddEffect("bleed")
+	}
+	assert.Equal(t, []Effect{{Name: "bleed", Duration: BLEED_TIME, Stacks: BLEED_MAX_STACKS}}, p.Effects)
+
+	// Effects that don't stack just get refreshed.
+	p.AddEffect("stagger")
+	p.AddEffect("stagger")
+	assert.Equal(t, 1, p.EffectStacks("stagger"))
+	assert.Equal(t, EffectStatus{Bleed: BLEED_MAX_STACKS, Stagger: 1}, p.Status().Effects)
+
+	p.RemoveEffect("bleed")
+	assert.Equal(t, 0, p.EffectStacks("bleed"))
+	p.RemoveEffect("stagger")
+	assert.Nil(t, p.Effects)
+}
+
+func TestBleed(t *testing.T) {
+	p := NewPlayer()
+	p.AddEffect("bleed")
+	p.AddEffect("bleed")
+	// It doesn't hurt right away.
+	p.PassTime(1)
+	assert.Equal(t, 100, p.Life)
+	for i := 1; i < BLEED_TIME; i++ {
+		p.PassTime(1)
+	}
+	assert.Equal(t, 100-2*BLEED_DMG*(BLEED_TIME/BLEED_INTERVAL-1), p.Life)
+	assert.Nil(t, p.Effects)
+
+	// A handicap on whoever caused it changes how much it hurts, like it does their hits.
+	p = NewPlayer()
+	attacker := NewPlayer()
+	attacker.SetHandicap(Handicap{DamageMult: 2})
+	p.AddEffectFrom("bleed", &attacker)
+	for i := 0; i < BLEED_TIME; i++ {
+		p.PassTime(1)
+	}
+	assert.Equal(t, 100-2*BLEED_DMG*(BLEED_TIME/BLEED_INTERVAL-1), p.Life)
+
+	// Heavy attacks that get through cause it.
+	p1 := NewPlayer()
+	p1.Finished = "heavy attack"
+	_, p2 := resolveState(p1, NewPlayer())
+	assert.Equal(t, 1, p2.EffectStacks("bleed"))
+	_, p2 = resolveState(p1, playerWith(100, HEAVY_ATK_BLK_COST-1, "blocking", 0))
+	assert.Equal(t, 1, p2.EffectStacks("bleed"))
+	_, p2 = resolveState(p1, playerWith(100, 100, "blocking", 0))
+	assert.Equal(t, 0, p2.EffectStacks("bleed"))
+	// And the bleeding goes by the attacker's handicap.
+	p1.SetHandicap(Handicap{DamageMult: 0.5})
+	_, p2 = resolveState(p1, NewPlayer())
+	assert.Equal(t, []Effect{{Name: "bleed", Duration: BLEED_TIME, Stacks: 1, DamageMult: 0.5}}, p2.Effects)
+}
+
+func TestStagger(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	// Blocking a heavy attack causes it.
+	p1 := NewPlayer()
+	p1.Finished = "heavy attack"
+	_, p2 := resolveState(p1, playerWith(100, 100, "blocking", 0))
+	assert.Equal(t, 1, p2.EffectStacks("stagger"))
+
+	// It slows down the next action and is used up by it.
+	p2.SetState("standing", 0)
+	p2.Command = "LIGHT"
+	p2, _ = resolveCommand(p2, NewPlayer(), random)
+	staggeredTime := int(float32(LIGHT_ATK_TIME) * STAGGER_SLOWDOWN)
+	assert.Equal(t, staggeredTime, p2.StateDuration)
+	assert.Equal(t, 0, p2.EffectStacks("stagger"))
+
+	// The counter window is judged against how long the attack really took.
+	p2.StateDuration = 0
+	p2.Finished = "light attack"
+	blocker := playerWith(100, 100, "blocking", -(LIGHT_ATK_TIME - LIGHT_ATK_CNTR_WINDOW))
+	p2, blocker = resolveState(p2, blocker)
+	assert.Equal(t, "blocking", blocker.State)
+	assert.NotEqual(t, "countered", p2.State)
+	p2 = midway(NewPlayer(), staggeredTime)
+	p2.Finished = "light attack"
+	_, blocker = resolveState(p2, playerWith(100, 100, "blocking", -(staggeredTime-LIGHT_ATK_CNTR_WINDOW)))
+	assert.Equal(t, "counterattack", blocker.State)
+
+	// It wears off on its own too.
+	p := NewPlayer()
+	p.AddEffect("stagger")
+	for i := 0; i < STAGGER_TIME; i++ {
+		p.PassTime(1)
+	}
+	assert.Equal(t, 0, p.EffectStacks("stagger"))
+}
+
+func TestGuardCrush(t *testing.T) {
+	// A grab that lands causes it.
+	p1 := NewPlayer()
+	p1.Finished = "grabbing"
+	_, p2 := resolveState(p1, playerWith(100, 100, "blocking", 0))
+	assert.Equal(t, 1, p2.EffectStacks("guard crush"))
+
+	// It makes blocking cost more.
+	p1 = midway(NewPlayer(), LIGHT_ATK_TIME)
+	p1.Finished = "light attack"
+	crushed := playerWith(100, 100, "blocking", -1)
+	crushed.AddEffect("guard crush")
+	_, crushed = resolveState(p1, crushed)
+	assert.Equal(t, 100-LIGHT_ATK_BLK_COST*GUARD_CRUSH_FACTOR, crushed.Stamina)
+	assert.Equal(t, "blocking", crushed.State)
+
+	// If the block can't be paid for any more, the attack gets through.
+	p1.Finished = "heavy attack"
+	crushed = playerWith(100, HEAVY_ATK_BLK_COST, "blocking", 0)
+	crushed.AddEffect("guard crush")
+	_, crushed = resolveState(p1, crushed)
+	assert.Equal(t, 100-HEAVY_ATK_DMG, crushed.Life)
+}
+
+// Step has to leave the state it was given alone, even though effects are in a slice.
+func TestEffectsCopyOnWrite(t *testing.T) {
+	state := BattleState{Players: []Player{NewPlayer(), NewPlayer()}}
+	state.Players[0].AddEffect("bleed")
+	state.Players[0].AddEffect("stagger")
+	before := append([]Effect(nil), state.Players[0].Effects...)
+	next := Step(state, []TickInput{{Player: 0, Command: "LIGHT"}})
+	assert.Equal(t, before, state.Players[0].Effects)
+	assert.Equal(t, []Effect{{Name: "bleed", Duration: BLEED_TIME - 10, Stacks: 1}}, next.Players[0].Effects)
+}
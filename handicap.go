@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file defines handicaps, which let two players who aren't evenly matched have a fair game anyway. They're
+// set up when challenging someone or starting a bot match, and both sides are shown them when the battle starts.
+// Battles with handicaps don't count for ratings.
+
+package main
+
+import (
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// A Handicap changes how one player fights. Any field left at 0 doesn't change anything, so the zero Handicap is
+// no handicap at all.
+type Handicap struct {
+	// How much life the player starts with, instead of their archetype's.
+	Life int `json:"life,omitempty"`
+	// The most stamina the player can have, instead of 100.
+	MaxStamina float32 `json:"maxStamina,omitempty"`
+	// How much the player's hits hurt, and how fast their stamina regenerates, compared to normal.
+	DamageMult float32 `json:"damageMult,omitempty"`
+	RegenMult  float32 `json:"regenMult,omitempty"`
+	// How many milliseconds wider the player's counter window is.
+	CounterWindow int `json:"counterWindow,omitempty"`
+}
+
+// The limits on what a handicap can be set to, so nobody can set up a battle that can't be won or can't end.
+const (
+	HANDICAP_MAX_LIFE           int     = 500
+	HANDICAP_MIN_STAMINA        float32 = 20
+	HANDICAP_MAX_STAMINA        float32 = 200
+	HANDICAP_MIN_MULT           float32 = 0.25
+	HANDICAP_MAX_MULT           float32 = 4
+	HANDICAP_MAX_COUNTER_WINDOW int     = 250
+)
+
+// The normal max stamina, for players without a handicap.
+const MAX_STAMINA float32 = 100
+
+// Validate returns an error if any of the handicap's fields are out of bounds.
+func (h Handicap) Validate() error {
+	if h.Life < 0 || h.Life > HANDICAP_MAX_LIFE {
+		return errors.Errorf("starting life must be between 1 and %d", HANDICAP_MAX_LIFE)
+	}
+	if h.MaxStamina != 0 && (h.MaxStamina < HANDICAP_MIN_STAMINA || h.MaxStamina > HANDICAP_MAX_STAMINA) {
+		return errors.Errorf("max stamina must be between %v and %v", HANDICAP_MIN_STAMINA, HANDICAP_MAX_STAMINA)
+	}
+	for _, mult := range []float32{h.DamageMult, h.RegenMult} {
+		if mult != 0 && (mult < HANDICAP_MIN_MULT || mult > HANDICAP_MAX_MULT) {
+			return errors.Errorf("multipliers must be between %v and %v", HANDICAP_MIN_MULT, HANDICAP_MAX_MULT)
+		}
+	}
+	if h.CounterWindow < 0 || h.CounterWindow > HANDICAP_MAX_COUNTER_WINDOW {
+		return errors.Errorf("the counter window can only be widened by up to %dms", HANDICAP_MAX_COUNTER_WINDOW)
+	}
+	return nil
+}
+
+// SetHandicap gives the player a handicap. Like SetArchetype it's only meant to be used before the battle starts,
+// and it has to come after SetArchetype, since it can override the archetype's life.
+func (p *Player) SetHandicap(h Handicap) {
+	p.Handicap = h
+	if h.Life != 0 {
+		p.Life = h.Life
+	}
+	p.Stamina = p.maxStamina()
+}
+
+// maxStamina returns the most stamina the player can have.
+func (p *Player) maxStamina() float32 {
+	if p.Handicap.MaxStamina != 0 {
+		return p.Handicap.MaxStamina
+	}
+	return MAX_STAMINA
+}
+
+// damage returns how much a hit by the player that normally does the given damage really does, rounded to the
+// nearest point.
+func (p *Player) damage(amount int) int {
+	return scaleDamage(amount, p.Handicap.DamageMult)
+}
+
+// scaleDamage applies a handicap's damage multiplier to an amount of damage, rounding to the nearest point. A
+// multiplier of 0 means there's no handicap.
+func scaleDamage(amount int, mult float32) int {
+	if mult == 0 {
+		return amount
+	}
+	return int(math.Round(float64(float32(amount) * mult)))
+}
+
+// regen returns how much stamina the player regenerates per second, before blocking is taken into account.
+func (p *Player) regen() float32 {
+	if p.Handicap.RegenMult == 0 {
+		return p.Archetype.Regen
+	}
+	return p.Archetype.Regen * p.Handicap.RegenMult
+}
+
+// handicapped says whether anyone in a battle has a handicap.
+func handicapped(players []Player) bool {
+	for _, p := range players {
+		if p.Handicap != (Handicap{}) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandicapValidate(t *testing.T) {
+	assert.Nil(t, Handicap{}.Validate())
+	assert.Nil(t, Handicap{Life: 150, MaxStamina: 80, DamageMult: 0.5, RegenMult: 2, CounterWindow: 10}.Validate())
+	for _, bad := range []Handicap{
+		{Life: -1}, {Life: HANDICAP_MAX_LIFE + 1}, {MaxStamina: 5}, {MaxStamina: -100}, {DamageMult: 10},
+		{RegenMult: 0.1}, {CounterWindow: -5}, {CounterWindow: HANDICAP_MAX_COUNTER_WINDOW + 1},
+	} {
+		assert.NotNil(t, bad.Validate(), "%+v", bad)
+	}
+}
+
+func TestSetHandicap(t *testing.T) {
+	p := NewPlayer()
+	p.SetArchetype(getArchetypeByName("Brute"))
+	p.SetHandicap(Handicap{})
+	assert.Equal(t, 120, p.Life)
+	assert.Equal(t, MAX_STAMINA, p.Stamina)
+
+	p.SetHandicap(Handicap{Life: 150, MaxStamina: 60})
+	assert.Equal(t, 150, p.Life)
+	assert.Equal(t, float32(60), p.Stamina)
+	// Stamina doesn't regenerate past the max.
+	p.PassTime(1)
+	assert.Equal(t, float32(60), p.Stamina)
+	assert.True(t, handicapped([]Player{NewPlayer(), p}))
+	assert.False(t, handicapped([]Player{NewPlayer(), NewPlayer()}))
+}
+
+func TestRegenMult(t *testing.T) {
+	p := NewPlayer()
+	p.SetHandicap(Handicap{RegenMult: 2})
+	p.Stamina = 50
+	p.PassTime(1000)
+	assert.InDelta(t, 50+2*p.Archetype.Regen, p.Stamina, 0.0001)
+}
+
+func TestDamageMult(t *testing.T) {
+	p1 := midway(NewPlayer(), LIGHT_ATK_TIME)
+	p1.SetHandicap(Handicap{DamageMult: 2})
+	p1.Finished = "light attack"
+	_, p2 := resolveState(p1, NewPlayer())
+	assert.Equal(t, 100-2*LIGHT_ATK_DMG, p2.Life)
+
+	// It's rounded to the nearest point.
+	p1.SetHandicap(Handicap{DamageMult: 0.5})
+	p1.Finished = "heavy attack"
+	_, p2 = resolveState(p1, NewPlayer())
+	assert.Equal(t, 100-HEAVY_ATK_DMG/2, p2.Life)
+	p1.Finished = "light attack"
+	_, p2 = resolveState(p1, NewPlayer())
+	assert.Equal(t, 100-2, p2.Life)
+}
+
+func TestCounterWindowHandicap(t *testing.T) {
+	p1 := midway(NewPlayer(), LIGHT_ATK_TIME)
+	p1.Finished = "light attack"
+	// A block a little too late to counter normally...
+	late := -(LIGHT_ATK_TIME - LIGHT_ATK_CNTR_WINDOW - 5)
+	_, blocker := resolveState(p1, playerWith(100, 100, "blocking", late))
+	assert.Equal(t, "blocking", blocker.State)
+	// ...counters with a wider window.
+	blocker = playerWith(100, 100, "blocking", late)
+	blocker.Handicap.CounterWindow = 5
+	_, blocker = resolveState(p1, blocker)
+	assert.Equal(t, "counterattack", blocker.State)
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file measures each connection's round trip time and works out how much lag compensation an input gets.
+
+package main
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How often each connection is pinged.
+const PING_INTERVAL = time.Second
+
+// The furthest an input is moved back in time by default, and the furthest it can be set to. Much more than the
+// maximum would let a laggy player react to things that happened well before they pressed anything.
+const (
+	DEFAULT_LAG_COMPENSATION_LIMIT = 150 * time.Millisecond
+	MAX_LAG_COMPENSATION_LIMIT     = time.Second
+)
+
+// LagCompensationLimit is the furthest an input can be moved back in time. An input can also never be moved
+// back further than its connection's measured RTT. Setting it to 0 turns lag compensation off. It's set from the
+// config when the server starts.
+var LagCompensationLimit = DEFAULT_LAG_COMPENSATION_LIMIT
+
+// Latency holds a connection's smoothed RTT. It's written by the connection's goroutine and read by the battle,
+// so it's only accessed atomically.
+type Latency struct {
+	rtt int64
+}
+
+// RTT returns the current smoothed round trip time.
+func (l *Latency) RTT() time.Duration {
+	if l == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&l.rtt))
+}
+
+// Record adds a new measurement. Each one moves the smoothed value a quarter of the way, so one slow ping doesn't
+// make it jump around.
+func (l *Latency) Record(sample time.Duration) {
+	old := time.Duration(atomic.LoadInt64(&l.rtt))
+	if old == 0 {
+		atomic.StoreInt64(&l.rtt, int64(sample))
+		return
+	}
+	atomic.StoreInt64(&l.rtt, int64(old+(sample-old)/4))
+}
+
+// measureLatency pings the socket every PING_INTERVAL until stop is closed, recording the RTT from each pong.
+// Browsers answer pings on their own, so the client doesn't need to do anything. The ping's payload is the time
+// it was sent, which the pong echoes back.
+func measureLatency(socket *websocket.Conn, latency *Latency, stop <-chan struct{}) {
+	socket.SetPongHandler(func(data string) error {
+		if len(data) == 8 {
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(data))))
+			latency.Record(time.Since(sent))
+		}
+		return nil
+	})
+	ticker := time.NewTicker(PING_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			payload := make([]byte, 8)
+			binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+			// WriteControl is safe to call alongside the goroutine writing normal messages.
+			if err := socket.WriteControl(websocket.PingMessage, payload, time.Now().Add(PING_INTERVAL)); err != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// lagCompensation returns how many milliseconds ago an input should be treated as having arrived. stamped is the
+// tick the client says it was on when the input was made (0 if it didn't say), current is the tick it actually
+// arrived on, and tick is how long a tick is.
+func lagCompensation(current, stamped int, rtt, tick time.Duration) int {
+	if stamped <= 0 || stamped >= current {
+		return 0
+	}
+	lag := time.Duration(current-stamped) * tick
+	if lag > LagCompensationLimit {
+		lag = LagCompensationLimit
+	}
+	// Don't believe a client that claims more lag than it has. The stamp can be up to a tick off either way.
+	if lag > rtt+tick {
+		lag = rtt + tick
+	}
+	return int(lag / time.Millisecond)
+}
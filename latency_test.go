@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyRecord(t *testing.T) {
+	var l Latency
+	l.Record(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, l.RTT())
+	l.Record(200 * time.Millisecond)
+	assert.Equal(t, 125*time.Millisecond, l.RTT())
+
+	// Bots don't have a Latency at all.
+	var none *Latency
+	assert.Equal(t, time.Duration(0), none.RTT())
+}
+
+func TestLagCompensation(t *testing.T) {
+	tick := 10 * time.Millisecond
+	// Unstamped inputs and inputs from the future get nothing.
+	assert.Equal(t, 0, lagCompensation(100, 0, time.Second, tick))
+	assert.Equal(t, 0, lagCompensation(100, 120, time.Second, tick))
+	// Normal lag is compensated in full.
+	assert.Equal(t, 80, lagCompensation(100, 92, 100*time.Millisecond, tick))
+	// It's measured in time, not ticks.
+	assert.Equal(t, 64, lagCompensation(100, 92, 100*time.Millisecond, 8*time.Millisecond))
+	// But never more than the connection's RTT allows...
+	assert.Equal(t, 30, lagCompensation(100, 90, 20*time.Millisecond, tick))
+	// ...or the configured limit.
+	assert.Equal(t, int(LagCompensationLimit/time.Millisecond), lagCompensation(1000, 500, time.Second, tick))
+	// And not at all when it's turned off.
+	limit := LagCompensationLimit
+	LagCompensationLimit = 0
+	assert.Equal(t, 0, lagCompensation(100, 92, 100*time.Millisecond, tick))
+	LagCompensationLimit = limit
+}
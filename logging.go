@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file sets up the server's logging. Log lines are structured, with the details in key/value pairs instead
+// of run together in the message, so they can be searched. Every connection and every battle gets an ID, and
+// everything logged about one carries its ID under the "conn" or "match" key, so it's easy to follow what
+// happened to a player or in a battle even with lots going on at once.
+
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+// The formats logs can be written in: "key=value" pairs, or a JSON object per line.
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// The last IDs given to a connection and a battle. They start over when the server restarts.
+var lastConnID, lastMatchID atomic.Uint64
+
+func nextConnID() uint64 {
+	return lastConnID.Add(1)
+}
+
+func nextMatchID() uint64 {
+	return lastMatchID.Add(1)
+}
+
+// newLogger makes a logger that writes to w in the given format, skipping anything less important than level.
+func newLogger(w io.Writer, format string, level slog.Leveler) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	if format == LOG_FORMAT_JSON {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+// fatal logs an error that the server can't carry on after, and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
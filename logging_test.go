@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// logBuffer collects log lines. It's locked, since goroutines left over from other tests might still be logging.
+type logBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines decodes the JSON log lines written so far.
+func (b *logBuffer) lines(t *testing.T) []map[string]interface{} {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var decoded map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &decoded), line)
+		lines = append(lines, decoded)
+	}
+	return lines
+}
+
+// captureLogs sends the default logger's output to a buffer in JSON until the test is over.
+func captureLogs(t *testing.T, level slog.Level) *logBuffer {
+	buf := &logBuffer{}
+	old := slog.Default()
+	slog.SetDefault(newLogger(buf, LOG_FORMAT_JSON, level))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return buf
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := newLogger(&buf, LOG_FORMAT_TEXT, slog.LevelWarn)
+	log.Info("hidden")
+	log.Warn("shown", "conn", 3)
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), "msg=shown conn=3")
+	_, err := LoadConfig([]string{"-logformat", "xml"}, testEnv(nil))
+	assert.NotNil(t, err)
+}
+
+func TestMatchLogs(t *testing.T) {
+	buf := captureLogs(t, slog.LevelDebug)
+	match := NewMatch(context.Background(), []Player{NewPlayer(), NewPlayer()})
+	assert.NotEqual(t, NewMatch(context.Background(), nil).ID, match.ID)
+	stopped := make(chan struct{})
+	go func() {
+		runBot("AttackBot", AttackBot, match, 1, getArchetypeByName(DEFAULT_ARCHETYPE))
+		close(stopped)
+	}()
+	match.Start()
+	match.Forfeit(0)
+	lastUpdate(t, match.Updates(0))
+	<-stopped
+	// Everything about the battle, including from the bot, says which battle it was.
+	var messages []string
+	for _, line := range buf.lines(t) {
+		assert.Equal(t, float64(match.ID), line["match"], "%v", line)
+		messages = append(messages, line["msg"].(string))
+	}
+	assert.Contains(t, messages, "battle over")
+	assert.Contains(t, messages, "bot starting")
+	assert.Contains(t, messages, "bot stopped")
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file runs battles. A Match is a battle plus everything needed to talk to it and stop it from outside.
+//
+// The match owns all of its channels. Players send inputs with Input, which never waits: inputs are queued, and if
+// the battle is so far behind that the queue is full, they're dropped, so a stuck battle can't hold up the lobby.
+// Forfeits have their own room, so they're never dropped. Each player gets their updates from a channel
+// that only ever holds the newest one, so the battle never waits for a slow reader, and that channel is closed
+// once the battle is over so whoever's reading it knows to stop. Once Done is closed, the match has nothing
+// left running.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The Outcome of every player's last update when a battle is aborted. It doesn't count as a win or a loss.
+const OUTCOME_NO_CONTEST = "no contest"
+
+// How many inputs each player can have waiting for the battle before more are dropped.
+const INPUT_QUEUE_SIZE = 32
+
+type Match struct {
+	// The match's ID, and where to log things about it, which says the ID (see logging.go).
+	ID      uint64
+	Log     *slog.Logger
+	players []Player
+	inputs  chan playerInput
+	updates []chan Update
+	// Players whose connection is only known once the battle has been set up, like on a worker, have it passed in
+	// here. There's room for one for each player.
+	latencies chan playerLatency
+	// Each player can only forfeit once, so there's always room for it.
+	forfeits  chan int
+	forfeited []sync.Once
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	// How the battle ended, once it's over.
+	final   BattleState
+	aborted bool
+	// For a battle that's running on a worker instead of here (see workers.go), the worker, and where it sends
+	// the result.
+	worker  *Worker
+	results chan workerMessage
+}
+
+// playerInput is a Message from the player with the given index.
+type playerInput struct {
+	Player  int
+	Message Message
+}
+
+// playerLatency is the Latency of the connection the player with the given index is playing over.
+type playerLatency struct {
+	Player  int
+	Latency *Latency
+}
+
+// NewMatch sets up a battle between the given players that's aborted if ctx is canceled. It doesn't start until
+// Start is called.
+func NewMatch(ctx context.Context, players []Player) *Match {
+	return newMatchWithID(ctx, nextMatchID(), players)
+}
+
+// newMatchWithID is NewMatch for a battle that already has an ID, because a lobby assigned it to this worker.
+func newMatchWithID(ctx context.Context, id uint64, players []Player) *Match {
+	m := &Match{
+		ID:        id,
+		Log:       slog.Default().With("match", id),
+		players:   players,
+		inputs:    make(chan playerInput, INPUT_QUEUE_SIZE*len(players)),
+		updates:   make([]chan Update, len(players)),
+		latencies: make(chan playerLatency, len(players)),
+		forfeits:  make(chan int, len(players)),
+		forfeited: make([]sync.Once, len(players)),
+		done:      make(chan struct{}),
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	for i := range m.updates {
+		m.updates[i] = make(chan Update, 1)
+	}
+	return m
+}
+
+// Start runs the battle in its own goroutine, or has its worker run it. It must only be called once.
+func (m *Match) Start() {
+	if m.worker != nil {
+		go m.relay()
+	} else {
+		go m.run()
+	}
+}
+
+// Abort stops the battle early. Everyone's last update has OUTCOME_NO_CONTEST as the outcome.
+func (m *Match) Abort() {
+	m.cancel()
+}
+
+// Forfeit knocks out the i-th player, the same as if they'd sent a FORFEIT command.
+func (m *Match) Forfeit(i int) {
+	m.forfeited[i].Do(func() {
+		m.forfeits <- i
+	})
+}
+
+// Input passes a message from the i-th player to the battle. It never blocks; if the battle is over the message is
+// thrown away, and if the battle has too many inputs waiting already it's dropped.
+func (m *Match) Input(i int, msg Message) {
+	if msg.Command == "FORFEIT" {
+		m.Forfeit(i)
+		return
+	}
+	select {
+	case <-m.done:
+		return
+	default:
+	}
+	select {
+	case m.inputs <- playerInput{Player: i, Message: msg}:
+	default:
+		metricDroppedInputs.Inc()
+		m.Log.Warn("dropped input because the battle is behind", "player", i)
+	}
+}
+
+// SetLatency tells the battle the latency of the connection the i-th player is playing over, which is used for
+// lag compensation. It can be called before the battle starts, but only once for each player.
+func (m *Match) SetLatency(i int, latency *Latency) {
+	m.latencies <- playerLatency{Player: i, Latency: latency}
+}
+
+// Updates returns the channel the i-th player's updates come through. It's closed after the last one.
+func (m *Match) Updates(i int) <-chan Update {
+	return m.updates[i]
+}
+
+// Done is closed once the battle is over and the last updates have been sent.
+func (m *Match) Done() <-chan struct{} {
+	return m.done
+}
+
+// Result returns the last state of the battle and whether it was aborted. It's only meaningful once Done is
+// closed.
+func (m *Match) Result() (BattleState, bool) {
+	<-m.done
+	return m.final, m.aborted
+}
+
+// send gives the i-th player an update, replacing the last one if they haven't picked it up yet. The acks in
+// the one that's replaced are carried over, so none get lost.
+func (m *Match) send(i int, update Update) {
+	select {
+	case old := <-m.updates[i]:
+		update.Acks = append(old.Acks, update.Acks...)
+		metricDroppedUpdates.Inc()
+	default:
+	}
+	// This can't block, since nothing else sends on the channel and there's room for one.
+	m.updates[i] <- update
+}
+
+func (m *Match) run() {
+	defer close(m.done)
+	defer m.cancel()
+	// Initialize the clocks and players. The simulation and the updates to the players each have their own.
+	state := BattleState{TickRate: TickRate, Seed: time.Now().UnixNano(), Players: m.players}
+	ticker := time.NewTicker(state.TickLength())
+	defer ticker.Stop()
+	updateTicker := time.NewTicker(time.Second / time.Duration(UpdateRate))
+	defer updateTicker.Stop()
+	// The inputs that have come in since the last tick.
+	var pending []TickInput
+	// The acks each player hasn't been sent yet.
+	acks := make([][]InputAck, len(m.players))
+	aborted := false
+	// Latencies that were set before the battle started are taken right away, so the first inputs can use them.
+	for len(m.latencies) > 0 {
+		l := <-m.latencies
+		state.Players[l.Player].Latency = l.Latency
+	}
+	for !state.Over() && !aborted {
+		select {
+		case <-m.ctx.Done():
+			aborted = true
+		case l := <-m.latencies:
+			state.Players[l.Player].Latency = l.Latency
+		// Each tick:
+		case <-ticker.C:
+			start := time.Now()
+			state = Step(state, pending)
+			metricTickTime.Observe(time.Since(start).Seconds())
+			for _, input := range pending {
+				// Targets and forfeits are lobby-style commands, which don't have sequence numbers.
+				if input.Command != "TARGET" && input.Command != "FORFEIT" {
+					acks[input.Player] = append(acks[input.Player], InputAck{Seq: input.Seq, Tick: state.Tick})
+				}
+			}
+			pending = nil
+		// Each time updates are due. The last one is sent below, once the battle is over.
+		case <-updateTicker.C:
+			for i := range state.Players {
+				m.send(i, state.UpdateFor(i, acks[i]))
+				acks[i] = nil
+			}
+		case i := <-m.forfeits:
+			pending = append(pending, TickInput{Player: i, Command: "FORFEIT"})
+		case input := <-m.inputs:
+			i := input.Player
+			switch input.Message.Command {
+			case "TARGET":
+				// A target that isn't a number is ignored like any other bad one.
+				t, err := strconv.Atoi(input.Message.Content)
+				if err != nil {
+					t = NO_TARGET
+				}
+				pending = append(pending, TickInput{Player: i, Command: "TARGET", Target: t})
+			default:
+				pending = append(pending, TickInput{Player: i, Command: input.Message.Content, Seq: input.Message.Seq,
+					Lag: lagCompensation(state.Tick, input.Message.Tick, state.Players[i].Latency.RTT(), state.TickLength())})
+			}
+		}
+	}
+	// Send one last update to the players so they know how the battle ended, and let them know there won't be
+	// any more.
+	for i := range state.Players {
+		update := state.UpdateFor(i, acks[i])
+		if aborted {
+			update.Outcome = OUTCOME_NO_CONTEST
+		}
+		m.send(i, update)
+		close(m.updates[i])
+	}
+	m.final, m.aborted = state, aborted
+	outcomes := make([]string, len(state.Players))
+	for i := range state.Players {
+		outcomes[i] = state.Outcome(i)
+	}
+	if aborted {
+		m.Log.Info("battle called off", "ticks", state.Tick)
+	} else {
+		m.Log.Info("battle over", "ticks", state.Tick, "outcomes", outcomes)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// settles says whether the number of goroutines running gets back down to n within a second.
+func settles(n int) bool {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// lastUpdate reads updates until the channel is closed and returns the last one.
+func lastUpdate(t *testing.T, updates <-chan Update) Update {
+	var last Update
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return last
+			}
+			last = update
+		case <-timeout:
+			t.Fatal("the updates never stopped")
+		}
+	}
+}
+
+func TestMatchForfeit(t *testing.T) {
+	before := runtime.NumGoroutine()
+	match := NewMatch(context.Background(), []Player{NewPlayer(), NewPlayer()})
+	match.Start()
+	match.Forfeit(1)
+	assert.Equal(t, "win", lastUpdate(t, match.Updates(0)).Outcome)
+	assert.Equal(t, "loss", lastUpdate(t, match.Updates(1)).Outcome)
+	<-match.Done()
+	// Inputs to a finished battle don't hold anyone up.
+	match.Input(0, Message{Content: "LIGHT"})
+	match.Forfeit(0)
+	match.Abort()
+	assert.True(t, settles(before))
+}
+
+func TestMatchAbort(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	match := NewMatch(ctx, []Player{NewPlayer(), NewPlayer(), NewPlayer()})
+	match.Start()
+	match.Input(0, Message{Content: "HEAVY", Seq: 1})
+	// Canceling the context the match was made with aborts it too.
+	cancel()
+	<-match.Done()
+	for i := 0; i < 3; i++ {
+		last := lastUpdate(t, match.Updates(i))
+		assert.Equal(t, OUTCOME_NO_CONTEST, last.Outcome)
+		assert.Equal(t, OUTCOME_NO_CONTEST, NewResult(last).Outcome)
+	}
+	assert.True(t, settles(before))
+}
+
+func TestMatchInputNeverBlocks(t *testing.T) {
+	match := NewMatch(context.Background(), []Player{NewPlayer(), NewPlayer()})
+	dropped := metricDroppedInputs.Value()
+	// The battle hasn't started, so nothing is taking inputs, but sending them still doesn't wait.
+	for i := 0; i < INPUT_QUEUE_SIZE*3; i++ {
+		match.Input(0, Message{Content: "LIGHT", Seq: i})
+	}
+	assert.Equal(t, dropped+INPUT_QUEUE_SIZE, metricDroppedInputs.Value())
+	// Forfeits are never dropped, even when the queue is full.
+	match.Forfeit(1)
+	match.Input(1, Message{Command: "FORFEIT"})
+	match.Start()
+	assert.Equal(t, "win", lastUpdate(t, match.Updates(0)).Outcome)
+	assert.Equal(t, "loss", lastUpdate(t, match.Updates(1)).Outcome)
+}
+
+func TestMatchUpdates(t *testing.T) {
+	match := NewMatch(context.Background(), []Player{NewPlayer(), NewPlayer()})
+	dropped := metricDroppedUpdates.Value()
+	// A player who doesn't pick up their updates only has the newest waiting, and doesn't miss any acks.
+	match.send(0, Update{Tick: 1, Acks: []InputAck{{Seq: 1, Tick: 1}}})
+	match.send(0, Update{Tick: 2, Acks: []InputAck{{Seq: 2, Tick: 2}}})
+	assert.Equal(t, dropped+1, metricDroppedUpdates.Value())
+	assert.Equal(t, Update{Tick: 2, Acks: []InputAck{{Seq: 1, Tick: 1}, {Seq: 2, Tick: 2}}}, <-match.Updates(0))
+	assert.Equal(t, 0, len(match.Updates(0)))
+}
+
+func TestBotLeavesWithMatch(t *testing.T) {
+	before := runtime.NumGoroutine()
+	match := NewMatch(context.Background(), []Player{NewPlayer(), NewPlayer()})
+	stopped := make(chan struct{})
+	go func() {
+		AttackBot(match.Updates(1), func(input Message) { match.Input(1, input) }, getArchetypeByName(DEFAULT_ARCHETYPE))
+		close(stopped)
+	}()
+	match.Start()
+	// The bot is still waiting out the countdown, and doesn't need it to finish to notice the battle's gone.
+	match.Abort()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the bot didn't stop")
+	}
+	lastUpdate(t, match.Updates(0))
+	assert.True(t, settles(before))
+}
@@ -0,0 +1,283 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file keeps the server's metrics and serves them at /metrics in the Prometheus text format, so a running
+// server can be watched without anything else installed. They're served on their own address, set in the config
+// along with an optional token that has to be given in an "Authorization: Bearer" header, so they can be kept
+// away from the players. Workers serve the metrics of the battles they run. It only has the few kinds of metric
+// the server needs: counters, gauges and histograms, each of which can be split up by labels.
+//
+// All of the metrics are safe to update from any goroutine.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The metrics the server keeps.
+var (
+	metricClients = newGaugeVec("counterplay_connected_clients", "Clients connected to the server.")
+	metricQueued  = newGaugeVec("counterplay_queued_users", "Users waiting for a battle, by mode.", "mode")
+	metricBattles = newGaugeVec("counterplay_active_battles", "Battles going on.")
+	metricWorkers = newGaugeVec("counterplay_workers", "Workers connected to the lobby.")
+	// Bot matches count as the "bot" mode.
+	metricBattlesStarted  = newCounterVec("counterplay_battles_started_total", "Battles started, by mode.", "mode")
+	metricBattlesFinished = newCounterVec("counterplay_battles_finished_total",
+		"Battles that have ended, by mode and whether they were completed or called off.", "mode", "outcome")
+	metricBotMatches = newCounterVec("counterplay_bot_matches_total", "Bot matches started, by bot.", "bot")
+	metricTickTime   = newHistogram("counterplay_tick_seconds", "How long the server takes to simulate a tick.",
+		[]float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01})
+	metricDroppedUpdates = newCounterVec("counterplay_dropped_updates_total",
+		"Battle updates replaced by a newer one before the player's connection picked them up.")
+	metricDroppedInputs = newCounterVec("counterplay_dropped_inputs_total",
+		"Battle inputs dropped because the battle had too many waiting already.")
+	metricSlowClients = newCounterVec("counterplay_slow_clients_total",
+		"Clients disconnected because they fell too far behind on what they were being sent.")
+	metricSocketErrors = newCounterVec("counterplay_websocket_errors_total",
+		"Errors reading from or writing to websockets.", "op")
+)
+
+// metric is anything that can write itself out in the text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// metricsMutex protects allMetrics, which is every metric that's been made, in the order they were made.
+var metricsMutex sync.Mutex
+var allMetrics []metric
+
+func register(m metric) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	allMetrics = append(allMetrics, m)
+}
+
+// writeMetrics writes out every metric in the text format.
+func writeMetrics(w io.Writer) {
+	metricsMutex.Lock()
+	metrics := append([]metric(nil), allMetrics...)
+	metricsMutex.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// The least a metrics token can be, so it can't be guessed.
+const METRICS_TOKEN_MIN_LENGTH = 16
+
+// metricsHandler serves the metrics at /metrics. If token isn't empty, requests have to give it.
+func metricsHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	return mux
+}
+
+// series is what every kind of metric has in common: a name, a description, and values that are told apart by
+// the values of its labels. The values are made when they're first asked for.
+type series[T any] struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mutex  sync.Mutex
+	values map[string]T
+	make   func() T
+}
+
+// setUp registers the metric, and makes its only value right away if it doesn't have any labels, so that it shows
+// up even before it's used.
+func (s *series[T]) setUp(m metric) {
+	register(m)
+	if len(s.labels) == 0 {
+		s.with()
+	}
+}
+
+// with returns the value for the given label values, which have to be in the same order as the labels.
+func (s *series[T]) with(labels ...string) T {
+	if len(labels) != len(s.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d", s.name, len(s.labels), len(labels)))
+	}
+	key := strings.Join(labels, "\x00")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	value, ok := s.values[key]
+	if !ok {
+		value = s.make()
+		s.values[key] = value
+	}
+	return value
+}
+
+// each calls f with each value's labels written out like {mode="duel"}, sorted so the output doesn't jump around.
+func (s *series[T]) each(w io.Writer, f func(labels string, value T)) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.kind)
+	// The values are copied so the metric isn't locked while they're written.
+	s.mutex.Lock()
+	keys := make([]string, 0, len(s.values))
+	values := make(map[string]T, len(s.values))
+	for key, value := range s.values {
+		keys = append(keys, key)
+		values[key] = value
+	}
+	s.mutex.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		f(formatLabels(s.labels, strings.Split(key, "\x00")), values[key])
+	}
+}
+
+// formatLabels writes label names and values out the way the text format wants them.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = name + `="` + value + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec is a count of something that only goes up.
+type CounterVec struct {
+	series[*atomic.Uint64]
+}
+
+func newCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{series[*atomic.Uint64]{name: name, help: help, kind: "counter", labels: labels,
+		values: make(map[string]*atomic.Uint64), make: func() *atomic.Uint64 { return new(atomic.Uint64) }}}
+	c.setUp(c)
+	return c
+}
+
+// Inc adds one to the count for the given label values.
+func (c *CounterVec) Inc(labels ...string) {
+	c.with(labels...).Add(1)
+}
+
+// Value returns the count for the given label values.
+func (c *CounterVec) Value(labels ...string) uint64 {
+	return c.with(labels...).Load()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.each(w, func(labels string, value *atomic.Uint64) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, labels, value.Load())
+	})
+}
+
+// GaugeVec is a number that can go up and down, like how many of something there are right now.
+type GaugeVec struct {
+	series[*atomic.Int64]
+}
+
+func newGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{series[*atomic.Int64]{name: name, help: help, kind: "gauge", labels: labels,
+		values: make(map[string]*atomic.Int64), make: func() *atomic.Int64 { return new(atomic.Int64) }}}
+	g.setUp(g)
+	return g
+}
+
+// Set sets the number for the given label values.
+func (g *GaugeVec) Set(n int, labels ...string) {
+	g.with(labels...).Store(int64(n))
+}
+
+// Value returns the number for the given label values.
+func (g *GaugeVec) Value(labels ...string) int {
+	return int(g.with(labels...).Load())
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.each(w, func(labels string, value *atomic.Int64) {
+		fmt.Fprintf(w, "%s%s %d\n", g.name, labels, value.Load())
+	})
+}
+
+// Histogram counts how many of a measurement fall at or under each of a list of bounds, along with how many
+// there were and what they added up to.
+type Histogram struct {
+	series[*histogramValue]
+	bounds []float64
+}
+
+type histogramValue struct {
+	mutex sync.Mutex
+	// counts[i] is how many were at or under bounds[i] but over the bound before it. The last one is for those
+	// over all the bounds.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, bounds []float64, labels ...string) *Histogram {
+	h := &Histogram{bounds: bounds}
+	h.series = series[*histogramValue]{name: name, help: help, kind: "histogram", labels: labels,
+		values: make(map[string]*histogramValue),
+		make:   func() *histogramValue { return &histogramValue{counts: make([]uint64, len(bounds)+1)} }}
+	h.setUp(h)
+	return h
+}
+
+// Observe adds a measurement for the given label values.
+func (h *Histogram) Observe(x float64, labels ...string) {
+	value := h.with(labels...)
+	i := sort.SearchFloat64s(h.bounds, x)
+	value.mutex.Lock()
+	defer value.mutex.Unlock()
+	value.counts[i]++
+	value.sum += x
+	value.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.each(w, func(labels string, value *histogramValue) {
+		value.mutex.Lock()
+		defer value.mutex.Unlock()
+		// The text format wants the count at or under each bound, not between them, and the le label goes in
+		// with the rest.
+		withBound := func(bound float64) string {
+			le := "+Inf"
+			if !math.IsInf(bound, 1) {
+				le = strconv.FormatFloat(bound, 'g', -1, 64)
+			}
+			if labels == "" {
+				return `{le="` + le + `"}`
+			}
+			return labels[:len(labels)-1] + `,le="` + le + `"}`
+		}
+		var cumulative uint64
+		for i := range value.counts {
+			bound := math.Inf(1)
+			if i < len(h.bounds) {
+				bound = h.bounds[i]
+			}
+			cumulative += value.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withBound(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, labels, value.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, value.count)
+	})
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("test_counter_total", "A counter.", "mode", "outcome")
+	c.Inc("ffa", "completed")
+	c.Inc("duel", "completed")
+	c.Inc("duel", "completed")
+	c.Inc("duel", `say "hi"`)
+	assert.Equal(t, uint64(2), c.Value("duel", "completed"))
+	assert.Panics(t, func() { c.Inc("duel") })
+	var out bytes.Buffer
+	c.write(&out)
+	assert.Equal(t, `# HELP test_counter_total A counter.
+# TYPE test_counter_total counter
+test_counter_total{mode="duel",outcome="completed"} 2
+test_counter_total{mode="duel",outcome="say \"hi\""} 1
+test_counter_total{mode="ffa",outcome="completed"} 1
+`, out.String())
+}
+
+func TestGaugeVec(t *testing.T) {
+	// Without labels, it's there from the start.
+	g := newGaugeVec("test_gauge", "A gauge.")
+	var out bytes.Buffer
+	g.write(&out)
+	assert.Contains(t, out.String(), "test_gauge 0\n")
+	g.Set(5)
+	g.Set(3)
+	out.Reset()
+	g.write(&out)
+	assert.Contains(t, out.String(), "test_gauge 3\n")
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram("test_seconds", "A histogram.", []float64{0.1, 1}, "mode")
+	for _, x := range []float64{0.05, 0.1, 0.5, 2} {
+		h.Observe(x, "duel")
+	}
+	var out bytes.Buffer
+	h.write(&out)
+	assert.Equal(t, `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{mode="duel",le="0.1"} 2
+test_seconds_bucket{mode="duel",le="1"} 3
+test_seconds_bucket{mode="duel",le="+Inf"} 4
+test_seconds_sum{mode="duel"} 2.65
+test_seconds_count{mode="duel"} 4
+`, out.String())
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	metricsHandler("").ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain"))
+	for _, name := range []string{"counterplay_connected_clients", "counterplay_active_battles",
+		"counterplay_tick_seconds_count", "counterplay_dropped_updates_total"} {
+		assert.Contains(t, body, "\n"+name+" ")
+	}
+
+	// With a token, the metrics are only shown to whoever gives it.
+	handler := metricsHandler("0123456789abcdef")
+	for _, header := range []string{"", "Bearer wrong", "0123456789abcdefx"} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Authorization", header)
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code, header)
+	}
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer 0123456789abcdef")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "counterplay_connected_clients")
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file defines the match modes players can queue for, and what it means for a battle to have more than two
+// players in it: who's on whose side, who each player is attacking, and when it's over.
+
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+type Mode struct {
+	Name string
+	// A match starts as soon as MaxPlayers are ready for it, or with MinPlayers once the one who's been
+	// waiting longest has waited MATCH_WAIT.
+	MinPlayers int
+	MaxPlayers int
+	// How many players are on each team. 0 means there are no teams and everyone is against everyone.
+	TeamSize int
+}
+
+// The mode you queue for if you don't say, unless the server's configured otherwise. DefaultMode is the one it's
+// configured with.
+const DEFAULT_MODE = "duel"
+
+var DefaultMode = DEFAULT_MODE
+
+// How long a match can be held up waiting for more players than it needs.
+const MATCH_WAIT = 15 * time.Second
+
+// The lobby menu in index.html lists these in the same order.
+var MODES = []Mode{
+	{Name: "duel", MinPlayers: 2, MaxPlayers: 2},
+	{Name: "ffa", MinPlayers: 3, MaxPlayers: 4},
+	{Name: "teams", MinPlayers: 4, MaxPlayers: 4, TeamSize: 2},
+}
+
+func getModeByName(name string) *Mode {
+	if name == "" {
+		name = DefaultMode
+	}
+	for i := range MODES {
+		if strings.EqualFold(MODES[i].Name, name) {
+			return &MODES[i]
+		}
+	}
+	return nil
+}
+
+// matchSize says how many of the players waiting for the mode should be put in a match now, or 0 if it isn't
+// time to start one yet. waitedLongest is how long the first one in the queue has been waiting.
+func (m *Mode) matchSize(waiting int, waitedLongest time.Duration) int {
+	if waiting >= m.MaxPlayers {
+		return m.MaxPlayers
+	}
+	if waiting >= m.MinPlayers && waitedLongest >= MATCH_WAIT {
+		return waiting
+	}
+	return 0
+}
+
+// team returns the team for the i-th player put in a match of this mode.
+func (m *Mode) team(i int) int {
+	if m.TeamSize == 0 {
+		return NO_TEAM
+	}
+	return i/m.TeamSize + 1
+}
+
+// A player on NO_TEAM is against everyone else.
+const NO_TEAM = 0
+
+// NO_TARGET is Player.Target for someone who hasn't picked one.
+const NO_TARGET = -1
+
+// isEnemy says whether the i-th and j-th players are against each other.
+func isEnemy(players []Player, i, j int) bool {
+	return i != j && (players[i].Team == NO_TEAM || players[i].Team != players[j].Team)
+}
+
+// target returns the index of the player the i-th player's attacks land on. That's whoever they picked with
+// TARGET, as long as that player is still alive; otherwise it's the next living enemy after them, going around.
+// If every enemy is dead it's the next enemy anyway, so there's still someone to show them, and if they have no
+// enemies at all it's NO_TARGET.
+func target(players []Player, i int) int {
+	if t := players[i].Target; t >= 0 && t < len(players) && isEnemy(players, i, t) && players[t].Life > 0 {
+		return t
+	}
+	fallback := NO_TARGET
+	for n := 1; n < len(players); n++ {
+		j := (i + n) % len(players)
+		if !isEnemy(players, i, j) {
+			continue
+		}
+		if players[j].Life > 0 {
+			return j
+		}
+		if fallback == NO_TARGET {
+			fallback = j
+		}
+	}
+	return fallback
+}
+
+// chooseTarget handles the TARGET command. You can only switch targets when you aren't in the middle of
+// something, so an attack always lands on whoever it was started against, and only to a living enemy.
+func chooseTarget(players []Player, i, t int) {
+	if !INTERRUPTABLE_STATES[players[i].State] || t < 0 || t >= len(players) || !isEnemy(players, i, t) ||
+		players[t].Life <= 0 {
+		return
+	}
+	players[i].Target = t
+}
+
+// bindTarget points the t-th player at the i-th if the i-th just got them into something only the two of them
+// can settle: being countered by them, or having their heavy attack interrupted by them. Otherwise a counterattack
+// could land on someone else and leave the countered player stuck.
+func bindTarget(players []Player, i, t int) {
+	if players[i].State == "countered" && players[t].State == "counterattack" ||
+		strings.HasPrefix(players[i].State, "interrupting") && strings.HasPrefix(players[t].State, "interrupted") {
+		players[t].Target = i
+	}
+}
+
+// livingTeams returns how many sides still have someone alive. Players on NO_TEAM are each their own side.
+func livingTeams(players []Player) int {
+	teams := make(map[int]bool)
+	count := 0
+	for _, p := range players {
+		if p.Life <= 0 {
+			continue
+		}
+		if p.Team == NO_TEAM {
+			count++
+		} else if !teams[p.Team] {
+			teams[p.Team] = true
+			count++
+		}
+	}
+	return count
+}
+
+// Over says whether the battle is over, which is when no more than one side has anyone left standing.
+func (s BattleState) Over() bool {
+	return livingTeams(s.Players) <= 1
+}
+
+// Outcome returns "win", "loss" or "draw" for the i-th player in a battle that's over. A player whose team
+// wins wins even if they were knocked out themselves.
+func (s BattleState) Outcome(i int) string {
+	if livingTeams(s.Players) == 0 {
+		return "draw"
+	}
+	for j, p := range s.Players {
+		if p.Life > 0 && !isEnemy(s.Players, i, j) {
+			return "win"
+		}
+	}
+	return "loss"
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// battleOf returns a BattleState with fresh players on the given teams.
+func battleOf(teams ...int) BattleState {
+	state := BattleState{}
+	for _, team := range teams {
+		p := NewPlayer()
+		p.Team = team
+		state.Players = append(state.Players, p)
+	}
+	return state
+}
+
+func TestGetModeByName(t *testing.T) {
+	assert.Equal(t, "duel", getModeByName("").Name)
+	assert.Equal(t, "ffa", getModeByName("FFA").Name)
+	assert.Nil(t, getModeByName("battle royale"))
+}
+
+func TestMatchSize(t *testing.T) {
+	ffa := getModeByName("ffa")
+	assert.Equal(t, 0, ffa.matchSize(2, time.Hour))
+	assert.Equal(t, 0, ffa.matchSize(3, MATCH_WAIT-time.Second))
+	assert.Equal(t, 3, ffa.matchSize(3, MATCH_WAIT))
+	assert.Equal(t, 4, ffa.matchSize(4, 0))
+	assert.Equal(t, 4, ffa.matchSize(6, 0))
+	assert.Equal(t, 2, getModeByName("duel").matchSize(2, 0))
+
+	teams := getModeByName("teams")
+	assert.Equal(t, []int{1, 1, 2, 2}, []int{teams.team(0), teams.team(1), teams.team(2), teams.team(3)})
+	assert.Equal(t, NO_TEAM, ffa.team(3))
+}
+
+func TestTarget(t *testing.T) {
+	// Without a pick, it's the next enemy around.
+	state := battleOf(NO_TEAM, NO_TEAM, NO_TEAM)
+	assert.Equal(t, []int{1, 2, 0}, []int{target(state.Players, 0), target(state.Players, 1), target(state.Players, 2)})
+
+	// Teammates are skipped.
+	state = battleOf(1, 1, 2, 2)
+	assert.Equal(t, []int{2, 2, 0, 0}, []int{target(state.Players, 0), target(state.Players, 1),
+		target(state.Players, 2), target(state.Players, 3)})
+
+	// A pick sticks until that player is knocked out.
+	state = battleOf(NO_TEAM, NO_TEAM, NO_TEAM)
+	state.Players[0].Target = 2
+	assert.Equal(t, 2, target(state.Players, 0))
+	state.Players[2].Life = 0
+	assert.Equal(t, 1, target(state.Players, 0))
+	// Once everyone's out, it's still someone.
+	state.Players[1].Life = 0
+	assert.Equal(t, 1, target(state.Players, 0))
+
+	// Nobody to fight.
+	assert.Equal(t, NO_TARGET, target(battleOf(1, 1).Players, 0))
+}
+
+func TestChooseTarget(t *testing.T) {
+	state := battleOf(1, 1, 2, 2)
+	state.Players[2].Life = 0
+	// Not yourself, a teammate, someone who's out or someone who isn't there.
+	for _, bad := range []int{0, 1, 2, 4, -1} {
+		chooseTarget(state.Players, 0, bad)
+		assert.Equal(t, NO_TARGET, state.Players[0].Target, "%d", bad)
+	}
+	chooseTarget(state.Players, 0, 3)
+	assert.Equal(t, 3, state.Players[0].Target)
+
+	// Not in the middle of an attack.
+	state = battleOf(NO_TEAM, NO_TEAM, NO_TEAM)
+	state.Players[0].SetState("heavy attack", 10)
+	chooseTarget(state.Players, 0, 2)
+	assert.Equal(t, NO_TARGET, state.Players[0].Target)
+}
+
+func TestOutcome(t *testing.T) {
+	// Free-for-all: last one standing.
+	state := battleOf(NO_TEAM, NO_TEAM, NO_TEAM)
+	state.Players[0].Life = 0
+	assert.False(t, state.Over())
+	state.Players[2].Life = 0
+	assert.True(t, state.Over())
+	assert.Equal(t, []string{"loss", "win", "loss"}, []string{state.Outcome(0), state.Outcome(1), state.Outcome(2)})
+
+	// Teams: a knocked out player still wins if their teammate does.
+	state = battleOf(1, 1, 2, 2)
+	state.Players[0].Life = 0
+	state.Players[2].Life = 0
+	assert.False(t, state.Over())
+	state.Players[3].Life = 0
+	assert.True(t, state.Over())
+	assert.Equal(t, []string{"win", "win", "loss", "loss"},
+		[]string{state.Outcome(0), state.Outcome(1), state.Outcome(2), state.Outcome(3)})
+
+	// Nobody left.
+	state = battleOf(NO_TEAM, NO_TEAM)
+	state.Players[0].Life = 0
+	state.Players[1].Life = 0
+	assert.Equal(t, "draw", state.Outcome(0))
+}
+
+func TestMultiplayerStep(t *testing.T) {
+	state := battleOf(NO_TEAM, NO_TEAM, NO_TEAM)
+	// Picking a target doesn't let go of a held block.
+	state = Step(state, []TickInput{{Player: 0, Command: "BLOCK"}, {Player: 0, Command: "TARGET", Target: 2}})
+	assert.Equal(t, "blocking", state.Players[0].State)
+	assert.Equal(t, 2, state.Players[0].Target)
+
+	// Attacks land on the target.
+	state = Step(state, []TickInput{{Player: 0, Command: "LIGHT"}})
+	for state.Players[0].State == "light attack" {
+		state = Step(state, nil)
+	}
+	assert.Equal(t, 100, state.Players[1].Life)
+	assert.Equal(t, 100-LIGHT_ATK_DMG, state.Players[2].Life)
+
+	// Players who are out don't do anything.
+	state.Players[1].Life = 0
+	state.Players[1].Command = "LIGHT"
+	state = Step(state, nil)
+	assert.Equal(t, "standing", state.Players[1].State)
+}
+
+func TestBindTarget(t *testing.T) {
+	// Player 1 counters player 0 while targeting player 2, and the counterattack still lands on player 0.
+	state := battleOf(NO_TEAM, NO_TEAM, NO_TEAM)
+	state.Players[1].Target = 2
+	state = Step(state, []TickInput{{Player: 0, Command: "LIGHT"}, {Player: 1, Command: "BLOCK"}})
+	for state.Players[1].State != "counterattack" {
+		state = Step(state, nil)
+	}
+	assert.Equal(t, "countered", state.Players[0].State)
+	assert.Equal(t, 0, state.Players[1].Target)
+	for state.Players[1].State == "counterattack" {
+		state = Step(state, nil)
+	}
+	assert.Equal(t, 100-LIGHT_ATK_CNTR_DMG, state.Players[0].Life)
+	assert.Equal(t, 100, state.Players[2].Life)
+}
+
+func TestUpdateFor(t *testing.T) {
+	// Duels don't have a combatants list.
+	duel := battleOf(NO_TEAM, NO_TEAM)
+	assert.Nil(t, duel.UpdateFor(0, nil).Combatants)
+
+	state := battleOf(NO_TEAM, NO_TEAM, NO_TEAM)
+	state.Players[1].Name = "bob"
+	state.Players[0].Target = 2
+	state.Players[2].Life = 50
+	update := state.UpdateFor(1, nil)
+	assert.Equal(t, 50, update.Enemy.Life)
+	assert.Equal(t, Combatant{Name: "bob", Archetype: DEFAULT_ARCHETYPE, Team: NO_TEAM, Target: 2, Self: true,
+		Status: state.Players[1].Status()}, update.Combatants[1])
+	assert.Equal(t, 2, update.Combatants[0].Target)
+	assert.False(t, update.Combatants[0].Self)
+	assert.Equal(t, "", update.Outcome)
+
+	// The last update says how it ended.
+	state.Players[0].Life = 0
+	state.Players[2].Life = 0
+	assert.Equal(t, "win", state.UpdateFor(1, nil).Outcome)
+	assert.Equal(t, "loss", NewResult(state.UpdateFor(2, nil)).Outcome)
+}
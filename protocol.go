@@ -0,0 +1,305 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file defines the wire protocol between the client and the server. Every message in either direction
+// is an Envelope whose Type says which payload struct is inside it. The first thing a client sends is a hello
+// with the protocol version it speaks, and the server answers with a welcome (or an error, if it can't talk to
+// that client at all).
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// PROTOCOL_VERSION is the newest version this server speaks. Clients asking for a newer one are downgraded to it.
+	PROTOCOL_VERSION = 15
+	// MIN_PROTOCOL_VERSION is the oldest version that can be asked for in a hello. Anything older is rejected.
+	MIN_PROTOCOL_VERSION = 1
+	// LEGACY_PROTOCOL_VERSION is what we call the original format, from before envelopes existed, where Messages
+	// and Updates were written to the socket directly. Clients that never send a hello are assumed to speak it.
+	LEGACY_PROTOCOL_VERSION = 0
+)
+
+// These are the values of Envelope.Type.
+const (
+	// Client to server only.
+	MSG_HELLO = "hello"
+	MSG_INPUT = "input"
+	// Server to client only.
+	MSG_WELCOME = "welcome"
+	MSG_UPDATE  = "update"
+	MSG_DELTA   = "delta"
+	MSG_ERROR   = "error"
+	MSG_RESULT  = "result"
+	// Both directions.
+	MSG_CHAT    = "chat"
+	MSG_COMMAND = "command"
+)
+
+// Envelope wraps every message sent over the websocket. Payload is decoded according to Type.
+type Envelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"v"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// outboundEnvelope is what the server actually writes. It's the same as Envelope on the wire, but the payload
+// gets marshaled along with the envelope instead of separately.
+type outboundEnvelope struct {
+	Type    string      `json:"type"`
+	Version int         `json:"v"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// HelloPayload is the first message a client sends, announcing the protocol version it speaks and the encodings
+// it can take battle traffic in, best first. JSON is always assumed to be among them.
+type HelloPayload struct {
+	Version   int      `json:"version"`
+	Encodings []string `json:"encodings,omitempty"`
+}
+
+// WelcomePayload answers a hello with the version and battle encoding the server picked for the connection. It
+// also says how many ticks per second battles run at, so the client can stamp its inputs.
+type WelcomePayload struct {
+	Version  int    `json:"version"`
+	Encoding string `json:"encoding"`
+	TickRate int    `json:"tickRate"`
+}
+
+// Protocol is what was agreed on with a client in the handshake.
+type Protocol struct {
+	Version  int
+	Encoding string
+}
+
+// ChatPayload is a lobby chat line. The client leaves Username blank; the server fills it in when broadcasting.
+type ChatPayload struct {
+	Username string `json:"username,omitempty"`
+	Text     string `json:"text"`
+}
+
+// CommandPayload is a lobby command, like READY or BOT MATCH, or START GAME coming from the server. TARGET and
+// FORFEIT are the only commands sent during battle. CHALLENGE goes to the challenged user too, with the
+// challenger's name.
+type CommandPayload struct {
+	Command string `json:"command"`
+	// Whatever the command needs: the name for SETNAME, the archetype for ARCHETYPE, the mode to queue for with
+	// READY, the bot for BOT MATCH, the other user's name for CHALLENGE and ACCEPT, the name to ignore or stop
+	// ignoring for IGNORE and UNIGNORE, the ticket for JOIN, the enemy's name for START GAME, and the index of the
+	// combatant to attack for TARGET.
+	Arg string `json:"arg,omitempty"`
+	// The bot's archetype for BOT MATCH, and the enemy's for START GAME.
+	Archetype string `json:"archetype,omitempty"`
+	// The sender's handicap and the other side's for CHALLENGE and BOT MATCH, and the receiver's and the enemy's
+	// when the server sends CHALLENGE or START GAME (see handicap.go).
+	Handicap      *Handicap `json:"handicap,omitempty"`
+	EnemyHandicap *Handicap `json:"enemyHandicap,omitempty"`
+	// Only in a START GAME for a battle on a worker: the client connects to Server and sends JOIN with the
+	// Ticket, and the battle happens on that connection instead (see worker.go).
+	Server string `json:"server,omitempty"`
+	Ticket string `json:"ticket,omitempty"`
+}
+
+// InputPayload is a battle input, like LIGHT or INTERRUPT_UP. Tick is the client's best guess at what tick the
+// server was on when the input was made, which is used for lag compensation. Seq is a number the
+// client picks for the input; the server will say which tick used it in the acks of a later update. Both can be
+// left out.
+type InputPayload struct {
+	Input string `json:"input"`
+	Tick  int    `json:"tick,omitempty"`
+	Seq   int    `json:"seq,omitempty"`
+}
+
+// ErrorPayload tells the client the server couldn't do what it asked.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes used in ErrorPayload.
+const (
+	ERR_BAD_VERSION = "bad version"
+	ERR_BAD_MESSAGE = "bad message"
+	ERR_MAINTENANCE = "maintenance"
+	ERR_MUTED       = "muted"
+)
+
+// ResultPayload is sent to each player once their battle is over. The update payload is just an Update, and the
+// delta payload is an UpdateDelta (see delta.go).
+type ResultPayload struct {
+	// Outcome is "win", "loss", "draw" or OUTCOME_NO_CONTEST.
+	Outcome   string `json:"outcome"`
+	Life      int    `json:"life"`
+	EnemyLife int    `json:"enemyLife"`
+	// Rated is false for bot matches and battles with handicaps.
+	Rated bool `json:"rated"`
+}
+
+// NewResult builds the ResultPayload for a player from the last Update they got. If the battle didn't say how it
+// ended, it's worked out as if it was a duel.
+func NewResult(update Update) ResultPayload {
+	outcome := update.Outcome
+	if outcome == "" {
+		outcome = "draw"
+		if update.Self.Life > 0 && update.Enemy.Life <= 0 {
+			outcome = "win"
+		} else if update.Self.Life <= 0 && update.Enemy.Life > 0 {
+			outcome = "loss"
+		}
+	}
+	return ResultPayload{Outcome: outcome, Life: update.Self.Life, EnemyLife: update.Enemy.Life}
+}
+
+// negotiateVersion picks the version to speak with a client whose hello asked for the given one.
+func negotiateVersion(requested int) (int, error) {
+	if requested < MIN_PROTOCOL_VERSION {
+		return 0, errors.Errorf("protocol version %d is not supported (need at least %d)", requested, MIN_PROTOCOL_VERSION)
+	}
+	if requested > PROTOCOL_VERSION {
+		return PROTOCOL_VERSION, nil
+	}
+	return requested, nil
+}
+
+// negotiateEncoding picks the first encoding the client offered that we can use at the given version.
+func negotiateEncoding(version int, offered []string) string {
+	for _, encoding := range offered {
+		if encoding == ENCODING_BINARY && version >= BINARY_PROTOCOL_VERSION {
+			return ENCODING_BINARY
+		}
+		if encoding == ENCODING_JSON {
+			return ENCODING_JSON
+		}
+	}
+	return ENCODING_JSON
+}
+
+// handshake looks at the first thing a client sent and decides what protocol to speak with it. Legacy clients
+// don't send a hello, so in that case the data is a normal Message that still has to be handled; it's returned
+// as pending. reply is what to send back, and if err is set the connection should be closed after sending it.
+func handshake(data []byte) (proto Protocol, pending *Message, reply interface{}, err error) {
+	proto.Encoding = ENCODING_JSON
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return proto, nil, ErrorPayload{ERR_BAD_MESSAGE, "first message isn't valid JSON"}, errors.Wrap(err, "when reading hello")
+	}
+	if env.Type == "" {
+		msg, err := decodeInbound(LEGACY_PROTOCOL_VERSION, data)
+		if err != nil {
+			return proto, nil, nil, err
+		}
+		proto.Version = LEGACY_PROTOCOL_VERSION
+		return proto, &msg, nil, nil
+	}
+	if env.Type != MSG_HELLO {
+		return proto, nil, ErrorPayload{ERR_BAD_MESSAGE, "expected hello, got " + env.Type}, errors.New("client didn't start with hello")
+	}
+	var hello HelloPayload
+	if err := json.Unmarshal(env.Payload, &hello); err != nil {
+		return proto, nil, ErrorPayload{ERR_BAD_MESSAGE, "malformed hello"}, errors.Wrap(err, "when decoding hello")
+	}
+	proto.Version, err = negotiateVersion(hello.Version)
+	if err != nil {
+		return proto, nil, ErrorPayload{ERR_BAD_VERSION, err.Error()}, err
+	}
+	proto.Encoding = negotiateEncoding(proto.Version, hello.Encodings)
+	return proto, nil, WelcomePayload{Version: proto.Version, Encoding: proto.Encoding, TickRate: TickRate}, nil
+}
+
+// decodeInbound turns what a client sent into the Message the dispatcher works with.
+func decodeInbound(version int, data []byte) (Message, error) {
+	var msg Message
+	if version == LEGACY_PROTOCOL_VERSION {
+		err := json.Unmarshal(data, &msg)
+		return msg, errors.Wrap(err, "when decoding legacy message")
+	}
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return msg, errors.Wrap(err, "when decoding envelope")
+	}
+	switch env.Type {
+	case MSG_CHAT:
+		var chat ChatPayload
+		if err := json.Unmarshal(env.Payload, &chat); err != nil {
+			return msg, errors.Wrap(err, "when decoding chat payload")
+		}
+		msg.Username = chat.Username
+		msg.Content = chat.Text
+	case MSG_COMMAND:
+		var cmd CommandPayload
+		if err := json.Unmarshal(env.Payload, &cmd); err != nil {
+			return msg, errors.Wrap(err, "when decoding command payload")
+		}
+		msg.Command = cmd.Command
+		msg.Archetype = cmd.Archetype
+		msg.Handicap = cmd.Handicap
+		msg.EnemyHandicap = cmd.EnemyHandicap
+		// SETNAME is the one command that has always carried its argument in Username.
+		if cmd.Command == "SETNAME" {
+			msg.Username = cmd.Arg
+		} else {
+			msg.Content = cmd.Arg
+		}
+	case MSG_INPUT:
+		var input InputPayload
+		if err := json.Unmarshal(env.Payload, &input); err != nil {
+			return msg, errors.Wrap(err, "when decoding input payload")
+		}
+		msg.Content = input.Input
+		msg.Tick = input.Tick
+		msg.Seq = input.Seq
+	default:
+		return msg, errors.Errorf("unexpected message type %q", env.Type)
+	}
+	return msg, nil
+}
+
+// encodeOutbound converts something the server wants to send into the value that should be written to the
+// socket for a client on the given version. ok is false if that client has no way to understand it.
+func encodeOutbound(version int, msg interface{}) (out interface{}, ok bool, err error) {
+	if version == LEGACY_PROTOCOL_VERSION {
+		switch msg := msg.(type) {
+		case Message, Update:
+			return msg, true, nil
+		case ErrorPayload:
+			return Message{Username: "server", Content: msg.Message}, true, nil
+		default:
+			// Legacy clients work out the result from the last Update themselves.
+			return nil, false, nil
+		}
+	}
+	var msgType string
+	var payload interface{}
+	switch msg := msg.(type) {
+	case Message:
+		if msg.Command != "" {
+			command := CommandPayload{Command: msg.Command, Arg: msg.Content, Archetype: msg.Archetype,
+				Handicap: msg.Handicap, EnemyHandicap: msg.EnemyHandicap, Server: msg.Server, Ticket: msg.Ticket}
+			msgType, payload = MSG_COMMAND, command
+		} else {
+			msgType, payload = MSG_CHAT, ChatPayload{Username: msg.Username, Text: msg.Content}
+		}
+	case Update:
+		msgType, payload = MSG_UPDATE, msg
+	case UpdateDelta:
+		msgType, payload = MSG_DELTA, msg
+		if version < COMBATANT_DELTA_PROTOCOL_VERSION && msg.Combatants != nil {
+			payload = wholeCombatantsDelta{UpdateDelta: msg, Combatants: msg.all}
+		}
+	case ResultPayload:
+		msgType, payload = MSG_RESULT, msg
+	case ErrorPayload:
+		msgType, payload = MSG_ERROR, msg
+	case WelcomePayload:
+		msgType, payload = MSG_WELCOME, msg
+	default:
+		return nil, false, errors.Errorf("don't know how to send %T", msg)
+	}
+	return outboundEnvelope{Type: msgType, Version: version, Payload: payload}, true, nil
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// This pins down the JSON schema of every message type, so changing a field name by accident breaks the test
+// instead of the client.
+func TestEnvelopeSchema(t *testing.T) {
+	cases := []struct {
+		msg      interface{}
+		expected string
+	}{
+		{Message{Username: "bob", Content: "hi"},
+			`{"type":"chat","v":%d,"payload":{"username":"bob","text":"hi"}}`},
+		{Message{Content: "alice", Command: "START GAME"},
+			`{"type":"command","v":%d,"payload":{"command":"START GAME","arg":"alice"}}`},
+		{Message{Content: "alice", Command: "START GAME", Archetype: "Brute"},
+			`{"type":"command","v":%d,"payload":{"command":"START GAME","arg":"alice","archetype":"Brute"}}`},
+		{Update{Tick: 12, Self: PlayerStatus{Life: 100, Stamina: 90, State: "light attack", StateDuration: 50, Ping: 40},
+			Enemy: PlayerStatus{Life: 97, Stamina: 100, State: "blocking", StateDuration: -3, Ping: 80}},
+			`{"type":"update","v":%d,"payload":{"tick":12,"self":{"life":100,"stamina":90,"state":"light attack","stateDur":50,"ping":40,"exhausted":false,"regenDelay":0,"combo":0,"effects":{"bleed":0,"stagger":0,"guardCrush":0}},` +
+				`"enemy":{"life":97,"stamina":100,"state":"blocking","stateDur":-3,"ping":80,"exhausted":false,"regenDelay":0,"combo":0,"effects":{"bleed":0,"stagger":0,"guardCrush":0}}}}`},
+		{ResultPayload{Outcome: "win", Life: 12, EnemyLife: 0, Rated: true},
+			`{"type":"result","v":%d,"payload":{"outcome":"win","life":12,"enemyLife":0,"rated":true}}`},
+		{Message{Content: "alice", Command: "CHALLENGE", Handicap: &Handicap{Life: 150}, EnemyHandicap: &Handicap{}},
+			`{"type":"command","v":%d,"payload":{"command":"CHALLENGE","arg":"alice","handicap":{"life":150},"enemyHandicap":{}}}`},
+		{ErrorPayload{ERR_BAD_MESSAGE, "nope"},
+			`{"type":"error","v":%d,"payload":{"code":"bad message","message":"nope"}}`},
+		{WelcomePayload{Version: 4, Encoding: ENCODING_BINARY, TickRate: 60},
+			`{"type":"welcome","v":%d,"payload":{"version":4,"encoding":"binary","tickRate":60}}`},
+		{Update{Tick: 13, Self: PlayerStatus{State: "standing"}, Enemy: PlayerStatus{State: "standing"}, Acks: []InputAck{{Seq: 7, Tick: 12}}},
+			`{"type":"update","v":%d,"payload":{"tick":13,"self":{"life":0,"stamina":0,"state":"standing","stateDur":0,"ping":0,"exhausted":false,"regenDelay":0,"combo":0,"effects":{"bleed":0,"stagger":0,"guardCrush":0}},` +
+				`"enemy":{"life":0,"stamina":0,"state":"standing","stateDur":0,"ping":0,"exhausted":false,"regenDelay":0,"combo":0,"effects":{"bleed":0,"stagger":0,"guardCrush":0}},"acks":[{"seq":7,"tick":12}]}}`},
+	}
+	for _, c := range cases {
+		out, ok, err := encodeOutbound(PROTOCOL_VERSION, c.msg)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		data, err := json.Marshal(out)
+		assert.Nil(t, err)
+		assert.JSONEq(t, fmt.Sprintf(c.expected, PROTOCOL_VERSION), string(data))
+	}
+}
+
+func TestDecodeInbound(t *testing.T) {
+	cases := []struct {
+		data     string
+		expected Message
+	}{
+		{`{"type":"chat","v":4,"payload":{"username":"bob","text":"hi"}}`, Message{Username: "bob", Content: "hi"}},
+		{`{"type":"command","v":4,"payload":{"command":"SETNAME","arg":"bob"}}`, Message{Username: "bob", Command: "SETNAME"}},
+		{`{"type":"command","v":4,"payload":{"command":"BOT MATCH","arg":"AttackBot"}}`, Message{Content: "AttackBot", Command: "BOT MATCH"}},
+		{`{"type":"command","v":4,"payload":{"command":"BOT MATCH","arg":"AttackBot","archetype":"Duelist"}}`,
+			Message{Content: "AttackBot", Command: "BOT MATCH", Archetype: "Duelist"}},
+		{`{"type":"command","v":4,"payload":{"command":"ARCHETYPE","arg":"Brute"}}`, Message{Content: "Brute", Command: "ARCHETYPE"}},
+		{`{"type":"command","v":4,"payload":{"command":"READY"}}`, Message{Command: "READY"}},
+		{`{"type":"command","v":9,"payload":{"command":"READY","arg":"ffa"}}`, Message{Command: "READY", Content: "ffa"}},
+		{`{"type":"command","v":9,"payload":{"command":"TARGET","arg":"2"}}`, Message{Command: "TARGET", Content: "2"}},
+		{`{"type":"command","v":10,"payload":{"command":"CHALLENGE","arg":"bob","enemyHandicap":{"damageMult":0.5,"counterWindow":10}}}`,
+			Message{Command: "CHALLENGE", Content: "bob", EnemyHandicap: &Handicap{DamageMult: 0.5, CounterWindow: 10}}},
+		{`{"type":"input","v":4,"payload":{"input":"LIGHT"}}`, Message{Content: "LIGHT"}},
+		{`{"type":"input","v":4,"payload":{"input":"BLOCK","tick":300}}`, Message{Content: "BLOCK", Tick: 300}},
+		{`{"type":"input","v":5,"payload":{"input":"HEAVY","tick":300,"seq":12}}`, Message{Content: "HEAVY", Tick: 300, Seq: 12}},
+	}
+	for _, c := range cases {
+		msg, err := decodeInbound(PROTOCOL_VERSION, []byte(c.data))
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, msg)
+	}
+
+	// Server-to-client types and garbage are refused.
+	_, err := decodeInbound(PROTOCOL_VERSION, []byte(`{"type":"update","v":4,"payload":{}}`))
+	assert.NotNil(t, err)
+	_, err = decodeInbound(PROTOCOL_VERSION, []byte(`not json`))
+	assert.NotNil(t, err)
+
+	// Legacy clients send Messages directly.
+	msg, err := decodeInbound(LEGACY_PROTOCOL_VERSION, []byte(`{"username":"bob","message":"LIGHT","command":""}`))
+	assert.Nil(t, err)
+	assert.Equal(t, Message{Username: "bob", Content: "LIGHT"}, msg)
+}
+
+func TestHandshake(t *testing.T) {
+	// An old client.
+	proto, pending, reply, err := handshake([]byte(`{"type":"hello","v":1,"payload":{"version":1}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, Protocol{1, ENCODING_JSON}, proto)
+	assert.Nil(t, pending)
+	assert.Equal(t, WelcomePayload{Version: 1, Encoding: ENCODING_JSON, TickRate: DEFAULT_TICK_RATE}, reply)
+
+	// A current client asking for binary.
+	current := fmt.Sprintf(`{"type":"hello","v":%d,"payload":{"version":%[1]d,"encodings":["binary","json"]}}`, PROTOCOL_VERSION)
+	proto, _, reply, err = handshake([]byte(current))
+	assert.Nil(t, err)
+	assert.Equal(t, Protocol{PROTOCOL_VERSION, ENCODING_BINARY}, proto)
+	assert.Equal(t, WelcomePayload{Version: PROTOCOL_VERSION, Encoding: ENCODING_BINARY, TickRate: DEFAULT_TICK_RATE}, reply)
+
+	// Binary can't be used on versions from before the current binary format.
+	old := fmt.Sprintf(`{"type":"hello","v":%d,"payload":{"version":%[1]d,"encodings":["binary","json"]}}`, BINARY_PROTOCOL_VERSION-1)
+	proto, _, _, err = handshake([]byte(old))
+	assert.Nil(t, err)
+	assert.Equal(t, Protocol{BINARY_PROTOCOL_VERSION - 1, ENCODING_JSON}, proto)
+
+	// A client from the future gets downgraded.
+	proto, _, reply, err = handshake([]byte(`{"type":"hello","v":99,"payload":{"version":99}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, PROTOCOL_VERSION, proto.Version)
+	assert.Equal(t, WelcomePayload{Version: PROTOCOL_VERSION, Encoding: ENCODING_JSON, TickRate: DEFAULT_TICK_RATE}, reply)
+
+	// A client that's too old is rejected.
+	_, _, reply, err = handshake([]byte(`{"type":"hello","v":0,"payload":{"version":0}}`))
+	assert.NotNil(t, err)
+	assert.Equal(t, ERR_BAD_VERSION, reply.(ErrorPayload).Code)
+
+	// Anything but a hello is rejected.
+	_, _, reply, err = handshake([]byte(`{"type":"chat","v":4,"payload":{"text":"hi"}}`))
+	assert.NotNil(t, err)
+	assert.Equal(t, ERR_BAD_MESSAGE, reply.(ErrorPayload).Code)
+
+	// A legacy client's first message is kept so it can still be handled.
+	proto, pending, reply, err = handshake([]byte(`{"username":"bob","message":"","command":"SETNAME"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, LEGACY_PROTOCOL_VERSION, proto.Version)
+	assert.Equal(t, &Message{Username: "bob", Command: "SETNAME"}, pending)
+	assert.Nil(t, reply)
+}
+
+func TestEncodeOutboundLegacy(t *testing.T) {
+	update := Update{Self: PlayerStatus{Life: 100, Stamina: 90, State: "standing", StateDuration: 0}, Enemy: PlayerStatus{Life: 100, Stamina: 90, State: "standing", StateDuration: 0}}
+	out, ok, err := encodeOutbound(LEGACY_PROTOCOL_VERSION, update)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, update, out)
+
+	// Results didn't exist in the legacy protocol.
+	_, ok, err = encodeOutbound(LEGACY_PROTOCOL_VERSION, ResultPayload{Outcome: "win"})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestNewResult(t *testing.T) {
+	assert.Equal(t, "win", NewResult(Update{Self: PlayerStatus{Life: 5}, Enemy: PlayerStatus{Life: -1}}).Outcome)
+	assert.Equal(t, "loss", NewResult(Update{Self: PlayerStatus{Life: 0}, Enemy: PlayerStatus{Life: 3}}).Outcome)
+	assert.Equal(t, "draw", NewResult(Update{Self: PlayerStatus{Life: 0}, Enemy: PlayerStatus{Life: 0}}).Outcome)
+	// In a team battle a knocked out player can still win, so the battle's word goes.
+	assert.Equal(t, "win", NewResult(Update{Self: PlayerStatus{Life: 0}, Enemy: PlayerStatus{Life: 0}, Outcome: "win"}).Outcome)
+}
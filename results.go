@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file keeps the results log, which has a line of JSON for every battle that ends, including the ones
+// called off when the server shuts down. Records are written by a goroutine of their own, so the dispatcher never
+// waits on the disk. Each one is written out as soon as it's taken, and the file is synced every
+// RESULTS_SYNC_INTERVAL and when the log is closed, so a crash loses at most the last second of them.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MatchRecord is what the results log says about a battle.
+type MatchRecord struct {
+	// The match's ID, which its log lines have too. IDs start over whenever the server restarts.
+	ID       uint64         `json:"id"`
+	Ended    time.Time      `json:"ended"`
+	Mode     string         `json:"mode"`
+	Rated    bool           `json:"rated"`
+	Seed     int64          `json:"seed"`
+	TickRate int            `json:"tickRate"`
+	Ticks    int            `json:"ticks"`
+	Players  []PlayerRecord `json:"players"`
+}
+
+// PlayerRecord is what the results log says about one player in a battle.
+type PlayerRecord struct {
+	Name      string   `json:"name"`
+	Archetype string   `json:"archetype"`
+	Team      int      `json:"team"`
+	Handicap  Handicap `json:"handicap"`
+	Outcome   string   `json:"outcome"`
+	Life      int      `json:"life"`
+}
+
+// NewMatchRecord builds the record of a finished battle from its last state.
+func NewMatchRecord(id uint64, mode string, rated, aborted bool, state BattleState) MatchRecord {
+	record := MatchRecord{ID: id, Ended: time.Now(), Mode: mode, Rated: rated, Seed: state.Seed,
+		TickRate: state.TickRate, Ticks: state.Tick, Players: make([]PlayerRecord, len(state.Players))}
+	for i, p := range state.Players {
+		outcome := OUTCOME_NO_CONTEST
+		if !aborted {
+			outcome = state.Outcome(i)
+		}
+		record.Players[i] = PlayerRecord{Name: p.Name, Archetype: p.Archetype.Name, Team: p.Team,
+			Handicap: p.Handicap, Outcome: outcome, Life: p.Life}
+	}
+	return record
+}
+
+// How many records can be waiting to be written before more are turned away.
+const RESULTS_QUEUE_SIZE = 256
+
+// How often the results log is synced to disk, if anything's been written since the last time.
+const RESULTS_SYNC_INTERVAL = time.Second
+
+// ResultLog appends MatchRecords to a file. Records can be added from any goroutine, but not after it's closed. A
+// nil ResultLog throws everything away.
+type ResultLog struct {
+	file    *os.File
+	records chan []byte
+	// Closed once the writer is done with the file, after which err says what went wrong closing it.
+	done chan struct{}
+	err  error
+}
+
+// OpenResultLog opens the results log at the given path, creating it if it isn't there yet, and starts writing
+// whatever is recorded to it.
+func OpenResultLog(path string) (*ResultLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "when opening results log")
+	}
+	l := &ResultLog{file: file, records: make(chan []byte, RESULTS_QUEUE_SIZE), done: make(chan struct{})}
+	go l.write()
+	return l, nil
+}
+
+// Record hands a battle to the log to be written. It never waits, so if the writer has fallen so far behind that
+// the queue is full, the record is dropped and an error is returned.
+func (l *ResultLog) Record(record MatchRecord) error {
+	if l == nil {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "when encoding match record")
+	}
+	select {
+	case l.records <- append(data, '\n'):
+		return nil
+	default:
+		return errors.New("the results log is too far behind")
+	}
+}
+
+// write writes the records as they come in, syncing every so often, until the log is closed.
+func (l *ResultLog) write() {
+	defer close(l.done)
+	ticker := time.NewTicker(RESULTS_SYNC_INTERVAL)
+	defer ticker.Stop()
+	dirty := false
+	sync := func() {
+		if dirty {
+			if err := l.file.Sync(); err != nil {
+				slog.Error("couldn't sync results log", "err", err)
+			}
+			dirty = false
+		}
+	}
+	for {
+		select {
+		case data, ok := <-l.records:
+			if !ok {
+				sync()
+				l.err = errors.Wrap(l.file.Close(), "when closing results log")
+				return
+			}
+			// Each record is written in one go, so a line is never split up.
+			if _, err := l.file.Write(data); err != nil {
+				slog.Error("couldn't write results log", "err", err)
+			}
+			dirty = true
+		case <-ticker.C:
+			sync()
+		}
+	}
+}
+
+// Close writes out whatever records are still waiting, syncs them to disk and closes the file.
+func (l *ResultLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	close(l.records)
+	<-l.done
+	return l.err
+}
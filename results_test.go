@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readResults returns every record in the results log at the given path.
+func readResults(t *testing.T, path string) []MatchRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []MatchRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record MatchRecord
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestNewMatchRecord(t *testing.T) {
+	players := []Player{NewPlayer(), NewPlayer()}
+	players[0].Name, players[1].Name = "a", "b"
+	players[1].Life = 0
+	players[1].SetHandicap(Handicap{DamageMult: 2})
+	state := BattleState{Tick: 300, TickRate: 60, Seed: 5, Players: players}
+	record := NewMatchRecord(7, "duel", false, false, state)
+	assert.Equal(t, uint64(7), record.ID)
+	assert.Equal(t, "duel", record.Mode)
+	assert.Equal(t, 300, record.Ticks)
+	assert.Equal(t, 60, record.TickRate)
+	assert.Equal(t, int64(5), record.Seed)
+	assert.Equal(t, PlayerRecord{Name: "a", Archetype: DEFAULT_ARCHETYPE, Outcome: "win", Life: 100}, record.Players[0])
+	assert.Equal(t, "loss", record.Players[1].Outcome)
+	assert.Equal(t, Handicap{DamageMult: 2}, record.Players[1].Handicap)
+	// A battle that was called off is a no-contest for everyone, however it was going.
+	record = NewMatchRecord(7, "duel", false, true, state)
+	assert.Equal(t, OUTCOME_NO_CONTEST, record.Players[0].Outcome)
+	assert.Equal(t, OUTCOME_NO_CONTEST, record.Players[1].Outcome)
+}
+
+func TestResultLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results")
+	log, err := OpenResultLog(path)
+	assert.Nil(t, err)
+	assert.Nil(t, log.Record(MatchRecord{Mode: "duel", Rated: true}))
+	assert.Nil(t, log.Close())
+	// Opening it again adds to what's there.
+	log, err = OpenResultLog(path)
+	assert.Nil(t, err)
+	assert.Nil(t, log.Record(MatchRecord{Mode: "bot"}))
+	// Records are written out soon after they're recorded, without waiting for the log to be closed.
+	waitFor(t, "the records to be written", func() bool { return len(readResults(t, path)) == 2 })
+	records := readResults(t, path)
+	assert.Equal(t, "duel", records[0].Mode)
+	assert.True(t, records[0].Rated)
+	assert.Equal(t, "bot", records[1].Mode)
+	// Closing the log writes out whatever's left.
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, log.Record(MatchRecord{Mode: "ffa"}))
+	}
+	assert.Nil(t, log.Close())
+	assert.Equal(t, 12, len(readResults(t, path)))
+
+	// Without a log, nothing happens.
+	log = nil
+	assert.Nil(t, log.Record(MatchRecord{}))
+	assert.Nil(t, log.Close())
+}
@@ -6,8 +6,19 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"flag"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
@@ -20,25 +31,131 @@ type Message struct {
 	Username string `json:"username"`
 	Content  string `json:"message"`
 	Command  string `json:"command"`
+	// For battle inputs, the tick the client was on when the input was made,
+	// and the client's number for the input.
+	Tick int `json:"tick,omitempty"`
+	Seq  int `json:"seq,omitempty"`
+	// The archetype a command is about: the bot's for BOT MATCH, and the enemy's for START GAME.
+	Archetype string `json:"archetype,omitempty"`
+	// The handicaps a command is about (see CommandPayload).
+	Handicap      *Handicap `json:"handicap,omitempty"`
+	EnemyHandicap *Handicap `json:"enemyHandicap,omitempty"`
+	// For a START GAME whose battle is on a worker, where to connect to it and the ticket to join it with (see
+	// workers.go).
+	Server string `json:"server,omitempty"`
+	Ticket string `json:"ticket,omitempty"`
 }
 
 // User is a connected player from the lobby server's perspective - it doesn't have any battle-specific fields.
-// The two channels are only used during battle.
 type User struct {
 	Name   string
 	Ready  bool
 	InGame bool
-	// The User's input during battle.
-	BattleInputChan chan Message
-	// The server's output to the user during battle.
-	BattleUpdateChan chan Update
+	// The match the user is in and which player they are in it, while InGame is set (see match.go).
+	Match *Match
+	Seat  int
+	// The user's connection latency, shared with their ConnInfo.
+	Latency *Latency
+	// Where to log things about the user. It's their ConnInfo's, plus their name once they have one.
+	Log *slog.Logger
+	// The archetype the user will fight as in their next battle.
+	Archetype *Archetype
+	// The mode the user is ready for and when they readied, so whoever's been waiting longest goes first.
+	Queue      string
+	ReadySince time.Time
+	// The last challenge someone sent the user, if they haven't answered it.
+	Challenge *Challenge
+	// Until when the user can't chat, because an admin muted them or they flooded the chat.
+	MutedUntil time.Time
+	// How fast the user has been chatting (see chat.go).
+	chat chatLimiter
+	// The names of the users whose chat the user doesn't want to see, in lower case.
+	Ignoring map[string]bool
+}
+
+// A Challenge is an invitation from one user to another to duel, with a handicap for each of them.
+type Challenge struct {
+	From *User
+	// The challenger's handicap and the challenged user's.
+	Handicap      Handicap
+	EnemyHandicap Handicap
 }
 
 // ConnInfo models the communication channel between a user's client and the
-// server.
+// server. The connection's goroutine closes Inbound and Done when the client goes away. Outbound and Updates are
+// never closed, since anyone might be sending on them; use Send and SendUpdate instead of sending on them directly.
+//
+// Outbound holds up to OUTBOUND_QUEUE_SIZE messages, so the dispatcher never waits on a slow client. A client that
+// falls so far behind that it fills up has Overflow closed, and its connection's goroutine disconnects it.
+// Battle updates and results come through Updates instead, because forwardUpdates can wait on them, and the
+// battle already only keeps the newest update for a client that's behind.
 type ConnInfo struct {
 	Inbound  chan Message
 	Outbound chan interface{}
+	Updates  chan interface{}
+	Done     chan struct{}
+	Overflow chan struct{}
+	overflow *sync.Once
+	// This is kept up to date by the connection's goroutine.
+	Latency *Latency
+	// The connection's ID, and where to log things about it, which says the ID (see logging.go).
+	ID  uint64
+	Log *slog.Logger
+	// The IP address the client is connecting from.
+	Addr string
+	// The protocol version the client speaks.
+	Version int
+}
+
+// How many messages can be waiting to be written to a client before it's disconnected.
+const OUTBOUND_QUEUE_SIZE = 64
+
+// newConnInfo makes the channels for a new connection.
+func newConnInfo(id uint64, log *slog.Logger, addr string) ConnInfo {
+	return ConnInfo{
+		Inbound:  make(chan Message),
+		Outbound: make(chan interface{}, OUTBOUND_QUEUE_SIZE),
+		Updates:  make(chan interface{}),
+		Done:     make(chan struct{}),
+		Overflow: make(chan struct{}),
+		overflow: new(sync.Once),
+		Latency:  &Latency{},
+		ID:       id,
+		Log:      log,
+		Addr:     addr,
+	}
+}
+
+// Send queues a message for the client's connection without waiting. It returns false without sending it if the
+// client is gone or its queue is full, and in the second case the client is disconnected.
+func (c *ConnInfo) Send(msg interface{}) bool {
+	select {
+	case <-c.Done:
+		return false
+	default:
+	}
+	select {
+	case c.Outbound <- msg:
+		return true
+	default:
+		c.overflow.Do(func() {
+			metricSlowClients.Inc()
+			c.Log.Warn("disconnecting client that fell behind", "queued", len(c.Outbound))
+			close(c.Overflow)
+		})
+		return false
+	}
+}
+
+// SendUpdate passes a battle update or result to the client's connection, waiting until it's taken. It returns
+// false without sending it if the client is gone.
+func (c *ConnInfo) SendUpdate(msg interface{}) bool {
+	select {
+	case c.Updates <- msg:
+		return true
+	case <-c.Done:
+		return false
+	}
 }
 
 // MessageInfo wraps a Message with a reference to the User that sent it.
@@ -47,19 +164,145 @@ type MessageInfo struct {
 	User    *User
 }
 
+// How long battles are given to finish when the server is shutting down, before they're called off.
+var DrainTimeout = time.Duration(DefaultConfig().DrainTimeout)
+
+// What users in the lobby are told when the server starts shutting down.
+const MAINTENANCE_NOTICE = "The server is going down for maintenance. No new battles can be started, " +
+	"but the ones already going will be allowed to finish."
+
+// The name of the results log in the data directory.
+const RESULTS_FILE = "results.jsonl"
+
 func main() {
+	config, err := LoadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fatal("bad configuration", err)
+	}
+	slog.SetDefault(newLogger(os.Stderr, config.LogFormat, config.LogLevel))
+	slog.Info("starting", "config", config)
+	TickRate, UpdateRate = config.TickRate, config.UpdateRate
+	if UpdateRate == 0 {
+		UpdateRate = TickRate
+	}
+	DrainTimeout = time.Duration(config.DrainTimeout)
+	LagCompensationLimit = time.Duration(config.LagCompensationLimit)
+	DefaultMode = config.DefaultMode
+	if config.BalanceFile != "" {
+		if ARCHETYPES, err = LoadBalance(config.BalanceFile); err != nil {
+			fatal("couldn't load balance file", err)
+		}
+	}
+	if config.WordFilter != "" {
+		if ChatFilter, err = LoadWordFilter(config.WordFilter); err != nil {
+			fatal("couldn't load word filter", err)
+		}
+	}
+	var results *ResultLog
+	auditPath := ""
+	if config.DataDir != "" {
+		if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+			fatal("couldn't create data directory", err)
+		}
+		if results, err = OpenResultLog(filepath.Join(config.DataDir, RESULTS_FILE)); err != nil {
+			fatal("couldn't open results log", err)
+		}
+		auditPath = filepath.Join(config.DataDir, AUDIT_FILE)
+	}
+	// SIGTERM or ^C starts a graceful shutdown. A second one kills the server right away, since the context stops
+	// catching them.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
 	// When new clients arrive, their IO channels will be sent through here.
 	var newClients = make(chan ConnInfo)
-	go dispatcher(newClients)
-	fs := http.FileServer(http.Dir("./"))
+	fs := http.FileServer(http.Dir(config.StaticDir))
 	http.Handle("/", fs)
 	// handleConnection actually returns an anonymous function that handles connections.
-	http.Handle("/ws", handleConnection(newClients))
-	port := ":8000"
-	log.Println("http server starting on port", port)
-	err := http.ListenAndServe(port, nil)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+	http.Handle("/ws", handleConnection(newClients, config.Origins))
+	// A lobby with a worker token takes workers.
+	if config.WorkerToken != "" && config.Lobby == "" {
+		Workers = newWorkerPool()
+		http.Handle("/workers", handleWorkers(Workers, config.WorkerToken))
+	}
+	server := &http.Server{Addr: config.Listen}
+	if config.SelfSigned {
+		cert, err := selfSignedCert()
+		if err != nil {
+			fatal("couldn't make self-signed certificate", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		slog.Warn("serving HTTPS with a self-signed certificate; browsers will warn about it")
+	}
+	go func() {
+		slog.Info("http server starting", "addr", config.Listen)
+		var err error
+		if config.TLSCert != "" || config.SelfSigned {
+			// The self-signed certificate is already in the TLS config, so the file names are left blank.
+			err = server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			fatal("http server failed", err)
+		}
+	}()
+	// The admin API has its own server, so it can't be reached from outside.
+	adminCommands := make(chan adminCommand)
+	var adminServer *http.Server
+	if config.AdminListen != "" {
+		audit, err := OpenAuditLog(auditPath)
+		if err != nil {
+			fatal("couldn't open audit log", err)
+		}
+		defer audit.Close()
+		adminServer = &http.Server{Addr: config.AdminListen,
+			Handler: adminHandler(adminCommands, config.AdminToken, config.BalanceFile, audit)}
+		go func() {
+			slog.Info("admin server starting", "addr", config.AdminListen)
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				fatal("admin server failed", err)
+			}
+		}()
+	}
+	// The metrics have their own server too, so they can be kept away from the players.
+	var metricsServer *http.Server
+	if config.MetricsListen != "" {
+		metricsServer = &http.Server{Addr: config.MetricsListen, Handler: metricsHandler(config.MetricsToken)}
+		go func() {
+			slog.Info("metrics server starting", "addr", config.MetricsListen)
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				fatal("metrics server failed", err)
+			}
+		}()
+	}
+	// The dispatcher, or a worker, returns once the server is shutting down and there are no battles left.
+	if config.Lobby != "" {
+		if err := runWorker(ctx, newClients, config.Lobby, config.PublicURL, config.WorkerToken); err != nil {
+			fatal("stopped running battles", err)
+		}
+	} else {
+		dispatcher(ctx, newClients, adminCommands, results)
+	}
+	stop()
+	slog.Info("all battles are over; shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("couldn't shut down http server", "err", err)
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("couldn't shut down admin server", "err", err)
+		}
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("couldn't shut down metrics server", "err", err)
+		}
+	}
+	if err := results.Close(); err != nil {
+		slog.Error("couldn't save results log", "err", err)
 	}
 }
 
@@ -67,20 +310,99 @@ func main() {
 // high-level message passing. It alone has the list of all connected clients,
 // so no mutex is needed. Because it only takes in ConnInfos, it doesn't care
 // how the clients are connected.
-func dispatcher(newClients <-chan ConnInfo) {
+//
+// When ctx is canceled, the server starts draining: no new battles are started, and the dispatcher returns once
+// the ones already going are over, calling off any that are still going after DrainTimeout. Every battle that
+// ends is recorded in results. Admin actions come in through admin (see admin.go).
+func dispatcher(ctx context.Context, newClients <-chan ConnInfo, admin <-chan adminCommand, results *ResultLog) {
 	// The list of clients never leaves this scope.
 	var clients = make(map[*ConnInfo]*User)
 	// All incoming messages will be merged into this channel.
 	var messages = make(chan MessageInfo)
 	// This is used for clients that disconnect, so they can be removed.
 	var leaving = make(chan *ConnInfo)
+	// The battles that are going on.
+	live := newLiveMatches()
+	// Who admins have banned.
+	var banned bans
+	// Matches that can start with fewer players than they could have only do once someone's waited long enough,
+	// so the matchmaker has to check every so often as well as whenever someone readies. The lobby's metrics are
+	// brought up to date then too, instead of every time a message comes through, since counting the queues means
+	// going through everyone who's connected.
+	matchTicker := time.NewTicker(time.Second)
+	defer matchTicker.Stop()
+	// These are set once the server starts draining. The shutdown channel is cleared so it only fires once.
+	shutdown := ctx.Done()
+	draining := false
+	var deadline <-chan time.Time
 	for {
 		select {
+		case <-matchTicker.C:
+			recordLobbyMetrics(clients, live)
+			if !draining {
+				matchmaker(clients, live)
+			}
+
+		case <-shutdown:
+			slog.Info("draining before shutting down", "battles", len(live.matches))
+			shutdown = nil
+			draining = true
+			deadline = time.After(DrainTimeout)
+			for conn, user := range clients {
+				user.Ready = false
+				conn.Send(Message{Username: "server", Content: MAINTENANCE_NOTICE})
+			}
+			if len(live.matches) == 0 {
+				return
+			}
+
+		// Battles that are still going when time's up are called off, and show up below when they've stopped.
+		case <-deadline:
+			slog.Warn("calling off battles that didn't finish in time", "battles", len(live.matches))
+			for match := range live.matches {
+				match.Log.Info("calling off battle for shutdown")
+				match.Abort()
+			}
+
+		// A worker has answered whether it'll take a battle it was offered.
+		case reply := <-Workers.Replies():
+			handedOff(live, reply)
+
+		case cmd := <-admin:
+			result, err := handleAdmin(cmd, clients, live, &banned)
+			cmd.Reply <- adminReply{Result: result, Err: err}
+
+		case match := <-live.finished:
+			info := live.matches[match]
+			delete(live.matches, match)
+			state, aborted := match.Result()
+			if aborted {
+				metricBattlesFinished.Inc(info.Mode, "no_contest")
+			} else {
+				metricBattlesFinished.Inc(info.Mode, "completed")
+			}
+			if err := results.Record(NewMatchRecord(match.ID, info.Mode, info.Rated, aborted, state)); err != nil {
+				match.Log.Error("couldn't record result", "err", err)
+			}
+			if draining && len(live.matches) == 0 {
+				return
+			}
+
 		// When a new connection is established.
 		case newConn := <-newClients:
 			// Add them to the list.
-			user := User{"", false, false, make(chan Message), make(chan Update)}
+			user := User{
+				Latency:   newConn.Latency,
+				Archetype: getArchetypeByName(DEFAULT_ARCHETYPE),
+				Log:       newConn.Log,
+			}
 			clients[&newConn] = &user
+			if ban := banned.check("", newConn.Addr); ban != nil {
+				newConn.Log.Info("banned address tried to connect", "addr", newConn.Addr)
+				newConn.Send(kick{Reason: ban.reason()})
+			} else if draining {
+				newConn.Send(Message{Username: "server", Content: MAINTENANCE_NOTICE})
+			}
 
 			// Merge their Messages ino the single messages channel.
 			go func(sink chan<- MessageInfo, conn *ConnInfo, user *User,
@@ -94,8 +416,12 @@ func dispatcher(newClients <-chan ConnInfo) {
 				leaving <- conn
 			}(messages, &newConn, &user, leaving)
 
-		// Delete clients when they disconnect.
+		// Delete clients when they disconnect. Leaving in the middle of a battle counts as giving up.
 		case oldConn := <-leaving:
+			if user := clients[oldConn]; user.InGame {
+				user.Log.Info("left during battle", "match", user.Match.ID)
+				user.Match.Forfeit(user.Seat)
+			}
 			delete(clients, oldConn)
 
 		// When a Message is received from anyone.
@@ -104,139 +430,499 @@ func dispatcher(newClients <-chan ConnInfo) {
 			if msg.User.InGame {
 				if msg.Message.Command == "END MATCH" {
 					msg.User.InGame = false
+					msg.User.Match = nil
 				} else {
-					msg.User.BattleInputChan <- msg.Message
+					msg.User.Match.Input(msg.User.Seat, msg.Message)
 				}
 
 				// Handle lobby command messages.
 			} else if msg.Message.Command != "" {
+				// Nothing that would start a battle is allowed while the server is draining.
+				switch msg.Message.Command {
+				case "READY", "CHALLENGE", "ACCEPT", "BOT MATCH":
+					if draining {
+						connOf(clients, msg.User).Send(ErrorPayload{Code: ERR_MAINTENANCE,
+							Message: "the server is shutting down for maintenance"})
+						continue
+					}
+				}
 				switch msg.Message.Command {
 				case "READY":
+					mode := getModeByName(msg.Message.Content)
+					if mode == nil {
+						msg.User.Log.Warn("unrecognized mode", "mode", msg.Message.Content)
+						break
+					}
 					msg.User.Ready = true
+					msg.User.Queue = mode.Name
+					msg.User.ReadySince = time.Now()
 					// Try to start a match.
-					matchmaker(clients)
+					matchmaker(clients, live)
 				case "UNREADY":
 					msg.User.Ready = false
 				case "SETNAME":
+					msg.User.Log.Info("set name", "name", msg.Message.Username)
 					msg.User.Name = msg.Message.Username
-				case "BOT MATCH":
-					// Find the ConnInfo in the clients map, because msg.User doesn't contain it.
-					var conn *ConnInfo
-					for conn = range clients {
-						if clients[conn] == msg.User {
-							break
-						}
+					// Everything logged about the user from now on says who they are.
+					conn := connOf(clients, msg.User)
+					msg.User.Log = conn.Log.With("user", msg.User.Name)
+					if ban := banned.check(msg.User.Name, ""); ban != nil {
+						msg.User.Log.Info("banned name tried to connect")
+						conn.Send(kick{Reason: ban.reason()})
 					}
-					msg.User.Ready = false
-					msg.User.InGame = true
-					botInputChan := make(chan Message)
-					botUpdateChan := make(chan Update)
-					conn.Outbound <- Message{Username: "", Content: msg.Message.Content, Command: "START GAME"}
+				case "IGNORE", "UNIGNORE":
+					ignore(connOf(clients, msg.User), msg.User, msg.Message.Content, msg.Message.Command == "IGNORE")
+				case "ARCHETYPE":
+					if archetype := getArchetypeByName(msg.Message.Content); archetype != nil {
+						msg.User.Archetype = archetype
+					} else {
+						msg.User.Log.Warn("unrecognized archetype", "archetype", msg.Message.Content)
+					}
+				case "CHALLENGE":
+					conn := connOf(clients, msg.User)
+					opponent := connByName(clients, msg.Message.Content)
+					if opponent == nil || clients[opponent] == msg.User || clients[opponent].InGame {
+						conn.Send(ErrorPayload{Code: ERR_BAD_MESSAGE,
+							Message: "there's nobody called " + msg.Message.Content + " in the lobby"})
+						break
+					}
+					handicap, enemyHandicap, err := readHandicaps(msg.Message)
+					if err != nil {
+						conn.Send(ErrorPayload{Code: ERR_BAD_MESSAGE, Message: err.Error()})
+						break
+					}
+					// A new challenge replaces any the user hasn't answered yet.
+					clients[opponent].Challenge = &Challenge{From: msg.User, Handicap: handicap, EnemyHandicap: enemyHandicap}
+					opponent.Send(Message{Content: msg.User.Name, Command: "CHALLENGE",
+						Handicap: &enemyHandicap, EnemyHandicap: &handicap})
+				case "ACCEPT":
+					conn := connOf(clients, msg.User)
+					challenge := msg.User.Challenge
+					msg.User.Challenge = nil
+					// The challenger might have left or started another battle since.
+					var challenger *ConnInfo
+					if challenge != nil && challenge.From.Name == msg.Message.Content {
+						challenger = connOf(clients, challenge.From)
+					}
+					if challenger == nil || challenge.From.InGame {
+						conn.Send(ErrorPayload{Code: ERR_BAD_MESSAGE,
+							Message: "the challenge from " + msg.Message.Content + " isn't open any more"})
+						break
+					}
+					startMatch(clients, live, []*ConnInfo{challenger, conn}, getModeByName("duel"),
+						[]Handicap{challenge.Handicap, challenge.EnemyHandicap})
+				case "BOT MATCH":
+					conn := connOf(clients, msg.User)
 					botFunction := getBotByName(msg.Message.Content)
 					if botFunction == nil {
-						log.Println("unrecognized bot", msg.Message.Content)
-					} else {
-						go botFunction(botInputChan, botUpdateChan)
-						go battle(msg.User.BattleInputChan, botInputChan, msg.User.BattleUpdateChan, botUpdateChan)
-						go forwardUpdates(conn.Outbound, msg.User.BattleUpdateChan)
+						msg.User.Log.Warn("unrecognized bot", "bot", msg.Message.Content)
+						break
+					}
+					handicap, botHandicap, err := readHandicaps(msg.Message)
+					if err != nil {
+						conn.Send(ErrorPayload{Code: ERR_BAD_MESSAGE, Message: err.Error()})
+						break
+					}
+					// Bots fight as the standard archetype unless asked otherwise.
+					botArchetype := getArchetypeByName(msg.Message.Archetype)
+					if botArchetype == nil {
+						botArchetype = getArchetypeByName(DEFAULT_ARCHETYPE)
 					}
+					start := Message{Username: "", Content: msg.Message.Content, Command: "START GAME", Archetype: botArchetype.Name}
+					if handicap != (Handicap{}) || botHandicap != (Handicap{}) {
+						start.Handicap, start.EnemyHandicap = &handicap, &botHandicap
+					}
+					conn.Send(start)
+					player := NewPlayer()
+					player.Name = msg.User.Name
+					player.Latency = msg.User.Latency
+					player.SetArchetype(msg.User.Archetype)
+					player.SetHandicap(handicap)
+					bot := NewPlayer()
+					bot.Name = msg.Message.Content
+					bot.SetArchetype(botArchetype)
+					bot.SetHandicap(botHandicap)
+					match := NewMatch(context.Background(), []Player{player, bot})
+					msg.User.Ready = false
+					msg.User.InGame = true
+					msg.User.Match, msg.User.Seat = match, 0
+					match.Log.Info("battle starting", "mode", "bot", "players", []string{player.Name, bot.Name},
+						"conns", []uint64{conn.ID})
+					go runBot(bot.Name, botFunction, match, 1, botArchetype)
+					match.Start()
+					live.add(match, liveMatch{Mode: "bot", Players: []string{player.Name, bot.Name}, Started: time.Now()})
+					metricBattlesStarted.Inc("bot")
+					metricBotMatches.Inc(msg.Message.Content)
+					// Bot matches are never rated.
+					go forwardUpdates(conn, match.Updates(0), false)
 				default:
-					log.Println("got unexpected command message", msg.Message.Command, "from user", msg.Message.Username)
+					msg.User.Log.Warn("unexpected command", "command", msg.Message.Command)
 				}
 				// Handle lobby chat messages.
 			} else {
-				for conn := range clients {
-					conn.Outbound <- msg.Message
-				}
+				handleChat(clients, msg)
+			}
+		}
+	}
+}
+
+// This function is called whenever a new player readies for battle, and every so often in case someone has
+// waited long enough for a smaller match. It starts whatever matches it can, putting whoever has been waiting
+// longest in first.
+func matchmaker(clients map[*ConnInfo]*User, live *liveMatches) {
+	for m := range MODES {
+		mode := &MODES[m]
+		queue := make([]*ConnInfo, 0)
+		for socket, user := range clients {
+			if user.Ready && user.Queue == mode.Name {
+				queue = append(queue, socket)
+			}
+		}
+		sort.Slice(queue, func(i, j int) bool {
+			return clients[queue[i]].ReadySince.Before(clients[queue[j]].ReadySince)
+		})
+		for len(queue) > 0 {
+			size := mode.matchSize(len(queue), time.Since(clients[queue[0]].ReadySince))
+			if size == 0 {
+				break
+			}
+			startMatch(clients, live, queue[:size], mode, nil)
+			queue = queue[size:]
+		}
+	}
+}
+
+// startMatch puts the given clients in a battle together. In a team mode, they're split into teams in order.
+// handicaps has one for each client, or is nil if nobody has one.
+func startMatch(clients map[*ConnInfo]*User, live *liveMatches, sockets []*ConnInfo, mode *Mode, handicaps []Handicap) {
+	players := make([]Player, len(sockets))
+	for i, socket := range sockets {
+		user := clients[socket]
+		players[i] = NewPlayer()
+		players[i].Name = user.Name
+		players[i].Latency = user.Latency
+		players[i].Team = mode.team(i)
+		players[i].SetArchetype(user.Archetype)
+		if handicaps != nil {
+			players[i].SetHandicap(handicaps[i])
+		}
+	}
+	rated := !handicapped(players)
+	match := NewMatch(context.Background(), players)
+	starts := make([]Message, len(sockets))
+	for i := range sockets {
+		// Everyone is told about whoever they'll be attacking first. In bigger battles they find out about
+		// the rest from their updates.
+		enemy := players[target(players, i)]
+		starts[i] = Message{Username: "", Content: enemy.Name, Command: "START GAME", Archetype: enemy.Archetype.Name}
+		if !rated {
+			starts[i].Handicap, starts[i].EnemyHandicap = &players[i].Handicap, &enemy.Handicap
+		}
+	}
+	names := make([]string, len(players))
+	conns := make([]uint64, len(sockets))
+	for i, socket := range sockets {
+		names[i], conns[i] = players[i].Name, socket.ID
+	}
+	match.Log.Info("battle starting", "mode", mode.Name, "players", names, "conns", conns, "rated", rated)
+	for i, socket := range sockets {
+		user := clients[socket]
+		user.Ready = false
+		user.InGame = true
+		user.Match, user.Seat = match, i
+		// For a battle on a worker, this is only the last update and the result.
+		go forwardUpdates(socket, match.Updates(i), rated)
+	}
+	info := liveMatch{Mode: mode.Name, Rated: rated, Players: names, Started: time.Now()}
+	// The battle goes to a worker if there is one, and everyone can be sent there. Then it doesn't start until
+	// the worker answers (see handedOff).
+	if worker := Workers.pick(); worker != nil && canHandOff(sockets) {
+		if tickets, err := worker.assign(match, mode.Name, rated); err != nil {
+			match.Log.Warn("couldn't give battle to worker; running it here", "worker", worker.URL, "err", err)
+		} else {
+			info.Worker = worker.URL
+			info.handoff = &handoff{sockets: sockets, starts: starts, tickets: tickets}
+		}
+	}
+	live.add(match, info)
+	metricBattlesStarted.Inc(mode.Name)
+	if info.handoff == nil {
+		beginMatch(match, sockets, starts)
+	}
+}
+
+// beginMatch tells everyone in a battle that it's starting, and starts it.
+func beginMatch(match *Match, sockets []*ConnInfo, starts []Message) {
+	for i, socket := range sockets {
+		socket.Send(starts[i])
+	}
+	match.Start()
+}
+
+// recordLobbyMetrics updates the metrics that say how many people are connected, waiting and fighting.
+func recordLobbyMetrics(clients map[*ConnInfo]*User, live *liveMatches) {
+	metricClients.Set(len(clients))
+	metricBattles.Set(len(live.matches))
+	for _, mode := range MODES {
+		queued := 0
+		for _, user := range clients {
+			if user.Ready && user.Queue == mode.Name {
+				queued++
 			}
 		}
+		metricQueued.Set(queued, mode.Name)
+	}
+}
+
+// liveMatches keeps track of the battles going on, so the dispatcher can record them when they end and knows
+// when it's safe to shut down. Only the dispatcher uses it.
+type liveMatches struct {
+	matches map[*Match]liveMatch
+	// Each match is sent here once it's over.
+	finished chan *Match
+}
+
+// liveMatch is what the results log and admins need to know about a battle that the battle itself doesn't.
+type liveMatch struct {
+	// The mode is "bot" for bot matches.
+	Mode    string
+	Rated   bool
+	Players []string
+	Started time.Time
+	// Where the battle is running, if it's on a worker.
+	Worker string
+	// What's needed to start the battle once the worker it was offered to answers, until then.
+	handoff *handoff
+}
+
+func newLiveMatches() *liveMatches {
+	return &liveMatches{matches: make(map[*Match]liveMatch), finished: make(chan *Match)}
+}
+
+// add starts keeping track of a match.
+func (l *liveMatches) add(match *Match, info liveMatch) {
+	l.matches[match] = info
+	go func() {
+		<-match.Done()
+		l.finished <- match
+	}()
+}
+
+// connOf finds the user's ConnInfo in the clients map, because the User doesn't contain it. It returns nil if the
+// user isn't connected any more.
+func connOf(clients map[*ConnInfo]*User, user *User) *ConnInfo {
+	for conn := range clients {
+		if clients[conn] == user {
+			return conn
+		}
 	}
+	return nil
 }
 
-// This function is called whenever a new player readies for battle.
-// If at least two people are ready, it matches two of them.
-func matchmaker(clients map[*ConnInfo]*User) {
-	readyUsers := make([]*ConnInfo, 0)
-	for socket, user := range clients {
-		if user.Ready == true {
-			readyUsers = append(readyUsers, socket)
+// connByName finds the ConnInfo of a user by their name, or returns nil if nobody has it.
+func connByName(clients map[*ConnInfo]*User, name string) *ConnInfo {
+	for conn, user := range clients {
+		if user.Name == name {
+			return conn
 		}
 	}
-	if len(readyUsers) >= 2 {
-		clients[readyUsers[0]].Ready = false
-		clients[readyUsers[0]].InGame = true
-		clients[readyUsers[1]].Ready = false
-		clients[readyUsers[1]].InGame = true
-		readyUsers[0].Outbound <- Message{Username: "", Content: clients[readyUsers[1]].Name, Command: "START GAME"}
-		readyUsers[1].Outbound <- Message{Username: "", Content: clients[readyUsers[0]].Name, Command: "START GAME"}
-		go battle(clients[readyUsers[0]].BattleInputChan, clients[readyUsers[1]].BattleInputChan, clients[readyUsers[0]].BattleUpdateChan, clients[readyUsers[1]].BattleUpdateChan)
-		go forwardUpdates(readyUsers[0].Outbound, clients[readyUsers[0]].BattleUpdateChan)
-		go forwardUpdates(readyUsers[1].Outbound, clients[readyUsers[1]].BattleUpdateChan)
+	return nil
+}
+
+// readHandicaps returns the handicaps in a CHALLENGE or BOT MATCH command, or an error if either is out of bounds.
+func readHandicaps(msg Message) (handicap, enemyHandicap Handicap, err error) {
+	if msg.Handicap != nil {
+		handicap = *msg.Handicap
+	}
+	if msg.EnemyHandicap != nil {
+		enemyHandicap = *msg.EnemyHandicap
+	}
+	if err = handicap.Validate(); err == nil {
+		err = enemyHandicap.Validate()
 	}
+	return handicap, enemyHandicap, errors.Wrap(err, "bad handicap")
 }
 
 // Each time a new user connects, a goroutine running the function that this one returns is created.
-// It keeps track of the connection and sends chat data or game data back and forth.
-func handleConnection(newClients chan<- ConnInfo) http.Handler {
+// It keeps track of the connection and sends chat data or game data back and forth. Connections from browsers are
+// only accepted from pages on this server or with one of the given origins.
+func handleConnection(newClients chan<- ConnInfo, origins []string) http.Handler {
+	// Upgrade initial GET request to a websocket
+	var upgrader = websocket.Upgrader{CheckOrigin: originChecker(origins)}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Upgrade initial GET request to a websocket
-		var upgrader = websocket.Upgrader{}
+		id := nextConnID()
+		log := slog.Default().With("conn", id)
 		socket, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Println(errors.Wrap(err, "when upgrading connection"))
+			log.Warn("couldn't upgrade connection", "remote", r.RemoteAddr, "err", err)
+			return
 		}
 		defer socket.Close()
+		addr, _, _ := net.SplitHostPort(r.RemoteAddr)
+		log.Info("connected", "addr", addr)
+		defer log.Info("disconnected")
 		// Send the connection info.
-		var conn = ConnInfo{
-			Inbound:  make(chan Message),
-			Outbound: make(chan interface{}),
-		}
-		// This will let the consumer know that it's no longer active.
+		var conn = newConnInfo(id, log, addr)
+		// This will let the consumer know that it's no longer active, and anyone sending to it that they
+		// can stop.
 		defer close(conn.Inbound)
-		defer close(conn.Outbound)
+		defer close(conn.Done)
+
+		// Find out what protocol the client speaks before anything else happens.
+		_, first, err := socket.ReadMessage()
+		if err != nil {
+			log.Info("closed before hello", "err", err)
+			return
+		}
+		proto, pending, reply, err := handshake(first)
+		if reply != nil {
+			replyProto := proto
+			if err != nil {
+				replyProto.Version = PROTOCOL_VERSION
+			}
+			writeOutbound(socket, replyProto, reply, log)
+		}
+		if err != nil {
+			log.Warn("couldn't negotiate protocol version", "err", err)
+			return
+		}
+		log.Debug("negotiated protocol", "version", proto.Version, "encoding", proto.Encoding)
+		conn.Version = proto.Version
+
 		// Signal that a new client has arrived.
 		newClients <- conn
 
-		// Connect the outbound channel to the websocket.
+		stopPinging := make(chan struct{})
+		defer close(stopPinging)
+		go measureLatency(socket, conn.Latency, stopPinging)
+
+		// A client that can't keep up is cut off. The writer below might be stuck writing to it, so this is
+		// done from here; closing the socket gets the writer unstuck too.
 		go func() {
-			for msg := range conn.Outbound {
-				err := socket.WriteJSON(msg)
-				if err != nil {
-					log.Println(errors.Wrap(err, "when writing chat message"))
+			select {
+			case <-conn.Overflow:
+				socket.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater,
+					"the server couldn't send you messages fast enough"), time.Now().Add(time.Second))
+				socket.Close()
+			case <-conn.Done:
+			}
+		}()
+
+		// Connect the outbound channels to the websocket.
+		go func() {
+			deltas := newDeltaEncoder()
+			for {
+				var msg interface{}
+				// Lobby messages go first, so START GAME always gets there before the battle's first update.
+				select {
+				case msg = <-conn.Outbound:
+				default:
+					select {
+					case msg = <-conn.Outbound:
+					case msg = <-conn.Updates:
+					case <-conn.Done:
+						return
+					}
+				}
+				switch m := msg.(type) {
+				case Update:
+					// Clients that understand deltas only get sent what changed.
+					if proto.Version >= DELTA_PROTOCOL_VERSION {
+						var changed bool
+						if msg, changed = deltas.Next(m); !changed {
+							continue
+						}
+					}
+				case ResultPayload:
+					// The next battle has to start with a keyframe.
+					deltas.Reset()
+				case kick:
+					// Closing the socket stops the loop below reading from it, which cleans everything up.
+					log.Info("kicked", "reason", m.Reason)
+					socket.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.ClosePolicyViolation, m.Reason), time.Now().Add(time.Second))
+					socket.Close()
+					return
 				}
-				//TODO remove them or just drop the message?
+				writeOutbound(socket, proto, msg, log)
 			}
 		}()
 
+		// Legacy clients don't send a hello, so their first message is a real one.
+		if pending != nil {
+			conn.Inbound <- *pending
+		}
 		// Connect the websocket to the inbound channel.
-		var msg Message
 		for {
 			// Read the next message from chat
-			err := socket.ReadJSON(&msg)
+			frameType, data, err := socket.ReadMessage()
 			if err != nil {
-				log.Println(errors.Wrap(err, "when reading chat message"))
+				// Clients closing the page isn't an error.
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+					metricSocketErrors.Inc("read")
+					log.Warn("couldn't read message", "err", err)
+				}
 				return
 			}
+			var msg Message
+			if frameType == websocket.BinaryMessage {
+				msg, err = decodeBinaryInbound(data)
+			} else {
+				msg, err = decodeInbound(proto.Version, data)
+			}
+			if err != nil {
+				log.Warn("couldn't decode message", "err", err)
+				conn.Send(ErrorPayload{ERR_BAD_MESSAGE, err.Error()})
+				continue
+			}
 			conn.Inbound <- msg
 		}
 	})
 }
 
-// This goroutine listens for gamestate updates from battle.go and forwards them to the player.
-func forwardUpdates(dest chan interface{}, src chan Update) {
-	for update := range src {
-		dest <- update
-		// This function is here to prevent crashes when someone reloads during battle
-		defer func() {
-			// recover from panic caused by writing to a closed channel
-			r := recover()
-			if r != nil {
-				log.Printf("error when writing on channel: %v\n", r)
-				return
+// writeOutbound encodes a message for the client's protocol and writes it to the socket, logging any errors to log.
+func writeOutbound(socket *websocket.Conn, proto Protocol, msg interface{}, log *slog.Logger) {
+	if proto.Encoding == ENCODING_BINARY {
+		data, ok, err := encodeBinary(msg)
+		if err != nil {
+			log.Error("couldn't encode binary message", "err", err)
+			return
+		}
+		if ok {
+			if err := socket.WriteMessage(websocket.BinaryMessage, data); err != nil {
+				metricSocketErrors.Inc("write")
+				log.Warn("couldn't write binary message", "err", err)
 			}
-		}()
-		if update.Self.Life <= 0 || update.Enemy.Life <= 0 {
 			return
 		}
 	}
+	out, ok, err := encodeOutbound(proto.Version, msg)
+	if err != nil {
+		log.Error("couldn't encode message", "err", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	if err := socket.WriteJSON(out); err != nil {
+		metricSocketErrors.Inc("write")
+		log.Warn("couldn't write message", "err", err)
+	}
+}
+
+// This goroutine listens for gamestate updates from a match and forwards them to the player, followed by the
+// result once the battle is over. It stops early if the player leaves. rated says whether the result counts for
+// ratings.
+func forwardUpdates(conn *ConnInfo, updates <-chan Update, rated bool) {
+	for update := range updates {
+		if !conn.SendUpdate(update) {
+			return
+		}
+		// Only the last update of a battle has an outcome.
+		if update.Outcome != "" {
+			result := NewResult(update)
+			result.Rated = rated
+			conn.SendUpdate(result)
+		}
+	}
 }
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConn connects a client to the dispatcher without a websocket, from the given address. It returns the
+// client's ConnInfo and a channel with everything the server sends it except battle updates.
+func fakeConn(newClients chan<- ConnInfo, addr string) (ConnInfo, <-chan interface{}) {
+	id := nextConnID()
+	conn := newConnInfo(id, slog.Default().With("conn", id), addr)
+	conn.Version = PROTOCOL_VERSION
+	lobby := make(chan interface{}, 100)
+	go func() {
+		for {
+			select {
+			case msg := <-conn.Outbound:
+				lobby <- msg
+			case msg := <-conn.Updates:
+				if _, ok := msg.(Update); !ok {
+					lobby <- msg
+				}
+			case <-conn.Done:
+				return
+			}
+		}
+	}()
+	newClients <- conn
+	return conn, lobby
+}
+
+// expect waits for the next message a fake client gets and returns it.
+func expect(t *testing.T, lobby <-chan interface{}) interface{} {
+	select {
+	case msg := <-lobby:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("the server didn't send anything")
+		return nil
+	}
+}
+
+func TestDispatcherDrain(t *testing.T) {
+	defer func(timeout time.Duration) { DrainTimeout = timeout }(DrainTimeout)
+	DrainTimeout = 50 * time.Millisecond
+	path := filepath.Join(t.TempDir(), "results")
+	results, err := OpenResultLog(path)
+	assert.Nil(t, err)
+	started, calledOff := metricBattlesStarted.Value("duel"), metricBattlesFinished.Value("duel", "no_contest")
+	ctx, cancel := context.WithCancel(context.Background())
+	newClients := make(chan ConnInfo)
+	stopped := make(chan struct{})
+	go func() {
+		dispatcher(ctx, newClients, nil, results)
+		close(stopped)
+	}()
+
+	// Two users start a duel.
+	var lobbies []<-chan interface{}
+	for _, name := range []string{"a", "b"} {
+		conn, lobby := fakeConn(newClients, "127.0.0.1")
+		defer close(conn.Done)
+		conn.Inbound <- Message{Username: name, Command: "SETNAME"}
+		conn.Inbound <- Message{Content: "duel", Command: "READY"}
+		lobbies = append(lobbies, lobby)
+	}
+	for _, lobby := range lobbies {
+		assert.Equal(t, "START GAME", expect(t, lobby).(Message).Command)
+	}
+
+	// Once the server is draining, everyone's told, including whoever shows up afterwards, and nobody can start
+	// a battle.
+	cancel()
+	for _, lobby := range lobbies {
+		assert.Equal(t, MAINTENANCE_NOTICE, expect(t, lobby).(Message).Content)
+	}
+	conn, lobby := fakeConn(newClients, "127.0.0.1")
+	defer close(conn.Done)
+	assert.Equal(t, MAINTENANCE_NOTICE, expect(t, lobby).(Message).Content)
+	for _, command := range []string{"READY", "BOT MATCH", "CHALLENGE", "ACCEPT"} {
+		conn.Inbound <- Message{Content: "a", Command: command}
+		assert.Equal(t, ERR_MAINTENANCE, expect(t, lobby).(ErrorPayload).Code)
+	}
+
+	// The duel doesn't finish in time, so it's called off, and the dispatcher stops once it's been recorded.
+	for _, lobby := range lobbies {
+		assert.Equal(t, OUTCOME_NO_CONTEST, expect(t, lobby).(ResultPayload).Outcome)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the dispatcher didn't stop")
+	}
+	assert.Nil(t, results.Close())
+	records := readResults(t, path)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, "duel", records[0].Mode)
+	assert.True(t, records[0].Rated)
+	assert.Equal(t, "a", records[0].Players[0].Name)
+	assert.Equal(t, OUTCOME_NO_CONTEST, records[0].Players[1].Outcome)
+	assert.Equal(t, started+1, metricBattlesStarted.Value("duel"))
+	assert.Equal(t, calledOff+1, metricBattlesFinished.Value("duel", "no_contest"))
+}
+
+// A client that stops reading what it's sent gets cut off, without holding up anyone else.
+func TestSlowClient(t *testing.T) {
+	const TALKERS, MESSAGES = 20, 4
+	slow := metricSlowClients.Value()
+	ctx, cancel := context.WithCancel(context.Background())
+	newClients := make(chan ConnInfo)
+	stopped := make(chan struct{})
+	go func() {
+		dispatcher(ctx, newClients, nil, nil)
+		close(stopped)
+	}()
+	// Nothing ever reads what's sent to this one.
+	stuck := newConnInfo(nextConnID(), slog.Default(), "10.0.0.1")
+	newClients <- stuck
+	defer close(stuck.Done)
+
+	var conns []ConnInfo
+	var lobbies []<-chan interface{}
+	for i := 0; i < TALKERS; i++ {
+		conn, lobby := fakeConn(newClients, "10.0.0.2")
+		defer close(conn.Done)
+		conns, lobbies = append(conns, conn), append(lobbies, lobby)
+	}
+	for _, conn := range conns {
+		go func(conn ConnInfo) {
+			for j := 0; j < MESSAGES; j++ {
+				conn.Inbound <- Message{Content: "hello"}
+			}
+		}(conn)
+	}
+	// There's more chat than the stuck client has room for, but everyone else gets all of it.
+	timeout := time.After(5 * time.Second)
+	for _, lobby := range lobbies {
+		for got := 0; got < TALKERS*MESSAGES; got++ {
+			select {
+			case msg := <-lobby:
+				assert.Equal(t, "hello", msg.(Message).Content)
+			case <-timeout:
+				t.Fatal("the stuck client held everyone up")
+			}
+		}
+	}
+	select {
+	case <-stuck.Overflow:
+	default:
+		t.Error("the stuck client wasn't disconnected")
+	}
+	assert.Equal(t, slow+1, metricSlowClients.Value())
+	cancel()
+	<-stopped
+}
@@ -0,0 +1,759 @@
+/*
+ * Copyright (c) 2018-2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+var newMsg = ''; // Holds new messages to be sent to the server
+var chatContent = ''; // A running list of chat messages displayed on the screen
+var username = null; // Our username
+var PROTOCOL_VERSION = 15; // The protocol version we ask for in our hello
+var protocolVersion = null; // The version the server picked, once it's welcomed us
+var encoding = "json"; // The encoding the server picked for battle traffic
+var battleState = null; // The full battle state, rebuilt from the last keyframe and the deltas since
+var lastTick = 0; // The last server tick we heard about
+var lastTickTime = 0; // When we heard about it
+var TICK_MS = 10; // The length of a server tick, in milliseconds. The server tells us its tick rate in the welcome.
+var inputSeq = 0; // The sequence number of the last input we sent
+var unackedInputs = {}; // Inputs the server hasn't said it's used yet, by sequence number
+// The websocket has to be secure if the page is, or the browser won't allow it.
+var socket = new WebSocket((window.location.protocol == "https:" ? "wss://" : "ws://") + window.location.host + '/ws');
+socket.binaryType = "arraybuffer";
+// When the lobby sends our battle to a worker, this is our connection to it, and battle inputs go through it.
+var battleSocket = null;
+// This variable is used later, but has to be global so it can persist.
+var keyCodes = {
+	32: "BLOCK", // space
+	81: "LIGHT", // q
+	87: "HEAVY", // w
+	16: "DODGE", // shift (either)
+	17: "SAVE", // ctrl (either)
+	37: "INTERRUPT_LEFT",
+	38: "INTERRUPT_UP",
+	39: "INTERRUPT_RIGHT",
+	40: "INTERRUPT_DOWN",
+	69: "FEINT", // e
+	82: "GRAB", // r
+	65: "PARRY", // a
+	83: "SPECIAL" // s
+};
+var TARGET_KEY = 84; // t, which switches to the next enemy in battles with more than two players
+var keyStates = {"LIGHT": false, "HEAVY": false, "BLOCK": false, "DODGE": false, "SAVE": false, "INTERRUPT_UP": false, "INTERRUPT_DOWN": false, "INTERRUPT_LEFT": false, "INTERRUPT_RIGHT": false, "FEINT": false, "GRAB": false, "PARRY": false, "SPECIAL": false};
+// States that don't have icons are shown as text under the icons instead.
+var stateLabels = {
+	"feint recovery": "Recovering from feint",
+	"grabbing": "Grabbing",
+	"grabbed": "Grabbed",
+	"grab whiff": "Missed grab",
+	"parrying": "Parrying",
+	"parried": "Parried",
+	"parry whiff": "Missed parry",
+	"slamming": "Slamming",
+	"hit stun": "Stunned"
+};
+
+
+// Everything sent to the server is wrapped in an envelope saying what kind of message it is. It goes to the lobby
+// unless another socket is given.
+function sendEnvelope(type, payload, to) {
+	(to || socket).send(JSON.stringify({
+		type: type,
+		v: protocolVersion || PROTOCOL_VERSION,
+		payload: payload
+	}));
+}
+
+socket.onopen = function() {
+	sendEnvelope("hello", {version: PROTOCOL_VERSION, encodings: ["binary", "json"]});
+};
+
+// The server says why when it closes the connection on purpose, like when an admin kicks someone.
+socket.onclose = function(e) {
+	handleChatMessage({username: "server", text: "Disconnected" + (e.reason ? ": " + e.reason : ".")});
+};
+
+// The lobby and the worker running our battle both send the same kinds of messages, so this handles either.
+function handleMessage(e) {
+	// Binary frames are always battle traffic; see binary.go for the format.
+	var msg = (e.data instanceof ArrayBuffer) ? decodeBinary(e.data) : JSON.parse(e.data);
+	switch (msg.type) {
+		case "welcome":
+			protocolVersion = msg.payload.version;
+			encoding = msg.payload.encoding;
+			if (msg.payload.tickRate) {
+				TICK_MS = 1000 / msg.payload.tickRate;
+			}
+			break;
+		case "chat":
+			handleChatMessage(msg.payload);
+			break;
+		case "command":
+			handleCommand(msg.payload);
+			break;
+		case "update":
+			battleState = msg.payload;
+			noteTick(battleState.tick);
+			noteAcks(battleState.acks);
+			delete battleState.acks;
+			handleBattleUpdate(battleState);
+			break;
+		case "delta":
+			// A delta is only ever sent after a keyframe.
+			if (battleState) {
+				// Acks aren't part of the state, so they mustn't linger in it.
+				var acks = msg.payload.acks;
+				delete msg.payload.acks;
+				applyDelta(battleState, msg.payload);
+				noteTick(battleState.tick);
+				noteAcks(acks);
+				handleBattleUpdate(battleState);
+			}
+			break;
+		case "result":
+			handleResult(msg.payload);
+			break;
+		case "error":
+			handleChatMessage({username: "server", text: msg.payload.message});
+			// The server won't have readied us if it's shutting down.
+			if (msg.payload.code == "maintenance") {
+				document.getElementById("readyButton").innerHTML = "Ready for game";
+			}
+			break;
+		default:
+			console.log("unknown message type", msg.type);
+	}
+}
+
+socket.onmessage = handleMessage;
+
+// joinBattle connects to the worker the lobby sent our battle to, and joins it with our ticket.
+function joinBattle(server, ticket) {
+	battleSocket = new WebSocket(server);
+	battleSocket.binaryType = "arraybuffer";
+	battleSocket.onopen = function() {
+		sendEnvelope("hello", {version: PROTOCOL_VERSION, encodings: ["binary", "json"]}, battleSocket);
+		sendEnvelope("command", {command: "JOIN", arg: ticket}, battleSocket);
+	};
+	battleSocket.onmessage = handleMessage;
+	// The lobby still tells us how the battle ended, even if the worker goes away.
+	battleSocket.onclose = function(e) {
+		if (e.reason) {
+			handleChatMessage({username: "server", text: "Disconnected from battle: " + e.reason});
+		}
+	};
+}
+
+// leaveBattle hangs up on the worker once the battle is over.
+function leaveBattle() {
+	if (battleSocket) {
+		battleSocket.onclose = null;
+		battleSocket.close();
+		battleSocket = null;
+	}
+}
+
+// These tables have to match the ones in binary.go exactly.
+var BINARY_INPUTS = ["NONE", "BLOCK", "LIGHT", "HEAVY", "DODGE", "SAVE",
+	"INTERRUPT_UP", "INTERRUPT_DOWN", "INTERRUPT_LEFT", "INTERRUPT_RIGHT", "FEINT", "GRAB", "PARRY", "SPECIAL"];
+var BINARY_STATES = ["standing", "blocking", "light attack", "heavy attack", "counterattack", "countered",
+	"interrupting heavy_up", "interrupting heavy_down", "interrupting heavy_left", "interrupting heavy_right",
+	"interrupted heavy_up", "interrupted heavy_down", "interrupted heavy_left", "interrupted heavy_right",
+	"feint recovery", "grabbing", "grabbed", "grab whiff",
+	"parrying", "parried", "parry whiff", "slamming", "hit stun"];
+var BIN_UPDATE = 1, BIN_DELTA = 2, BIN_INPUT = 3;
+var STATUS_FIELD_LIFE = 1, STATUS_FIELD_STAMINA = 2, STATUS_FIELD_STATE = 4, STATUS_FIELD_STATE_DURATION = 8;
+var STATUS_FIELD_PING = 16, STATUS_FIELD_EXHAUSTED = 32, STATUS_FIELD_REGEN_DELAY = 64, STATUS_FIELD_COMBO = 128;
+var STATUS_FIELD_EFFECTS = 256;
+var STATUS_FIELD_ALL = 511;
+
+// Decode a binary battle message into the same shape as a JSON envelope.
+function decodeBinary(buffer) {
+	var bytes = new Uint8Array(buffer);
+	var pos = 1;
+	function readByte() {
+		return bytes[pos++];
+	}
+	// An unsigned varint, like Go's binary.Uvarint.
+	function readUvarint() {
+		var value = 0, shift = 0, b;
+		do {
+			b = readByte();
+			value += (b & 0x7f) * Math.pow(2, shift);
+			shift += 7;
+		} while (b & 0x80);
+		return value;
+	}
+	// A zigzag varint, like Go's binary.Varint.
+	function readVarint() {
+		var value = readUvarint();
+		return (value % 2) ? -(value + 1) / 2 : value / 2;
+	}
+	function readStatus(fields) {
+		var status = {};
+		if (fields & STATUS_FIELD_LIFE) {
+			status.life = readVarint();
+		}
+		if (fields & STATUS_FIELD_STAMINA) {
+			status.stamina = ((readByte() << 8) | readByte()) / 100;
+		}
+		if (fields & STATUS_FIELD_STATE) {
+			status.state = BINARY_STATES[readByte()];
+		}
+		if (fields & STATUS_FIELD_STATE_DURATION) {
+			status.stateDur = readVarint();
+		}
+		if (fields & STATUS_FIELD_PING) {
+			status.ping = readUvarint();
+		}
+		if (fields & STATUS_FIELD_EXHAUSTED) {
+			status.exhausted = readByte() == 1;
+		}
+		if (fields & STATUS_FIELD_REGEN_DELAY) {
+			status.regenDelay = readUvarint();
+		}
+		if (fields & STATUS_FIELD_COMBO) {
+			status.combo = readUvarint();
+		}
+		if (fields & STATUS_FIELD_EFFECTS) {
+			status.effects = {bleed: readUvarint(), stagger: readUvarint(), guardCrush: readUvarint()};
+		}
+		return status;
+	}
+	function readAcks() {
+		var acks = [];
+		for (var count = readUvarint(); count > 0; count--) {
+			acks.push({seq: readUvarint(), tick: readUvarint()});
+		}
+		return acks;
+	}
+	switch (bytes[0]) {
+		case BIN_UPDATE:
+			var tick = readUvarint();
+			var update = {tick: tick, self: readStatus(STATUS_FIELD_ALL), enemy: readStatus(STATUS_FIELD_ALL)};
+			update.acks = readAcks();
+			return {type: "update", payload: update};
+		case BIN_DELTA:
+			var delta = {tick: readUvarint()};
+			var present = readByte();
+			if (present & 1) {
+				delta.self = readStatus(readUvarint());
+			}
+			if (present & 2) {
+				delta.enemy = readStatus(readUvarint());
+			}
+			delta.acks = readAcks();
+			return {type: "delta", payload: delta};
+	}
+	return {type: "unknown"};
+}
+
+// Remember the latest server tick, so our inputs can say when they were made.
+function noteTick(tick) {
+	lastTick = tick;
+	lastTickTime = Date.now();
+}
+
+// Forget about inputs the server has told us it used. A predicting client would replay the ones left over
+// on top of each authoritative update; we just keep track of them.
+function noteAcks(acks) {
+	if (!acks) {
+		return;
+	}
+	for (var i = 0; i < acks.length; i++) {
+		delete unackedInputs[acks[i].seq];
+	}
+}
+
+// Our guess at what tick the server is on. Deltas aren't sent when nothing changed, so we count ticks ourselves
+// since the last one we heard about.
+function estimatedTick() {
+	if (!lastTick) {
+		return 0;
+	}
+	return lastTick + Math.floor((Date.now() - lastTickTime) / TICK_MS);
+}
+
+// Append an unsigned varint to an array of bytes, like Go's binary.AppendUvarint.
+function appendUvarint(bytes, value) {
+	while (value >= 0x80) {
+		bytes.push((value % 0x80) | 0x80);
+		value = Math.floor(value / 0x80);
+	}
+	bytes.push(value);
+	return bytes;
+}
+
+// Copy the fields of a delta onto the state it applies to, descending into nested objects.
+function applyDelta(target, delta) {
+	for (var key in delta) {
+		if (delta[key] !== null && typeof delta[key] == "object" && typeof target[key] == "object" && target[key] !== null) {
+			applyDelta(target[key], delta[key]);
+		} else {
+			target[key] = delta[key];
+		}
+	}
+}
+
+function handleCommand(msg) {
+	if (msg.command == "START GAME") {
+		if (msg.server) {
+			joinBattle(msg.server, msg.ticket);
+		}
+		document.getElementById('ownName').innerHTML = username;
+		document.getElementById('enemyName').innerHTML = msg.arg;
+		document.getElementById('ownArchetype').innerHTML = document.getElementById("archetypeMenu").value;
+		document.getElementById('enemyArchetype').innerHTML = msg.archetype || "";
+		document.getElementById('ownHandicap').innerHTML = handicapText(msg.handicap);
+		document.getElementById('enemyHandicap').innerHTML = handicapText(msg.enemyHandicap);
+		// Archetypes start with different amounts of life, so the bars are scaled to whatever the first update says.
+		ownMaxLife = null;
+		enemyMaxLife = null;
+		ownMaxStamina = (msg.handicap && msg.handicap.maxStamina) || 100;
+		enemyMaxStamina = (msg.enemyHandicap && msg.enemyHandicap.maxStamina) || 100;
+		combatantMaxLife = null;
+		document.getElementById('combatants').innerHTML = "";
+		document.getElementById("matchSound").play();
+		document.getElementById("readyButton").innerHTML = "Ready for game";
+		document.getElementById('chat').style.display = "none";
+		document.getElementById('battleUI').style.display = "block";
+		document.getElementById("getReadyText").style.display = "block";
+		// Stupid hack with reverse cascading timers to show a countdown.
+		setTimeout(function(){
+			setTimeout(function(){
+				setTimeout(function(){
+					setTimeout(function(){
+						document.getElementById("getReadyText").innerHTML = "Get ready!";
+						document.getElementById("getReadyText").style.display = "none";
+						document.getElementById("startSound").play();
+						battle();
+					}, 1000)
+					document.getElementById("getReadyText").innerHTML = "1...";
+					document.getElementById("countdownSound").fastSeek(0);
+					document.getElementById("countdownSound").play();
+				}, 1000)
+				document.getElementById("getReadyText").innerHTML = "2...";
+				document.getElementById("countdownSound").fastSeek(0);
+				document.getElementById("countdownSound").play();
+			}, 1000)
+			document.getElementById("getReadyText").innerHTML = "3...";
+			document.getElementById("countdownSound").play();
+		}, 1000)
+	} else if (msg.command == "CHALLENGE") {
+		challenger = msg.arg;
+		var terms = [];
+		if (handicapText(msg.enemyHandicap)) {
+			terms.push("them: " + handicapText(msg.enemyHandicap));
+		}
+		if (handicapText(msg.handicap)) {
+			terms.push("you: " + handicapText(msg.handicap));
+		}
+		handleChatMessage({username: "server", text: msg.arg + " challenged you to a duel"
+			+ (terms.length ? " (" + terms.join("; ") + ")" : "")
+			+ '. <a href="#" onclick="acceptChallenge(); return false">Accept</a>'});
+	}
+};
+
+function handleChatMessage(msg) {
+	chatContent += '<div class="chip">'
+		+ msg.username
+		+ '</div>'
+		+ (msg.text) + '<br/>';
+	var element = document.getElementById('chat-messages');
+	element.innerHTML = chatContent;
+	element.scrollTop = element.scrollHeight; // Auto scroll to the bottom
+};
+
+// Send a chat message to the server.
+function send () {
+	newMsg = document.getElementById("msgbox").value;
+	// "/ignore name" and "/unignore name" hide someone's messages or show them again.
+	var ignoreCommand = newMsg.match(/^\/(un)?ignore\s+(.+)$/i);
+	if (ignoreCommand) {
+		sendEnvelope("command", {command: ignoreCommand[1] ? "UNIGNORE" : "IGNORE", arg: ignoreCommand[2].trim()});
+		handleChatMessage({username: "server", text: (ignoreCommand[1] ? "No longer ignoring " : "Ignoring ")
+			+ ignoreCommand[2].trim()});
+		document.getElementById("msgbox").value = "";
+	} else if (newMsg != '') {
+		sendEnvelope("chat", {username: username, text: newMsg});
+		document.getElementById("msgbox").value = ""; // Reset the message box
+	}
+}
+
+function join () {
+	username = document.getElementById("usernamebox").value;
+	if (!username) {
+		Materialize.toast('You must choose a username', 2000);
+		return
+	}
+	document.getElementById("afterjoin").style.display = "block";
+	document.getElementById("beforejoin").style.display = "none";
+	sendEnvelope("command", {command: "SETNAME", arg: username});
+	chooseArchetype();
+}
+
+function chooseArchetype() {
+	sendEnvelope("command", {command: "ARCHETYPE", arg: document.getElementById("archetypeMenu").value});
+}
+
+function toggleReady () {
+	readyStatus = document.getElementById("readyButton").innerHTML;
+	console.log("(Un)readying for game...");
+	if (readyStatus.search("Unready for game") == -1) {
+		var command = "READY";
+		document.getElementById("readyButton").innerHTML = "Unready for game";
+	} else {
+		var command = "UNREADY";
+		document.getElementById("readyButton").innerHTML = "Ready for game";
+	}
+	sendEnvelope("command", {command: command, arg: document.getElementById("modeMenu").value});
+}
+
+// This function is called from the HTML. We have to check the keycode ourselves, because the HTML can only detect when a key is pressed, not which one.
+function enter (event) {
+	if (event.keyCode == 13) {
+		send();
+	}
+}
+
+function fightBot() {
+	sendEnvelope("command", {command: "BOT MATCH", arg: document.getElementById("botMenu").value,
+		archetype: document.getElementById("botArchetypeMenu").value,
+		handicap: readHandicap("own"), enemyHandicap: readHandicap("enemy")});
+}
+
+var challenger = null; // Who sent us the last challenge
+
+function challenge() {
+	var name = document.getElementById("challengeName").value;
+	if (!name) {
+		Materialize.toast('You must say who to challenge', 2000);
+		return
+	}
+	sendEnvelope("command", {command: "CHALLENGE", arg: name,
+		handicap: readHandicap("own"), enemyHandicap: readHandicap("enemy")});
+}
+
+function acceptChallenge() {
+	sendEnvelope("command", {command: "ACCEPT", arg: challenger});
+}
+
+// The handicap inputs in index.html, with the field each one sets and what to multiply it by (the multipliers
+// are entered as percentages).
+var HANDICAP_INPUTS = [["Life", "life", 1], ["Stamina", "maxStamina", 1], ["Damage", "damageMult", 0.01],
+	["Regen", "regenMult", 0.01], ["Counter", "counterWindow", 1]];
+
+// Read the handicap for one side ("own" or "enemy") from the lobby. Blank inputs are left out, which means no change.
+function readHandicap(side) {
+	var handicap = {};
+	HANDICAP_INPUTS.forEach(function(input) {
+		var value = document.getElementById(side + input[0] + "Handicap").value;
+		if (value != "") {
+			handicap[input[1]] = Number(value) * input[2];
+		}
+	});
+	return handicap;
+}
+
+// Describe a handicap from the server in words, or return "" for none.
+function handicapText(handicap) {
+	if (!handicap) {
+		return "";
+	}
+	var parts = [];
+	if (handicap.life) {
+		parts.push(handicap.life + " life");
+	}
+	if (handicap.maxStamina) {
+		parts.push(handicap.maxStamina + " max stamina");
+	}
+	if (handicap.damageMult) {
+		parts.push(Math.round(handicap.damageMult * 100) + "% damage");
+	}
+	if (handicap.regenMult) {
+		parts.push(Math.round(handicap.regenMult * 100) + "% regen");
+	}
+	if (handicap.counterWindow) {
+		parts.push("+" + handicap.counterWindow + "ms counter window");
+	}
+	return parts.join(", ");
+}
+
+function toggleInstructions () {
+	element = document.getElementById("instructions");
+	if (element.style.display == "none") {
+		element.style.display = "block"
+	} else {
+		element.style.display = "none"
+	}
+	element.scrollTop = element.scrollHeight; // Auto scroll to the bottom
+}
+
+// This function is called when the server tells us the battle is over.
+function handleResult(result) {
+	leaveBattle();
+	battleState = null;
+	lastTick = 0;
+	unackedInputs = {};
+	document.getElementById('battleUI').style.display = "none";
+	document.getElementById('chat').style.display = "block";
+	// Display a message telling the result of the battle.
+	var outcomes = {"win": "You won!", "loss": "You lost.", "draw": "It's a draw.", "no contest": "The battle was called off. It's a no-contest."};
+	chatContent += '<div class="chip">'
+	 + "server"
+	 + "</div>"
+	 + outcomes[result.outcome] + " You had " + result.life.toString() + " life and the enemy had " + result.enemyLife.toString()
+	 + (result.rated ? "" : " (unrated)") + "<br>";
+	var element = document.getElementById('chat-messages');
+	element.innerHTML = chatContent;
+	element.scrollTop = element.scrollHeight;
+
+	document.removeEventListener("keyup", keyupListener)
+	document.removeEventListener("keydown", keydownListener)
+	sendEnvelope("command", {command: "END MATCH"});
+}
+
+// A single hit isn't much of a combo, so the counter only shows up from the second.
+function comboText(combo) {
+	if (combo >= 2) {
+		return combo.toString() + " hit combo!";
+	}
+	return "";
+}
+
+// The names shown for each status effect, in the order they're shown.
+var effectLabels = {bleed: "Bleeding", stagger: "Staggered", guardCrush: "Guard crushed"};
+
+// Each effect the player has is shown as a badge, with the number of stacks if there's more than one.
+function effectsHTML(effects) {
+	var html = "";
+	for (var effect in effectLabels) {
+		var stacks = effects[effect];
+		if (stacks > 0) {
+			html += '<span class="effect ' + effect + '">' + effectLabels[effect]
+			 + (stacks > 1 ? " x" + stacks.toString() : "") + "</span>";
+		}
+	}
+	return html;
+}
+
+var ownMaxLife = null;
+var enemyMaxLife = null;
+// The same for stamina, which is only different with a handicap.
+var ownMaxStamina = 100;
+var enemyMaxStamina = 100;
+// In battles with more than two players, everyone's starting life, since the enemy shown changes with the target.
+var combatantMaxLife = null;
+
+// Show everyone in a battle with more than two players, and who they're attacking.
+function showCombatants(combatants) {
+	if (combatantMaxLife == null) {
+		combatantMaxLife = combatants.map(function(c) { return c.status.life; });
+	}
+	var html = "";
+	for (var i = 0; i < combatants.length; i++) {
+		var c = combatants[i];
+		var classes = "combatant" + (c.self ? " self" : "") + (c.status.life <= 0 ? " out" : "");
+		html += '<div class="' + classes + '">' + c.name
+		 + (c.team ? " (team " + c.team.toString() + ")" : "")
+		 + " - " + Math.max(c.status.life, 0).toString() + " life"
+		 + (c.target >= 0 && c.status.life > 0 ? ", attacking " + combatants[c.target].name : "") + "</div>";
+	}
+	document.getElementById('combatants').innerHTML = html;
+}
+
+// Find our own place in the combatants list.
+function selfIndex(combatants) {
+	for (var i = 0; i < combatants.length; i++) {
+		if (combatants[i].self) {
+			return i;
+		}
+	}
+	return -1;
+}
+
+// Give up the battle, after making sure that's what the player meant.
+function forfeit() {
+	if (battleState && confirm("Give up this battle?")) {
+		sendEnvelope("command", {command: "FORFEIT"}, battleSocket);
+	}
+}
+
+// Switch to attacking the next enemy who's still standing.
+function nextTarget() {
+	if (!battleState || !battleState.combatants) {
+		return;
+	}
+	var combatants = battleState.combatants;
+	var me = selfIndex(combatants);
+	var current = combatants[me].target;
+	for (var n = 1; n < combatants.length; n++) {
+		var i = (current + n) % combatants.length;
+		var c = combatants[i];
+		if (i != me && (!c.team || c.team != combatants[me].team) && c.status.life > 0) {
+			sendEnvelope("command", {command: "TARGET", arg: i.toString()}, battleSocket);
+			return;
+		}
+	}
+}
+
+// This function updates the battle UI.
+function handleBattleUpdate(update) {
+	if (ownMaxLife == null) {
+		ownMaxLife = update.self.life;
+		enemyMaxLife = update.enemy.life;
+	}
+	if (update.combatants) {
+		showCombatants(update.combatants);
+		var enemy = update.combatants[update.combatants[selfIndex(update.combatants)].target];
+		document.getElementById('enemyName').innerHTML = enemy.name;
+		document.getElementById('enemyArchetype').innerHTML = enemy.archetype;
+		enemyMaxLife = combatantMaxLife[update.combatants.indexOf(enemy)];
+	}
+	document.getElementById('ownLife').style.width = (100 * update.self.life / ownMaxLife).toString() + "%";
+	document.getElementById('ownStam').style.width = (100 * update.self.stamina / ownMaxStamina).toString() + "%";
+	// The stamina bar changes color when exhausted and fades while it isn't regenerating.
+	document.getElementById('ownStam').classList.toggle("exhausted", update.self.exhausted);
+	document.getElementById('ownStam').classList.toggle("regenPaused", update.self.regenDelay > 0);
+	// State durations are in milliseconds, and the bars are full at a second.
+	document.getElementById('ownDuration').style.width = (update.self.stateDur / 10).toString() + "%";
+	document.getElementById('enemyLife').style.width = (100 * update.enemy.life / enemyMaxLife).toString() + "%";
+	document.getElementById('enemyStam').style.width = (100 * update.enemy.stamina / enemyMaxStamina).toString() + "%";
+	document.getElementById('enemyStam').classList.toggle("exhausted", update.enemy.exhausted);
+	document.getElementById('enemyStam').classList.toggle("regenPaused", update.enemy.regenDelay > 0);
+	document.getElementById('enemyDuration').style.width = (update.enemy.stateDur / 10).toString() + "%";
+	document.getElementById('ownCombo').innerHTML = comboText(update.self.combo);
+	document.getElementById('enemyCombo').innerHTML = comboText(update.enemy.combo);
+	document.getElementById('ownEffects').innerHTML = effectsHTML(update.self.effects);
+	document.getElementById('enemyEffects').innerHTML = effectsHTML(update.enemy.effects);
+	document.getElementById('ownPing').innerHTML = update.self.ping.toString() + " ms";
+	document.getElementById('enemyPing').innerHTML = update.enemy.ping.toString() + " ms";
+	var ownState = update.self.state;
+	var enemyState = update.enemy.state;
+	document.getElementById('ownBlockSymbol').style.display = "none";
+	document.getElementById('ownLightSymbol').style.display = "none";
+	document.getElementById('ownLeftLightSymbol').style.display = "none";
+	document.getElementById('ownHeavySymbol').style.display = "none";
+	document.getElementById('enemyBlockSymbol').style.display = "none";
+	document.getElementById('enemyLightSymbol').style.display = "none";
+	document.getElementById('enemyHeavySymbol').style.display = "none";
+	document.getElementById('enemyRightLightSymbol').style.display = "none";
+	document.getElementById('leftArrowSymbol').style.display = "none";
+	document.getElementById('upArrowSymbol').style.display = "none";
+	document.getElementById('rightArrowSymbol').style.display = "none";
+	document.getElementById('downArrowSymbol').style.display = "none";
+	document.getElementById('ownStateText').innerHTML = stateLabels[ownState] || "";
+	document.getElementById('enemyStateText').innerHTML = stateLabels[enemyState] || "";
+	if (stateLabels[ownState]) {
+		ownState = "";
+	}
+	if (stateLabels[enemyState]) {
+		enemyState = "";
+	}
+	switch (ownState) {
+		case "":
+		case "standing":
+			break
+		case "blocking":
+			document.getElementById('ownBlockSymbol').style.display = "inline-block";
+			break;
+		case "light attack":
+			document.getElementById('ownLightSymbol').style.display = "inline-block";
+			break;
+		case "heavy attack":
+			document.getElementById('ownHeavySymbol').style.display = "inline-block";
+			break;
+		case "counterattack":
+			document.getElementById('ownBlockSymbol').style.display = "inline-block";
+			document.getElementById('ownLightSymbol').style.display = "inline-block";
+			break;
+		case "countered":
+			document.getElementById('ownLeftLightSymbol').style.display = "inline-block";
+			document.getElementById('ownBlockSymbol').style.display = "inline-block";
+			break;
+		default:
+			// If we're the heavy attack player
+			if (ownState.search("interrupted") == 0) {
+				arrow=ownState.slice(ownState.indexOf("_") + 1, ownState.length);
+				document.getElementById('ownHeavySymbol').style.display = "inline-block";
+				document.getElementById(arrow+'ArrowSymbol').style.display = "inline-block";
+			} else {
+				arrow=ownState.slice(ownState.indexOf("_") + 1, ownState.length);
+				document.getElementById('ownLightSymbol').style.display = "inline-block";
+				document.getElementById(arrow+'ArrowSymbol').style.display = "inline-block";
+			}
+
+	}
+	switch (enemyState) {
+		case "":
+		case "standing":
+			break
+		case "blocking":
+			document.getElementById('enemyBlockSymbol').style.display = "inline-block";
+			break;
+		case "light attack":
+			document.getElementById('enemyLightSymbol').style.display = "inline-block";
+			break;
+		case "heavy attack":
+			document.getElementById('enemyHeavySymbol').style.display = "inline-block";
+			break;
+		case "counterattack":
+			document.getElementById('enemyBlockSymbol').style.display = "inline-block";
+			document.getElementById('enemyLightSymbol').style.display = "inline-block";
+			break;
+		case "countered":
+			document.getElementById('enemyRightLightSymbol').style.display = "inline-block";
+			document.getElementById('enemyBlockSymbol').style.display = "inline-block";
+			break;
+		default:
+			if (ownState.search("interrupted") == 0) {
+				document.getElementById('enemyLightSymbol').style.display = "inline-block";
+			} else {
+				document.getElementById('enemyHeavySymbol').style.display = "inline-block";
+			}
+	}
+};
+
+
+function sendUpdate (input) {
+	// Don't allow holding keys.
+	if (keyStates[input] == true) {
+		return
+	}
+	var tick = estimatedTick();
+	inputSeq++;
+	unackedInputs[inputSeq] = {input: input, tick: tick};
+	if (encoding == "binary") {
+		(battleSocket || socket).send(new Uint8Array(appendUvarint(appendUvarint([BIN_INPUT, BINARY_INPUTS.indexOf(input)], tick), inputSeq)));
+	} else {
+		sendEnvelope("input", {input: input, tick: tick, seq: inputSeq}, battleSocket);
+	}
+}
+
+function keyupListener (e) {
+	var move = keyCodes[e.keyCode];
+	if (move) {
+		keyStates[move] = false;
+		// Since blocking is currently the only terminal state that is entered by choice, it's the only key we need to send a command for on keyup.
+		if (move == "BLOCK") {
+			sendUpdate("NONE");
+		}
+	}
+	return
+};
+
+function keydownListener (e) {
+	console.log(e);
+	if (e.keyCode == TARGET_KEY) {
+		nextTarget();
+		return;
+	}
+	move = keyCodes[e.keyCode];
+	if (move) {
+		sendUpdate(move);
+		keyStates[move] = true;
+	}
+}
+
+function battle () {
+	document.addEventListener('keyup', keyupListener);
+	document.addEventListener('keydown', keydownListener);
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file has what the server needs to be reached safely from browsers: the self-signed certificate it can
+// serve HTTPS with during development, and the check on where websocket connections come from.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// How long the self-signed certificate is good for. It's made fresh every time the server starts, so this only
+// has to outlast one run.
+const SELF_SIGNED_LIFETIME = 30 * 24 * time.Hour
+
+// selfSignedCert makes a certificate for localhost that nobody has signed. Browsers will warn about it, but it
+// lets HTTPS and WSS be tried out without a real certificate.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "when generating key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "when generating serial number")
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Counterplay Infinity development"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(SELF_SIGNED_LIFETIME),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "when creating certificate")
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// validOrigin returns an error if the origin isn't written like "https://example.com", with a scheme and host
+// and nothing after them, which is the only way a browser ever sends one.
+func validOrigin(origin string) error {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return errors.Wrapf(err, "bad origin %q", origin)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil ||
+		(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return errors.Errorf("bad origin %q: it should look like https://example.com", origin)
+	}
+	return nil
+}
+
+// originChecker returns the CheckOrigin function for the websocket upgrader. It lets a connection through if it
+// comes from a page served by this server or from one of the given origins. Connections without an Origin
+// header aren't from browsers, so there's no page that could be abusing them, and they're let through too.
+func originChecker(origins []string) func(r *http.Request) bool {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		return strings.EqualFold(u.Host, r.Host) || allowed[strings.ToLower(origin)]
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfSignedCert(t *testing.T) {
+	cert, err := selfSignedCert()
+	assert.Nil(t, err)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	assert.Nil(t, parsed.VerifyHostname("localhost"))
+	assert.Nil(t, parsed.VerifyHostname("127.0.0.1"))
+	assert.NotNil(t, parsed.VerifyHostname("example.com"))
+}
+
+func TestValidOrigin(t *testing.T) {
+	for _, good := range []string{"https://example.com", "http://localhost:8000", "https://example.com/"} {
+		assert.Nil(t, validOrigin(good), good)
+	}
+	for _, bad := range []string{"example.com", "ftp://example.com", "https://", "https://example.com/page",
+		"https://example.com?x=1", "https://user@example.com", "*"} {
+		assert.NotNil(t, validOrigin(bad), bad)
+	}
+	_, err := LoadConfig([]string{"-origins", "https://example.com,example.org"}, testEnv(nil))
+	assert.NotNil(t, err)
+	_, err = LoadConfig([]string{"-selfsigned", "-tlscert", "cert.pem", "-tlskey", "key.pem"}, testEnv(nil))
+	assert.NotNil(t, err)
+}
+
+func TestOriginChecker(t *testing.T) {
+	check := originChecker([]string{"https://Example.com/", "http://localhost:3000"})
+	for origin, allowed := range map[string]bool{
+		// Pages on the server itself, and clients that aren't browsers.
+		"https://game.example:8000": true,
+		"http://game.example:8000":  true,
+		"":                          true,
+		// The allowed origins, which don't care about case.
+		"https://example.com":   true,
+		"https://EXAMPLE.com":   true,
+		"http://localhost:3000": true,
+		// Anywhere else.
+		"http://example.com":       false,
+		"https://evil.example":     false,
+		"http://localhost:3001":    false,
+		"https://game.example":     false,
+		"https://example.com.evil": false,
+	} {
+		r := httptest.NewRequest("GET", "https://game.example:8000/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		assert.Equal(t, allowed, check(r), origin)
+	}
+}
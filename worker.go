@@ -0,0 +1,308 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file runs a worker, which is a server that runs battles for a lobby instead of having a lobby of its own
+// (see workers.go for the lobby's side). It's started with -lobby set to the lobby's /workers URL and -publicurl
+// set to the websocket URL players can reach it at.
+//
+// Players connect to a worker the same way they connect to a lobby, starting with a hello, but the first thing
+// they send after that is a JOIN command with the ticket the lobby gave them. A battle starts once all of its
+// players have joined, or after JOIN_TIMEOUT, with whoever didn't make it counted as having forfeited. Leaving a
+// battle early is forfeiting it too, the same as on the lobby. Players only get their updates from the worker;
+// their result comes from the lobby.
+//
+// If the worker loses the lobby, or is told to shut down, it calls off its battles and stops. The lobby counts
+// them as no-contests either way.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// How long a worker waits for everyone in a battle to join before starting it without them.
+const JOIN_TIMEOUT = 10 * time.Second
+
+// workerBattle is a battle a worker has been given by the lobby.
+type workerBattle struct {
+	match *Match
+	// Each player's ticket, and whether they've joined with it.
+	tickets []string
+	joined  []bool
+	started bool
+}
+
+// start starts the battle if it hasn't already.
+func (b *workerBattle) start() {
+	if !b.started {
+		b.started = true
+		b.match.Start()
+	}
+}
+
+// abort calls the battle off. It still has to be started, so that it finishes.
+func (b *workerBattle) abort() {
+	b.match.Abort()
+	b.start()
+}
+
+// joinRequest is a player asking to join a battle with a ticket.
+type joinRequest struct {
+	conn   *ConnInfo
+	ticket string
+}
+
+// join seats a player who's come with one of the battle's tickets, and starts the battle if they're the last one.
+// Battles that have started already can't be joined, including ones that were called off before they could.
+func (b *workerBattle) join(req joinRequest) error {
+	if b.started {
+		return errors.New("that battle has already started")
+	}
+	seat := 0
+	for b.tickets[seat] != req.ticket {
+		seat++
+	}
+	b.joined[seat] = true
+	b.match.SetLatency(seat, req.conn.Latency)
+	b.match.Log.Info("player joined", "conn", req.conn.ID, "seat", seat)
+	go forwardWorkerUpdates(req.conn, b.match.Updates(seat))
+	go forwardInputs(req.conn, b.match, seat)
+	if allJoined(b.joined) {
+		b.start()
+	}
+	return nil
+}
+
+// runWorker registers with the lobby at lobbyURL and runs the battles it gives out, which players join through
+// newClients. It returns once ctx is canceled or the lobby goes away, after calling off whatever battles were
+// going; losing the lobby is an error.
+func runWorker(ctx context.Context, newClients <-chan ConnInfo, lobbyURL, publicURL, token string) error {
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	socket, _, err := websocket.DefaultDialer.Dial(lobbyURL, header)
+	if err != nil {
+		return errors.Wrap(err, "when connecting to the lobby")
+	}
+	defer socket.Close()
+	if err := socket.WriteJSON(workerMessage{Type: WORKER_REGISTER, URL: publicURL}); err != nil {
+		return errors.Wrap(err, "when registering with the lobby")
+	}
+	slog.Info("registered with the lobby", "lobby", lobbyURL, "url", publicURL)
+	// stop tells this function's goroutines that it's returned.
+	stop := make(chan struct{})
+	defer close(stop)
+	fromLobby := make(chan workerMessage)
+	lobbyGone := make(chan error, 1)
+	go func() {
+		for {
+			var msg workerMessage
+			if err := socket.ReadJSON(&msg); err != nil {
+				lobbyGone <- err
+				return
+			}
+			select {
+			case fromLobby <- msg:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	battles := make(map[uint64]*workerBattle)
+	byTicket := make(map[string]*workerBattle)
+	joins := make(chan joinRequest)
+	// Battles whose players have had long enough to join come through here.
+	timeouts := make(chan *workerBattle)
+	finished := make(chan *Match)
+	// These are set once the worker is on its way out.
+	shutdown := ctx.Done()
+	stopping := false
+	var lost error
+	callOff := func() {
+		for _, b := range battles {
+			b.abort()
+		}
+	}
+	toLobby := func(msg workerMessage) {
+		socket.SetWriteDeadline(time.Now().Add(WORKER_WRITE_TIMEOUT))
+		if err := socket.WriteJSON(msg); err != nil {
+			slog.Error("couldn't write to the lobby", "type", msg.Type, "err", err)
+		}
+	}
+	for {
+		if (stopping || lost != nil) && len(battles) == 0 {
+			return lost
+		}
+		select {
+		case <-shutdown:
+			slog.Info("calling off battles before shutting down", "battles", len(battles))
+			shutdown = nil
+			stopping = true
+			toLobby(workerMessage{Type: WORKER_DRAINING})
+			callOff()
+
+		case err := <-lobbyGone:
+			slog.Error("lost the lobby; calling off battles", "err", err, "battles", len(battles))
+			lost = errors.Wrap(err, "lost the lobby")
+			callOff()
+
+		case msg := <-fromLobby:
+			b := battles[msg.Match]
+			switch msg.Type {
+			case WORKER_ASSIGN:
+				// It might have been sent before the lobby heard the worker was draining.
+				if stopping {
+					slog.Info("turned down a battle while draining", "match", msg.Match)
+					toLobby(workerMessage{Type: WORKER_DECLINED, Match: msg.Match})
+					break
+				}
+				b = newWorkerBattle(msg)
+				battles[msg.Match] = b
+				for _, ticket := range b.tickets {
+					byTicket[ticket] = b
+				}
+				b.match.Log.Info("battle assigned", "mode", msg.Mode, "rated", msg.Rated)
+				toLobby(workerMessage{Type: WORKER_ACCEPTED, Match: msg.Match})
+				go func() {
+					<-b.match.Done()
+					finished <- b.match
+				}()
+				time.AfterFunc(JOIN_TIMEOUT, func() {
+					select {
+					case timeouts <- b:
+					case <-stop:
+					}
+				})
+			case WORKER_FORFEIT:
+				if b != nil && msg.Seat >= 0 && msg.Seat < len(b.tickets) {
+					b.match.Forfeit(msg.Seat)
+				}
+			case WORKER_ABORT:
+				if b != nil {
+					b.match.Log.Info("lobby called off battle")
+					b.abort()
+				}
+			default:
+				slog.Warn("unexpected message from lobby", "type", msg.Type)
+			}
+
+		case conn := <-newClients:
+			go awaitJoin(conn, joins, stop)
+
+		case req := <-joins:
+			b := byTicket[req.ticket]
+			if b == nil {
+				req.conn.Log.Info("tried to join with a bad ticket")
+				req.conn.Send(kick{Reason: "that battle isn't here"})
+				go drain(req.conn)
+				break
+			}
+			delete(byTicket, req.ticket)
+			if err := b.join(req); err != nil {
+				req.conn.Log.Info("couldn't join battle", "match", b.match.ID, "err", err)
+				req.conn.Send(kick{Reason: err.Error()})
+				go drain(req.conn)
+			}
+
+		case b := <-timeouts:
+			if b.started {
+				break
+			}
+			for seat, joined := range b.joined {
+				if !joined {
+					b.match.Log.Info("player didn't join in time", "seat", seat)
+					delete(byTicket, b.tickets[seat])
+					b.match.Forfeit(seat)
+				}
+			}
+			b.start()
+
+		case match := <-finished:
+			b := battles[match.ID]
+			delete(battles, match.ID)
+			for _, ticket := range b.tickets {
+				delete(byTicket, ticket)
+			}
+			if lost == nil {
+				state, aborted := match.Result()
+				toLobby(workerMessage{Type: WORKER_RESULT, Match: match.ID, State: &state, Aborted: aborted})
+			}
+		}
+	}
+}
+
+// newWorkerBattle sets up a battle the lobby has assigned. It doesn't start until its players join.
+func newWorkerBattle(msg workerMessage) *workerBattle {
+	players := make([]Player, len(msg.Players))
+	b := &workerBattle{tickets: make([]string, len(msg.Players)),
+		joined: make([]bool, len(msg.Players))}
+	for i, p := range msg.Players {
+		archetype := p.Archetype
+		players[i] = NewPlayer()
+		players[i].Name = p.Name
+		players[i].Team = p.Team
+		players[i].SetArchetype(&archetype)
+		players[i].SetHandicap(p.Handicap)
+		b.tickets[i] = p.Ticket
+	}
+	b.match = newMatchWithID(context.Background(), msg.Match, players)
+	return b
+}
+
+func allJoined(joined []bool) bool {
+	for _, j := range joined {
+		if !j {
+			return false
+		}
+	}
+	return true
+}
+
+// awaitJoin waits for a player who's connected to the worker to say which battle they're joining. Anything else
+// gets them disconnected.
+func awaitJoin(conn ConnInfo, joins chan<- joinRequest, stop <-chan struct{}) {
+	msg, ok := <-conn.Inbound
+	if !ok {
+		return
+	}
+	if msg.Command != "JOIN" {
+		conn.Log.Info("didn't join a battle", "command", msg.Command)
+		conn.Send(kick{Reason: "this server only runs battles"})
+		drain(&conn)
+		return
+	}
+	select {
+	case joins <- joinRequest{conn: &conn, ticket: msg.Content}:
+	case <-stop:
+	}
+}
+
+// drain throws away whatever a client sends until it's gone, so its connection isn't left waiting to pass it on.
+func drain(conn *ConnInfo) {
+	for range conn.Inbound {
+	}
+}
+
+// forwardWorkerUpdates passes a player's updates on to them until the battle is over or they leave.
+func forwardWorkerUpdates(conn *ConnInfo, updates <-chan Update) {
+	for update := range updates {
+		if !conn.SendUpdate(update) {
+			return
+		}
+	}
+}
+
+// forwardInputs passes a player's inputs to their battle until they leave, which forfeits it.
+func forwardInputs(conn *ConnInfo, match *Match, seat int) {
+	for msg := range conn.Inbound {
+		match.Input(seat, msg)
+	}
+	match.Forfeit(seat)
+}
@@ -0,0 +1,464 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+// This file is the lobby's side of running battles on workers, which are other server processes started with
+// -lobby (see worker.go). Each worker connects to the lobby's /workers endpoint with a websocket, using the worker
+// token, and says where players can reach it. After that the lobby sends it matches to run, and it sends back how
+// they ended. Messages either way are workerMessages, as JSON.
+//
+// When a battle goes to a worker, the lobby still has a Match for it, so the dispatcher can treat it like any
+// other: the Match just passes forfeits and aborts along to the worker, and finishes when the worker says it has.
+// Nothing the dispatcher does waits on a worker. Messages to a worker are queued for its own goroutine to write,
+// and the battle only starts once the worker's answer to the assignment comes back to the dispatcher, as a
+// workerReply. If the worker turns it down, or doesn't answer in time, the lobby runs the battle itself.
+//
+// Each player's START GAME says where the worker is and has a ticket, which they join the battle there with. They
+// get their updates from the worker, but their result from the lobby, so they hear how the battle ended even if
+// they never made it to the worker, or it went away.
+//
+// Battles only go to workers when every player's client knows how to be handed off, and when there's no worker to
+// send them to, the lobby runs them itself.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// HANDOFF_PROTOCOL_VERSION is the first protocol version where clients understand being sent to a worker for
+// their battles.
+const HANDOFF_PROTOCOL_VERSION = 13
+
+// How long writing a message to a worker can take before the connection is given up on.
+const WORKER_WRITE_TIMEOUT = 5 * time.Second
+
+// How many messages can be waiting to be written to a worker. A worker that falls this far behind is disconnected.
+const WORKER_QUEUE_SIZE = 256
+
+// How long a worker has to answer an assignment before the lobby runs the battle itself.
+const WORKER_ACCEPT_TIMEOUT = 5 * time.Second
+
+// The shortest the worker token can be.
+const WORKER_TOKEN_MIN_LENGTH = 16
+
+// These are the values of workerMessage.Type.
+const (
+	// Worker to lobby only. A worker that's draining shouldn't be given any more battles, and turns down any it's
+	// given anyway.
+	WORKER_REGISTER = "register"
+	WORKER_ACCEPTED = "accepted"
+	WORKER_DECLINED = "declined"
+	WORKER_RESULT   = "result"
+	WORKER_DRAINING = "draining"
+	// Lobby to worker only.
+	WORKER_ASSIGN  = "assign"
+	WORKER_FORFEIT = "forfeit"
+	WORKER_ABORT   = "abort"
+)
+
+// workerMessage is what the lobby and its workers say to each other. Which fields are used depends on the Type.
+type workerMessage struct {
+	Type string `json:"type"`
+	// Where players connect to the worker, for WORKER_REGISTER.
+	URL string `json:"url,omitempty"`
+	// The match the message is about, for everything else but WORKER_DRAINING.
+	Match uint64 `json:"match,omitempty"`
+	// The players in the match, for WORKER_ASSIGN.
+	Mode    string           `json:"mode,omitempty"`
+	Rated   bool             `json:"rated,omitempty"`
+	Players []assignedPlayer `json:"players,omitempty"`
+	// The player who's giving up, for WORKER_FORFEIT.
+	Seat int `json:"seat,omitempty"`
+	// How the battle ended, for WORKER_RESULT.
+	State   *BattleState `json:"state,omitempty"`
+	Aborted bool         `json:"aborted,omitempty"`
+}
+
+// assignedPlayer is everything a worker needs to know about a player in a battle it's been given. The whole
+// archetype is sent, so the lobby's balance file is the one that counts.
+type assignedPlayer struct {
+	Name      string    `json:"name"`
+	Team      int       `json:"team"`
+	Archetype Archetype `json:"archetype"`
+	Handicap  Handicap  `json:"handicap"`
+	// What the player has to give the worker to join the battle.
+	Ticket string `json:"ticket"`
+}
+
+// Workers is the workers connected to this lobby, or nil if it doesn't take any. It's set from the config when the
+// server starts.
+var Workers *WorkerPool
+
+// WorkerPool keeps track of the workers connected to the lobby. It's safe to use from any goroutine.
+type WorkerPool struct {
+	mutex   sync.Mutex
+	workers map[*Worker]bool
+	// The workers' answers to their assignments come through here, for the dispatcher.
+	replies chan workerReply
+}
+
+// workerReply is a worker's answer to being given a battle. A worker that went away or didn't answer in time
+// counts as turning it down.
+type workerReply struct {
+	Match    *Match
+	Worker   *Worker
+	Accepted bool
+}
+
+func newWorkerPool() *WorkerPool {
+	return &WorkerPool{workers: make(map[*Worker]bool), replies: make(chan workerReply)}
+}
+
+// Replies returns the channel workers' answers to their assignments come through. It's nil if there's no pool, so
+// there's never anything on it.
+func (p *WorkerPool) Replies() <-chan workerReply {
+	if p == nil {
+		return nil
+	}
+	return p.replies
+}
+
+func (p *WorkerPool) add(w *Worker) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.workers[w] = true
+	metricWorkers.Set(len(p.workers))
+}
+
+func (p *WorkerPool) remove(w *Worker) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.workers, w)
+	metricWorkers.Set(len(p.workers))
+}
+
+// Len returns how many workers are connected.
+func (p *WorkerPool) Len() int {
+	if p == nil {
+		return 0
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.workers)
+}
+
+// pick returns the worker with the fewest battles going, or nil if there aren't any.
+func (p *WorkerPool) pick() *Worker {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var best *Worker
+	bestLoad := 0
+	for w := range p.workers {
+		if load := w.load(); best == nil || load < bestLoad {
+			best, bestLoad = w, load
+		}
+	}
+	return best
+}
+
+// Worker is the lobby's connection to one worker.
+type Worker struct {
+	// Where players connect to the worker, and where to log things about it.
+	URL string
+	Log *slog.Logger
+	// gone is closed once the connection to the worker is lost.
+	gone   chan struct{}
+	socket *websocket.Conn
+	// Messages waiting to be written to the worker, and what makes sure it's only disconnected once for falling
+	// behind.
+	outbound chan workerMessage
+	overflow sync.Once
+	replies  chan<- workerReply
+	// mutex protects the matches, which are the worker's battles that haven't ended, and which of them it hasn't
+	// answered the assignment for yet.
+	mutex   sync.Mutex
+	matches map[uint64]*Match
+	pending map[uint64]bool
+}
+
+func (w *Worker) load() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.matches)
+}
+
+// send queues a message for the worker without waiting. If the queue is full, the worker has fallen too far
+// behind, so it's disconnected, and dropped once its handler notices; send returns false then.
+func (w *Worker) send(msg workerMessage) bool {
+	select {
+	case w.outbound <- msg:
+		return true
+	default:
+		w.overflow.Do(func() {
+			w.Log.Warn("worker fell too far behind; disconnecting it", "type", msg.Type)
+			w.socket.Close()
+		})
+		return false
+	}
+}
+
+// write writes the queued messages to the worker until it's gone. A write failing closes the connection, so its
+// handler notices too.
+func (w *Worker) write() {
+	for {
+		select {
+		case msg := <-w.outbound:
+			w.socket.SetWriteDeadline(time.Now().Add(WORKER_WRITE_TIMEOUT))
+			if err := w.socket.WriteJSON(msg); err != nil {
+				w.Log.Warn("couldn't write to worker", "type", msg.Type, "err", err)
+				w.socket.Close()
+				return
+			}
+		case <-w.gone:
+			return
+		}
+	}
+}
+
+// assign offers a match that hasn't started yet to the worker. It returns the ticket each player needs to join
+// it. It doesn't wait for the worker's answer, which comes through the pool's Replies later.
+func (w *Worker) assign(match *Match, mode string, rated bool) ([]string, error) {
+	msg := workerMessage{Type: WORKER_ASSIGN, Match: match.ID, Mode: mode, Rated: rated,
+		Players: make([]assignedPlayer, len(match.players))}
+	tickets := make([]string, len(match.players))
+	for i, p := range match.players {
+		ticket, err := newTicket()
+		if err != nil {
+			return nil, err
+		}
+		tickets[i] = ticket
+		msg.Players[i] = assignedPlayer{Name: p.Name, Team: p.Team, Archetype: *p.Archetype, Handicap: p.Handicap,
+			Ticket: ticket}
+	}
+	// The match has to be ready for its result before the worker can possibly send it.
+	match.worker, match.results = w, make(chan workerMessage, 1)
+	w.mutex.Lock()
+	w.matches[match.ID], w.pending[match.ID] = match, true
+	w.mutex.Unlock()
+	if !w.send(msg) {
+		w.mutex.Lock()
+		delete(w.matches, match.ID)
+		delete(w.pending, match.ID)
+		w.mutex.Unlock()
+		match.worker, match.results = nil, nil
+		return nil, errors.New("worker isn't keeping up")
+	}
+	match.Log.Info("offered battle to worker", "worker", w.URL)
+	time.AfterFunc(WORKER_ACCEPT_TIMEOUT, func() {
+		if w.answer(match.ID, false) {
+			w.Log.Warn("worker didn't answer an assignment in time", "match", match.ID)
+			w.send(workerMessage{Type: WORKER_ABORT, Match: match.ID})
+		}
+	})
+	return tickets, nil
+}
+
+// answer passes on the worker's answer to an assignment to the dispatcher, if it hasn't already been answered.
+// It returns whether it had.
+func (w *Worker) answer(id uint64, accepted bool) bool {
+	w.mutex.Lock()
+	match := w.matches[id]
+	if !w.pending[id] {
+		w.mutex.Unlock()
+		return false
+	}
+	delete(w.pending, id)
+	if !accepted {
+		delete(w.matches, id)
+	}
+	w.mutex.Unlock()
+	w.replies <- workerReply{Match: match, Worker: w, Accepted: accepted}
+	return true
+}
+
+// answerAll turns down every assignment the worker hasn't answered, for when it's gone.
+func (w *Worker) answerAll() {
+	w.mutex.Lock()
+	var ids []uint64
+	for id := range w.pending {
+		ids = append(ids, id)
+	}
+	w.mutex.Unlock()
+	for _, id := range ids {
+		w.answer(id, false)
+	}
+}
+
+// finish passes a result from the worker to its match.
+func (w *Worker) finish(msg workerMessage) {
+	w.mutex.Lock()
+	match := w.matches[msg.Match]
+	delete(w.matches, msg.Match)
+	w.mutex.Unlock()
+	if match == nil || msg.State == nil {
+		w.Log.Warn("got a result for a battle that isn't going", "match", msg.Match)
+		return
+	}
+	match.results <- msg
+}
+
+// newTicket makes up a ticket for a player to join a battle on a worker with. It can't be guessed, so nobody else
+// can take their place.
+func newTicket() (string, error) {
+	ticket := make([]byte, 16)
+	if _, err := rand.Read(ticket); err != nil {
+		return "", errors.Wrap(err, "when making ticket")
+	}
+	return hex.EncodeToString(ticket), nil
+}
+
+// relay stands in for run when the battle is on a worker that's taken it. It passes forfeits and aborts along,
+// and finishes the match once the worker says how it ended. If the worker goes away, the battle is a no-contest.
+func (m *Match) relay() {
+	defer close(m.done)
+	defer m.cancel()
+	abort := m.ctx.Done()
+	for {
+		select {
+		case <-abort:
+			abort = nil
+			m.worker.send(workerMessage{Type: WORKER_ABORT, Match: m.ID})
+		case i := <-m.forfeits:
+			m.worker.send(workerMessage{Type: WORKER_FORFEIT, Match: m.ID, Seat: i})
+		case <-m.inputs:
+			// Players send their inputs to the worker themselves, so anything that comes here is too late.
+		case result := <-m.results:
+			m.final, m.aborted = *result.State, result.Aborted
+			m.finishRelay()
+			return
+		case <-m.worker.gone:
+			m.Log.Warn("lost the worker running the battle", "worker", m.worker.URL)
+			m.final = BattleState{TickRate: TickRate, Players: m.players}
+			m.aborted = true
+			m.finishRelay()
+			return
+		}
+	}
+}
+
+// finishRelay sends everyone the last update of the battle, which their result is made from, and logs how it
+// ended.
+func (m *Match) finishRelay() {
+	for i := range m.final.Players {
+		update := m.final.UpdateFor(i, nil)
+		if m.aborted {
+			update.Outcome = OUTCOME_NO_CONTEST
+		}
+		m.send(i, update)
+		close(m.updates[i])
+	}
+	if m.aborted {
+		m.Log.Info("battle called off", "ticks", m.final.Tick, "worker", m.worker.URL)
+	} else {
+		m.Log.Info("battle over", "ticks", m.final.Tick, "worker", m.worker.URL)
+	}
+}
+
+// handoff is what's needed to start a battle that's been offered to a worker, once it answers.
+type handoff struct {
+	sockets []*ConnInfo
+	starts  []Message
+	tickets []string
+}
+
+// handedOff starts a battle that was offered to a worker once the worker has answered: on the worker if it took
+// it, and here if it didn't.
+func handedOff(live *liveMatches, reply workerReply) {
+	info := live.matches[reply.Match]
+	h := info.handoff
+	if h == nil {
+		return
+	}
+	info.handoff = nil
+	if reply.Accepted {
+		for i := range h.starts {
+			h.starts[i].Server, h.starts[i].Ticket = reply.Worker.URL, h.tickets[i]
+		}
+		reply.Match.Log.Info("handed battle to worker", "worker", reply.Worker.URL)
+	} else {
+		reply.Match.Log.Warn("worker didn't take battle; running it here", "worker", reply.Worker.URL)
+		reply.Match.worker, reply.Match.results = nil, nil
+		info.Worker = ""
+	}
+	live.matches[reply.Match] = info
+	beginMatch(reply.Match, h.sockets, h.starts)
+}
+
+// canHandOff says whether every one of the given connections can be sent to a worker for a battle.
+func canHandOff(conns []*ConnInfo) bool {
+	for _, conn := range conns {
+		if conn.Version < HANDOFF_PROTOCOL_VERSION {
+			return false
+		}
+	}
+	return true
+}
+
+// handleWorkers accepts connections from workers that have the token, and adds them to the pool until they
+// disconnect.
+func handleWorkers(pool *WorkerPool, token string) http.Handler {
+	// Workers aren't browsers, so there's no origin to check.
+	upgrader := websocket.Upgrader{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			slog.Warn("worker tried to connect with the wrong token", "remote", r.RemoteAddr)
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		socket, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			slog.Warn("couldn't upgrade worker connection", "remote", r.RemoteAddr, "err", err)
+			return
+		}
+		defer socket.Close()
+		var hello workerMessage
+		if err := socket.ReadJSON(&hello); err != nil || hello.Type != WORKER_REGISTER || hello.URL == "" {
+			slog.Warn("worker didn't register", "remote", r.RemoteAddr, "err", err)
+			return
+		}
+		worker := &Worker{URL: hello.URL, Log: slog.Default().With("worker", hello.URL), gone: make(chan struct{}),
+			socket: socket, outbound: make(chan workerMessage, WORKER_QUEUE_SIZE), replies: pool.replies,
+			matches: make(map[uint64]*Match), pending: make(map[uint64]bool)}
+		worker.Log.Info("worker connected", "remote", r.RemoteAddr)
+		go worker.write()
+		pool.add(worker)
+		// Its battles are called off once it's out of the pool, so no more can be given to it.
+		defer close(worker.gone)
+		defer worker.answerAll()
+		defer pool.remove(worker)
+		for {
+			var msg workerMessage
+			if err := socket.ReadJSON(&msg); err != nil {
+				worker.Log.Warn("worker disconnected", "err", err)
+				return
+			}
+			switch msg.Type {
+			case WORKER_ACCEPTED, WORKER_DECLINED:
+				worker.answer(msg.Match, msg.Type == WORKER_ACCEPTED)
+			case WORKER_RESULT:
+				worker.finish(msg)
+			case WORKER_DRAINING:
+				worker.Log.Info("worker is draining")
+				pool.remove(worker)
+			default:
+				worker.Log.Warn("unexpected message from worker", "type", msg.Type)
+			}
+		}
+	})
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2019, Ryan Westlund.
+ * This code is under the BSD 3-Clause license.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+const TEST_WORKER_TOKEN = "test-worker-token-0123456789"
+
+// wsURL returns the ws:// URL of a test server.
+func wsURL(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// waitFor waits up to a second for cond to be true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// joinBattle connects to a worker the way the client does and joins a battle with the ticket.
+func joinBattle(t *testing.T, server, ticket string) *websocket.Conn {
+	socket, _, err := websocket.DefaultDialer.Dial(server, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, socket.WriteJSON(outboundEnvelope{Type: MSG_HELLO, Version: PROTOCOL_VERSION,
+		Payload: HelloPayload{Version: PROTOCOL_VERSION}}))
+	assert.Nil(t, socket.WriteJSON(outboundEnvelope{Type: MSG_COMMAND, Version: PROTOCOL_VERSION,
+		Payload: CommandPayload{Command: "JOIN", Arg: ticket}}))
+	return socket
+}
+
+// readUpdate reads the next update a worker sends a player.
+func readUpdate(t *testing.T, socket *websocket.Conn) Update {
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var env Envelope
+		if err := socket.ReadJSON(&env); err != nil {
+			t.Fatal("no update: ", err)
+		}
+		if env.Type == MSG_UPDATE {
+			var update Update
+			assert.Nil(t, json.Unmarshal(env.Payload, &update))
+			return update
+		}
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	defer func(pool *WorkerPool) { Workers = pool }(Workers)
+	Workers = newWorkerPool()
+	workersEndpoint := httptest.NewServer(handleWorkers(Workers, TEST_WORKER_TOKEN))
+	defer workersEndpoint.Close()
+	_, response, err := websocket.DefaultDialer.Dial(wsURL(workersEndpoint),
+		http.Header{"Authorization": {"Bearer wrong"}})
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	// The worker is a separate server, which players connect to the same way they connect to the lobby.
+	workerClients := make(chan ConnInfo)
+	battleServer := httptest.NewServer(handleConnection(workerClients, nil))
+	defer battleServer.Close()
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	workerStopped := make(chan error, 1)
+	go func() {
+		workerStopped <- runWorker(workerCtx, workerClients, wsURL(workersEndpoint), wsURL(battleServer),
+			TEST_WORKER_TOKEN)
+	}()
+	waitFor(t, "the worker to register", func() bool { return Workers.Len() == 1 })
+
+	path := filepath.Join(t.TempDir(), "results")
+	results, err := OpenResultLog(path)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	newClients := make(chan ConnInfo)
+	stopped := make(chan struct{})
+	go func() {
+		dispatcher(ctx, newClients, nil, results)
+		close(stopped)
+	}()
+	var conns []ConnInfo
+	var lobbies []<-chan interface{}
+	for _, name := range []string{"a", "b"} {
+		conn, lobby := fakeConn(newClients, "127.0.0.1")
+		defer close(conn.Done)
+		conn.Inbound <- Message{Username: name, Command: "SETNAME"}
+		conns, lobbies = append(conns, conn), append(lobbies, lobby)
+	}
+	// duel readies both players, and returns their connections to the worker once they've joined the battle there.
+	duel := func() []*websocket.Conn {
+		var sockets []*websocket.Conn
+		for _, conn := range conns {
+			conn.Inbound <- Message{Content: "duel", Command: "READY"}
+		}
+		for _, lobby := range lobbies {
+			start := expect(t, lobby).(Message)
+			assert.Equal(t, "START GAME", start.Command)
+			assert.Equal(t, wsURL(battleServer), start.Server)
+			assert.NotEqual(t, "", start.Ticket)
+			sockets = append(sockets, joinBattle(t, start.Server, start.Ticket))
+		}
+		return sockets
+	}
+	finished := func() uint64 {
+		return metricBattlesFinished.Value("duel", "completed") + metricBattlesFinished.Value("duel", "no_contest")
+	}
+
+	// The battle happens on the worker, and the players get their results from the lobby once it's over.
+	before := finished()
+	sockets := duel()
+	readUpdate(t, sockets[0])
+	assert.Nil(t, sockets[1].WriteJSON(outboundEnvelope{Type: MSG_COMMAND, Version: PROTOCOL_VERSION,
+		Payload: CommandPayload{Command: "FORFEIT"}}))
+	assert.Equal(t, "win", expect(t, lobbies[0]).(ResultPayload).Outcome)
+	assert.Equal(t, "loss", expect(t, lobbies[1]).(ResultPayload).Outcome)
+	waitFor(t, "the lobby to record the battle", func() bool { return finished() == before+1 })
+	for i, conn := range conns {
+		sockets[i].Close()
+		conn.Inbound <- Message{Command: "END MATCH"}
+	}
+
+	// Players with a ticket for a battle that isn't there are sent away.
+	socket := joinBattle(t, wsURL(battleServer), "nonsense")
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	for err == nil {
+		_, _, err = socket.ReadMessage()
+	}
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation))
+
+	// When the worker stops, its battles are called off.
+	sockets = duel()
+	stopWorker()
+	for i, lobby := range lobbies {
+		assert.Equal(t, OUTCOME_NO_CONTEST, expect(t, lobby).(ResultPayload).Outcome)
+		sockets[i].Close()
+	}
+	assert.Nil(t, <-workerStopped)
+	waitFor(t, "the worker to leave", func() bool { return Workers.Len() == 0 })
+
+	cancel()
+	<-stopped
+	assert.Nil(t, results.Close())
+	records := readResults(t, path)
+	assert.Equal(t, 2, len(records))
+	// Seats go in whatever order matchmaking put them in, so players are found by name.
+	for _, p := range records[0].Players {
+		assert.Equal(t, map[string]string{"a": "win", "b": "loss"}[p.Name], p.Outcome)
+	}
+	assert.Equal(t, DEFAULT_ARCHETYPE, records[0].Players[0].Archetype)
+	assert.Equal(t, OUTCOME_NO_CONTEST, records[1].Players[0].Outcome)
+}
+
+func TestWorkerTurnsDownBattle(t *testing.T) {
+	defer func(pool *WorkerPool) { Workers = pool }(Workers)
+	Workers = newWorkerPool()
+	workersEndpoint := httptest.NewServer(handleWorkers(Workers, TEST_WORKER_TOKEN))
+	defer workersEndpoint.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	newClients := make(chan ConnInfo)
+	stopped := make(chan struct{})
+	go func() {
+		dispatcher(ctx, newClients, nil, nil)
+		close(stopped)
+	}()
+	var conns []ConnInfo
+	var lobbies []<-chan interface{}
+	for _, name := range []string{"a", "b"} {
+		conn, lobby := fakeConn(newClients, "127.0.0.1")
+		defer close(conn.Done)
+		conn.Inbound <- Message{Username: name, Command: "SETNAME"}
+		conns, lobbies = append(conns, conn), append(lobbies, lobby)
+	}
+	// fakeWorker registers with the lobby and waits to be offered a battle.
+	fakeWorker := func() (*websocket.Conn, workerMessage) {
+		socket, _, err := websocket.DefaultDialer.Dial(wsURL(workersEndpoint),
+			http.Header{"Authorization": {"Bearer " + TEST_WORKER_TOKEN}})
+		assert.Nil(t, err)
+		assert.Nil(t, socket.WriteJSON(workerMessage{Type: WORKER_REGISTER, URL: "ws://worker.example/ws"}))
+		waitFor(t, "the worker to register", func() bool { return Workers.Len() == 1 })
+		for _, conn := range conns {
+			conn.Inbound <- Message{Content: "duel", Command: "READY"}
+		}
+		var assign workerMessage
+		socket.SetReadDeadline(time.Now().Add(time.Second))
+		assert.Nil(t, socket.ReadJSON(&assign))
+		assert.Equal(t, WORKER_ASSIGN, assign.Type)
+		return socket, assign
+	}
+	// playHere checks that the battle is run by the lobby, and finishes it.
+	playHere := func() {
+		for _, lobby := range lobbies {
+			start := expect(t, lobby).(Message)
+			assert.Equal(t, "START GAME", start.Command)
+			assert.Equal(t, "", start.Server)
+		}
+		conns[0].Inbound <- Message{Command: "FORFEIT"}
+		for i, lobby := range lobbies {
+			assert.NotEqual(t, "", expect(t, lobby).(ResultPayload).Outcome)
+			conns[i].Inbound <- Message{Command: "END MATCH"}
+		}
+	}
+
+	// A worker that turns the battle down leaves it to the lobby.
+	socket, assign := fakeWorker()
+	assert.Nil(t, socket.WriteJSON(workerMessage{Type: WORKER_DECLINED, Match: assign.Match}))
+	playHere()
+	socket.Close()
+	waitFor(t, "the worker to leave", func() bool { return Workers.Len() == 0 })
+
+	// So does one that goes away before answering.
+	socket, _ = fakeWorker()
+	socket.Close()
+	playHere()
+
+	cancel()
+	<-stopped
+}
+
+func TestWorkerBattleJoin(t *testing.T) {
+	assign := func() *workerBattle {
+		archetype := *getArchetypeByName(DEFAULT_ARCHETYPE)
+		return newWorkerBattle(workerMessage{Type: WORKER_ASSIGN, Match: 7, Mode: "duel", Players: []assignedPlayer{
+			{Name: "a", Archetype: archetype, Ticket: "ticket-a"},
+			{Name: "b", Team: 1, Archetype: archetype, Ticket: "ticket-b"}}})
+	}
+	join := func(b *workerBattle, ticket string) error {
+		// The player leaves right away, which forfeits the battle, so it doesn't take long.
+		conn := newConnInfo(nextConnID(), slog.Default(), "127.0.0.1")
+		close(conn.Inbound)
+		close(conn.Done)
+		return b.join(joinRequest{conn: &conn, ticket: ticket})
+	}
+
+	// The battle starts once everyone's joined.
+	b := assign()
+	assert.Nil(t, join(b, "ticket-b"))
+	assert.False(t, b.started)
+	assert.Nil(t, join(b, "ticket-a"))
+	assert.True(t, b.started)
+	<-b.match.Done()
+
+	// A battle that's been called off is left to finish without anyone else.
+	b = assign()
+	b.abort()
+	assert.NotNil(t, join(b, "ticket-a"))
+	_, aborted := b.match.Result()
+	assert.True(t, aborted)
+}